@@ -5,7 +5,9 @@ import (
 	"net/http"
 
 	"github.com/bh107/tapr/api/cmd"
+	"github.com/bh107/tapr/api/lib"
 	"github.com/bh107/tapr/api/obj"
+	"github.com/bh107/tapr/api/s3"
 	"github.com/bh107/tapr/api/vol"
 	"github.com/bh107/tapr/server"
 	"github.com/gorilla/mux"
@@ -39,9 +41,38 @@ func (w Wrapper) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 var routes = []Route{
 	{"cmd/audit", "PATCH", "/cmd/audit/{library}", cmd.Audit},
+	{"cmd/reclaim", "PATCH", "/cmd/reclaim", cmd.Reclaim},
 	{"vol/list", "GET", "/vol/list/{library}", vol.List},
+	{"vol/state", "PUT", "/vol/state/{serial}", vol.SetState},
+	{"lib/import", "POST", "/lib/{library}/import", lib.Import},
+	{"lib/export", "POST", "/lib/{library}/export", lib.Export},
+	{"lib/export/list", "GET", "/lib/{library}/export", lib.Exports},
+	{"lib/vault", "GET", "/lib/{library}/vault", lib.Vault},
+	{"obj/list", "GET", "/obj", obj.List},
 	{"obj/store", "PUT", "/obj/{id}", obj.Store},
 	{"obj/retrieve", "GET", "/obj/{id}", obj.Retrieve},
+	{"obj/stat", "HEAD", "/obj/{id}", obj.Stat},
+	{"obj/delete", "DELETE", "/obj/{id}", obj.Delete},
+	{"obj/upload/initiate", "POST", "/obj/{id}/uploads", obj.InitiateUpload},
+	{"obj/upload/part", "PUT", "/obj/{id}/uploads/{upload}/{part}", obj.StorePart},
+	{"obj/upload/list", "GET", "/obj/{id}/uploads/{upload}", obj.ListParts},
+	{"obj/upload/complete", "POST", "/obj/{id}/uploads/{upload}", obj.CompleteUpload},
+	{"obj/upload/abort", "DELETE", "/obj/{id}/uploads/{upload}", obj.AbortUpload},
+	{"obj/recall", "POST", "/obj/{id}/recall", obj.Recall},
+	{"obj/recall/status", "GET", "/obj/{id}/recall", obj.RecallStatus},
+
+	// S3 compatible routes; they must come last, since buckets match any
+	// path not taken by the routes above
+	{"s3/buckets", "GET", "/", s3.ListBuckets},
+	{"s3/bucket/create", "PUT", "/{bucket}", s3.CreateBucket},
+	{"s3/bucket/head", "HEAD", "/{bucket}", s3.HeadBucket},
+	{"s3/bucket/delete", "DELETE", "/{bucket}", s3.DeleteBucket},
+	{"s3/bucket/list", "GET", "/{bucket}", s3.ListObjects},
+	{"s3/object/put", "PUT", "/{bucket}/{key:.+}", s3.PutObject},
+	{"s3/object/get", "GET", "/{bucket}/{key:.+}", s3.GetObject},
+	{"s3/object/head", "HEAD", "/{bucket}/{key:.+}", s3.HeadObject},
+	{"s3/object/delete", "DELETE", "/{bucket}/{key:.+}", s3.DeleteObject},
+	{"s3/object/post", "POST", "/{bucket}/{key:.+}", s3.PostObject},
 }
 
 // build routes from routes.go and wrap them with net/context
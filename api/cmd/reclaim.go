@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/server"
+)
+
+// Reclaim repacks volumes with little live data and responds with the serials
+// of the volumes returned to the scratch pool.
+func Reclaim(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reclaimed, err := srv.Reclaim(ctx)
+	if err != nil {
+		log.Print(err)
+
+		http.Error(rw, fmt.Sprintf("cmd/reclaim failed: %s", err),
+			http.StatusInternalServerError,
+		)
+
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(rw).Encode(reclaimed); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,141 @@
+// Package lib implements the operator API of the libraries, moving volumes in
+// and out of the library through its mail slots.
+package lib
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/inventory"
+	"github.com/bh107/tapr/server"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// ExportRequest lists the volumes to export.
+type ExportRequest struct {
+	Volumes []string `json:"volumes"`
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		libError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(js)
+}
+
+// libError responds with the status matching err.
+func libError(rw http.ResponseWriter, err error) {
+	switch errors.Cause(err) {
+	case server.ErrNoSuchLibrary, inventory.ErrNoSuchVolume:
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+
+	case server.ErrNotInLibrary, server.ErrVolumeBusy:
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if _, ok := errors.Cause(err).(*inventory.TransitionError); ok {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+
+	log.Print(err)
+	http.Error(rw, err.Error(), http.StatusInternalServerError)
+}
+
+// Import moves the volumes in the mail slots into the library. Unknown volumes
+// are registered as scratch volumes, or as readonly volumes if the foreign
+// parameter is true.
+func Import(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	var foreign bool
+	if v := req.URL.Query().Get("foreign"); v != "" {
+		var err error
+		if foreign, err = strconv.ParseBool(v); err != nil {
+			http.Error(rw, "invalid foreign parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	imports, err := srv.Import(ctx, vars["library"], foreign)
+	if err != nil {
+		libError(rw, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, imports)
+}
+
+// Export moves the requested volumes to the mail slots. If some are queued
+// because the mail slots are full, the request is accepted.
+func Export(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	var exportReq ExportRequest
+	if err := json.NewDecoder(req.Body).Decode(&exportReq); err != nil || len(exportReq.Volumes) == 0 {
+		http.Error(rw, "expected a list of volumes", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	jobs, err := srv.Export(ctx, vars["library"], exportReq.Volumes)
+	if err != nil {
+		libError(rw, err)
+		return
+	}
+
+	status := http.StatusOK
+	for _, job := range jobs {
+		if job.State == server.ExportQueued {
+			status = http.StatusAccepted
+		}
+	}
+
+	writeJSON(rw, status, jobs)
+}
+
+// Exports lists the volumes queued for export.
+func Exports(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	jobs, err := srv.Exports(vars["library"])
+	if err != nil {
+		libError(rw, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, jobs)
+}
+
+// Vault reports which full volumes should be rotated offsite.
+func Vault(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	report, err := srv.VaultReport(ctx, vars["library"])
+	if err != nil {
+		libError(rw, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, report)
+}
@@ -0,0 +1,73 @@
+package obj
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bh107/tapr/server"
+)
+
+// digestAlgs maps RFC 3230 digest algorithm names to server digests.
+var digestAlgs = map[string]struct {
+	alg  string
+	size int
+}{
+	"md5":     {server.DigestMD5, md5.Size},
+	"sha-256": {server.DigestSHA256, sha256.Size},
+}
+
+// ParseDigests returns the digests supplied by the client in the Content-MD5
+// and Digest (RFC 3230) headers. Digest algorithms not supported by the server
+// are ignored.
+func ParseDigests(req *http.Request) ([]server.Digest, error) {
+	var digests []server.Digest
+
+	if v := req.Header.Get("Content-MD5"); v != "" {
+		sum, err := decodeDigest(v, md5.Size)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Content-MD5: %v", err)
+		}
+
+		digests = append(digests, server.Digest{Alg: server.DigestMD5, Sum: sum})
+	}
+
+	for _, v := range req.Header["Digest"] {
+		for _, instance := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(instance), "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid Digest: %s", instance)
+			}
+
+			alg, ok := digestAlgs[strings.ToLower(kv[0])]
+			if !ok {
+				continue
+			}
+
+			sum, err := decodeDigest(kv[1], alg.size)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Digest: %v", err)
+			}
+
+			digests = append(digests, server.Digest{Alg: alg.alg, Sum: sum})
+		}
+	}
+
+	return digests, nil
+}
+
+func decodeDigest(v string, size int) ([]byte, error) {
+	sum, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sum) != size {
+		return nil, fmt.Errorf("expected %d bytes, got %d", size, len(sum))
+	}
+
+	return sum, nil
+}
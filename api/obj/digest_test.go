@@ -0,0 +1,65 @@
+package obj
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/bh107/tapr/server"
+)
+
+func TestParseDigests(t *testing.T) {
+	data := []byte("the tape custodian")
+	md5sum := md5.Sum(data)
+	shasum := sha256.Sum256(data)
+
+	req, err := http.NewRequest("PUT", "/obj/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5sum[:]))
+	req.Header.Set("Digest", "UNIXsum=42, SHA-256="+base64.StdEncoding.EncodeToString(shasum[:]))
+
+	digests, err := ParseDigests(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []server.Digest{
+		{Alg: server.DigestMD5, Sum: md5sum[:]},
+		{Alg: server.DigestSHA256, Sum: shasum[:]},
+	}
+
+	if len(digests) != len(expected) {
+		t.Fatalf("expected %d digests, got %d", len(expected), len(digests))
+	}
+
+	for i := range expected {
+		if digests[i].Alg != expected[i].Alg || !bytes.Equal(digests[i].Sum, expected[i].Sum) {
+			t.Errorf("digest %d: expected %v, got %v", i, expected[i], digests[i])
+		}
+	}
+}
+
+func TestParseDigestsInvalid(t *testing.T) {
+	for _, hdr := range [][2]string{
+		{"Content-MD5", "not base64!"},
+		{"Content-MD5", base64.StdEncoding.EncodeToString([]byte("short"))},
+		{"Digest", "SHA-256"},
+	} {
+		req, err := http.NewRequest("PUT", "/obj/test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set(hdr[0], hdr[1])
+
+		if _, err := ParseDigests(req); err == nil {
+			t.Errorf("%s: %s: expected error", hdr[0], hdr[1])
+		}
+	}
+}
@@ -1,22 +1,72 @@
 package obj
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/bh107/tapr/inventory"
 	"github.com/bh107/tapr/server"
 	"github.com/bh107/tapr/stream/policy"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 )
 
+// Status describes an archive.
 type Status struct {
-	ID string
+	ID      string         `json:"id"`
+	Size    int64          `json:"size"`
+	Chunks  int            `json:"chunks"`
+	Created time.Time      `json:"created"`
+	Policy  *policy.Policy `json:"policy"`
+	SHA256  string         `json:"sha256"`
+	Volumes []string       `json:"volumes"`
+
+	// Spooled is set while the archive is in the disk spool.
+	Spooled bool `json:"spooled,omitempty"`
+}
+
+func newStatus(ar *server.Archive) *Status {
+	st := &Status{
+		ID:      ar.Name,
+		Size:    ar.Size,
+		Chunks:  ar.Chunks(),
+		Created: ar.Created,
+		Policy:  ar.Policy,
+		SHA256:  ar.SHA256,
+		Volumes: make([]string, 0),
+		Spooled: ar.Spooled,
+	}
+
+	for _, vol := range ar.Volumes() {
+		st.Volumes = append(st.Volumes, vol.Serial)
+	}
+
+	return st
 }
 
+// Listing is the result of listing archives.
+type Listing struct {
+	Archives []*Status `json:"archives"`
+
+	// Next is set if there may be more archives. Pass it as the after
+	// parameter to continue listing.
+	Next string `json:"next,omitempty"`
+}
+
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 10000
+)
+
 func internalServerError(rw http.ResponseWriter, err error) {
 	log.Print(err)
 	http.Error(rw, err.Error(), http.StatusInternalServerError)
@@ -45,23 +95,49 @@ func Store(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
 
 	pol, err := policy.Construct(req)
 	if err != nil {
-		panic(err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	ctx = policy.Wrap(ctx, pol)
 
+	expect, err := ParseDigests(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	if archive, ok := vars["id"]; ok {
 		if err := srv.Create(ctx, archive); err != nil {
 			internalServerError(rw, err)
 			return
 		}
 
-		if err := srv.Store(ctx, archive, req.Body); err != nil {
+		receipt, err := srv.Store(ctx, archive, req.Body, expect...)
+		if err != nil {
+			if _, ok := err.(server.ErrDigestMismatch); ok {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			// the write may be retried once the spool is migrated
+			if errors.Cause(err) == server.ErrSpoolFull {
+				http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+
 			internalServerError(rw, err)
 			return
 		}
 
-		fmt.Fprint(rw, "OK")
+		js, err := json.Marshal(receipt)
+		if err != nil {
+			internalServerError(rw, err)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(js)
 		return
 	}
 
@@ -69,19 +145,141 @@ func Store(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
 }
 
 func Retrieve(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
-	/*
-		vars := mux.Vars(req)
+	vars := mux.Vars(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if archive, ok := vars["id"]; ok {
+		rw.Header().Set("Content-Type", "application/octet-stream")
+
+		if err := srv.Retrieve(ctx, archive, rw); err != nil {
+			switch errors.Cause(err) {
+			case server.ErrNoSuchArchive:
+				http.Error(rw, err.Error(), http.StatusNotFound)
+				return
+
+			case inventory.ErrOffsite:
+				// the archive must be recalled once the volume is imported
+				http.Error(rw, err.Error(), http.StatusConflict)
+				return
+			}
+
+			internalServerError(rw, err)
+			return
+		}
+
+		return
+	}
+
+	http.Error(rw, "Bad Request", http.StatusBadRequest)
+}
+
+// Stat describes the archive in the response headers.
+func Stat(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if archive, ok := vars["id"]; ok {
+		ar, err := srv.Stat(ctx, archive)
+		if err != nil {
+			if errors.Cause(err) == server.ErrNoSuchArchive {
+				http.Error(rw, err.Error(), http.StatusNotFound)
+				return
+			}
+
+			internalServerError(rw, err)
+			return
+		}
 
-			if archive, ok := vars["id"]; ok {
-				if err := srv.Retrieve(rw, archive); err != nil {
-					log.Print(err)
-					http.Error(rw, err.Error(), http.StatusInternalServerError)
-					return
-				}
+		st := newStatus(ar)
 
+		h := rw.Header()
+		h.Set("Content-Length", strconv.FormatInt(st.Size, 10))
+		h.Set("Last-Modified", st.Created.Format(http.TimeFormat))
+		h.Set("Archive-Chunks", strconv.Itoa(st.Chunks))
+		h.Set("Archive-Volumes", strings.Join(st.Volumes, ","))
+
+		if sum, err := hex.DecodeString(st.SHA256); err == nil && len(sum) > 0 {
+			h.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum))
+		}
+
+		if st.Policy != nil {
+			st.Policy.Header(h)
+		}
+
+		rw.WriteHeader(http.StatusOK)
+		return
+	}
+
+	http.Error(rw, "Bad Request", http.StatusBadRequest)
+}
+
+// List lists archives. The prefix, after and limit query parameters restrict
+// the listing.
+func List(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := req.URL.Query()
+
+	limit := defaultListLimit
+	if v := q.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			http.Error(rw, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	archives, err := srv.List(ctx, q.Get("prefix"), q.Get("after"), limit)
+	if err != nil {
+		internalServerError(rw, err)
+		return
+	}
+
+	listing := &Listing{Archives: make([]*Status, 0, len(archives))}
+	for _, ar := range archives {
+		listing.Archives = append(listing.Archives, newStatus(ar))
+	}
+
+	if len(archives) == limit {
+		listing.Next = archives[len(archives)-1].Name
+	}
+
+	js, err := json.Marshal(listing)
+	if err != nil {
+		internalServerError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
+
+func Delete(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if archive, ok := vars["id"]; ok {
+		if err := srv.Delete(ctx, archive); err != nil {
+			if errors.Cause(err) == server.ErrNoSuchArchive {
+				http.Error(rw, err.Error(), http.StatusNotFound)
 				return
 			}
-	*/
 
-	http.Error(rw, "Not implemented", http.StatusNotImplemented)
+			internalServerError(rw, err)
+			return
+		}
+
+		fmt.Fprint(rw, "OK")
+		return
+	}
+
+	http.Error(rw, "Bad Request", http.StatusBadRequest)
 }
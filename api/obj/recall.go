@@ -0,0 +1,73 @@
+package obj
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/server"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// recallError responds with the status matching err.
+func recallError(rw http.ResponseWriter, err error) {
+	switch errors.Cause(err) {
+	case server.ErrNoSuchArchive, server.ErrNoSuchRecall:
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+
+	case server.ErrRecallDisabled:
+		http.Error(rw, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	internalServerError(rw, err)
+}
+
+// writeRecall responds with the recall job. Jobs that are not done yet,
+// including jobs waiting for offsite volumes to be imported, are accepted.
+func writeRecall(rw http.ResponseWriter, req *http.Request, job *server.RecallJob) {
+	rw.Header().Set("Location", req.URL.Path)
+
+	switch job.State {
+	case server.RecallQueued, server.RecallStaging, server.RecallOffsite:
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusAccepted)
+	}
+
+	writeJSON(rw, job)
+}
+
+// Recall queues the archive to be staged from tape to the recall cache, from
+// which it is retrieved once ready.
+func Recall(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	job, err := srv.Recall(ctx, vars["id"])
+	if err != nil {
+		recallError(rw, err)
+		return
+	}
+
+	writeRecall(rw, req, job)
+}
+
+// RecallStatus describes the recall job of the archive.
+func RecallStatus(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	job, err := srv.RecallStatus(ctx, vars["id"])
+	if err != nil {
+		recallError(rw, err)
+		return
+	}
+
+	writeRecall(rw, req, job)
+}
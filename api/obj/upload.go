@@ -0,0 +1,165 @@
+package obj
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/server"
+	"github.com/bh107/tapr/stream/policy"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// Upload identifies a multipart upload.
+type Upload struct {
+	Archive string `json:"archive"`
+	Upload  string `json:"upload"`
+}
+
+// Completion lists the parts making up the archive of a completed multipart
+// upload.
+type Completion struct {
+	Parts []*server.PartInfo `json:"parts"`
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		internalServerError(rw, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
+
+// uploadError responds with the status matching err.
+func uploadError(rw http.ResponseWriter, err error) {
+	switch errors.Cause(err) {
+	case server.ErrNoSuchUpload, server.ErrNoSuchArchive:
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if _, ok := err.(server.ErrDigestMismatch); ok {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	internalServerError(rw, err)
+}
+
+// InitiateUpload starts a multipart upload. The write policy headers apply to
+// all parts.
+func InitiateUpload(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pol, err := policy.Construct(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx = policy.Wrap(ctx, pol)
+
+	id, err := srv.InitiateUpload(ctx, vars["id"])
+	if err != nil {
+		internalServerError(rw, err)
+		return
+	}
+
+	writeJSON(rw, &Upload{Archive: vars["id"], Upload: id})
+}
+
+// StorePart stores a part of a multipart upload. A part that was uploaded
+// before is replaced.
+func StorePart(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n, err := strconv.Atoi(vars["part"])
+	if err != nil {
+		http.Error(rw, "invalid part number", http.StatusBadRequest)
+		return
+	}
+
+	expect, err := ParseDigests(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	part, err := srv.StorePart(ctx, vars["id"], vars["upload"], n, req.Body, expect...)
+	if err != nil {
+		uploadError(rw, err)
+		return
+	}
+
+	rw.Header().Set("ETag", strconv.Quote(part.ETag))
+	writeJSON(rw, part)
+}
+
+// ListParts lists the uploaded parts of a multipart upload.
+func ListParts(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	parts, err := srv.ListParts(ctx, vars["id"], vars["upload"])
+	if err != nil {
+		uploadError(rw, err)
+		return
+	}
+
+	writeJSON(rw, &Completion{Parts: parts})
+}
+
+// CompleteUpload completes a multipart upload. The request body may list the
+// parts making up the archive; all uploaded parts are used otherwise.
+func CompleteUpload(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	completion := new(Completion)
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(completion); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	receipt, err := srv.CompleteUpload(ctx, vars["id"], vars["upload"], completion.Parts)
+	if err != nil {
+		uploadError(rw, err)
+		return
+	}
+
+	writeJSON(rw, receipt)
+}
+
+// AbortUpload aborts a multipart upload.
+func AbortUpload(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := srv.AbortUpload(ctx, vars["id"], vars["upload"]); err != nil {
+		uploadError(rw, err)
+		return
+	}
+
+	fmt.Fprint(rw, "OK")
+}
@@ -0,0 +1,662 @@
+// Package s3 implements a subset of the Amazon S3 REST API on top of the
+// server. Buckets are namespaces of archives and objects are archives named by
+// the bucket and object key. Requests are not authenticated and the aws-chunked
+// payload encoding is not supported.
+package s3
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/api/obj"
+	"github.com/bh107/tapr/inventory"
+	"github.com/bh107/tapr/server"
+	"github.com/bh107/tapr/stream/policy"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMaxKeys = 1000
+
+	// storageClass is reported for all objects.
+	storageClass = "GLACIER"
+)
+
+// errorCodes maps server errors to S3 error codes and status codes.
+var errorCodes = map[error]struct {
+	code   string
+	status int
+}{
+	server.ErrNoSuchArchive:  {"NoSuchKey", http.StatusNotFound},
+	server.ErrNoSuchBucket:   {"NoSuchBucket", http.StatusNotFound},
+	server.ErrNoSuchUpload:   {"NoSuchUpload", http.StatusNotFound},
+	server.ErrBucketExists:   {"BucketAlreadyOwnedByYou", http.StatusConflict},
+	server.ErrBucketNotEmpty: {"BucketNotEmpty", http.StatusConflict},
+	server.ErrInvalidBucket:  {"InvalidBucketName", http.StatusBadRequest},
+	server.ErrSpoolFull:      {"SlowDown", http.StatusServiceUnavailable},
+
+	// the object must be restored once its volumes are imported
+	inventory.ErrOffsite: {"InvalidObjectState", http.StatusForbidden},
+}
+
+// writeError responds with an S3 error document describing err.
+func writeError(rw http.ResponseWriter, req *http.Request, err error) {
+	code, status := "InternalError", http.StatusInternalServerError
+
+	if e, ok := errorCodes[errors.Cause(err)]; ok {
+		code, status = e.code, e.status
+	} else if _, ok := errors.Cause(err).(server.ErrDigestMismatch); ok {
+		code, status = "BadDigest", http.StatusBadRequest
+	} else {
+		log.Print(err)
+	}
+
+	writeErrorCode(rw, req, code, err.Error(), status)
+}
+
+func writeErrorCode(rw http.ResponseWriter, req *http.Request, code string, msg string, status int) {
+	// responses to HEAD requests have no body
+	if req.Method == "HEAD" {
+		rw.WriteHeader(status)
+		return
+	}
+
+	writeXML(rw, status, &Error{
+		Code:     code,
+		Message:  msg,
+		Resource: req.URL.Path,
+	})
+}
+
+func writeXML(rw http.ResponseWriter, status int, v interface{}) {
+	buf, err := xml.Marshal(v)
+	if err != nil {
+		log.Print(err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/xml")
+	rw.WriteHeader(status)
+	rw.Write([]byte(xml.Header))
+	rw.Write(buf)
+}
+
+func quote(etag string) string {
+	return strconv.Quote(etag)
+}
+
+func unquote(etag string) string {
+	return strings.Trim(etag, `"`)
+}
+
+// ListBuckets lists all buckets.
+func ListBuckets(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	buckets, err := srv.Buckets(ctx)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	res := &ListAllMyBucketsResult{
+		Xmlns: xmlns,
+		Owner: owner,
+	}
+
+	for _, b := range buckets {
+		res.Buckets = append(res.Buckets, BucketEntry{
+			Name:         b.Name,
+			CreationDate: formatTime(b.Created),
+		})
+	}
+
+	writeXML(rw, http.StatusOK, res)
+}
+
+// CreateBucket creates a bucket.
+func CreateBucket(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bucket := mux.Vars(req)["bucket"]
+
+	if err := srv.CreateBucket(ctx, bucket); err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	rw.Header().Set("Location", "/"+bucket)
+	rw.WriteHeader(http.StatusOK)
+}
+
+// HeadBucket reports whether a bucket exists.
+func HeadBucket(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := srv.Bucket(ctx, mux.Vars(req)["bucket"]); err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+// DeleteBucket deletes an empty bucket.
+func DeleteBucket(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := srv.DeleteBucket(ctx, mux.Vars(req)["bucket"]); err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// ListObjects lists the objects in a bucket as done by ListObjectsV2.
+func ListObjects(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bucket := mux.Vars(req)["bucket"]
+	q := req.URL.Query()
+
+	if _, ok := q["uploads"]; ok {
+		writeErrorCode(rw, req, "NotImplemented", "listing multipart uploads is not supported", http.StatusNotImplemented)
+		return
+	}
+
+	if _, err := srv.Bucket(ctx, bucket); err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	res := &ListBucketResult{
+		Xmlns:             xmlns,
+		Name:              bucket,
+		Prefix:            q.Get("prefix"),
+		Delimiter:         q.Get("delimiter"),
+		StartAfter:        q.Get("start-after"),
+		ContinuationToken: q.Get("continuation-token"),
+		MaxKeys:           defaultMaxKeys,
+	}
+
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeErrorCode(rw, req, "InvalidArgument", "invalid max-keys", http.StatusBadRequest)
+			return
+		}
+
+		if n < res.MaxKeys {
+			res.MaxKeys = n
+		}
+	}
+
+	// listing continues after the archive named by the token
+	after := ""
+	if res.StartAfter != "" {
+		after = server.ObjectArchive(bucket, res.StartAfter)
+	}
+
+	if res.ContinuationToken != "" {
+		buf, err := base64.URLEncoding.DecodeString(res.ContinuationToken)
+		if err != nil {
+			writeErrorCode(rw, req, "InvalidArgument", "invalid continuation token", http.StatusBadRequest)
+			return
+		}
+
+		after = string(buf)
+	}
+
+	next, err := list(ctx, srv, res, after)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	if next != "" {
+		res.IsTruncated = true
+		res.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(next))
+	}
+
+	writeXML(rw, http.StatusOK, res)
+}
+
+// list fills in the contents and common prefixes of res with archives sorting
+// after the archive named after. It returns the name to continue listing
+// after if the listing is truncated.
+func list(ctx context.Context, srv *server.Server, res *ListBucketResult, after string) (string, error) {
+	base := server.ObjectArchive(res.Name, "")
+	prefix := base + res.Prefix
+
+	seen := make(map[string]bool)
+
+	for res.KeyCount < res.MaxKeys {
+		archives, err := srv.List(ctx, prefix, after, res.MaxKeys-res.KeyCount)
+		if err != nil {
+			return "", err
+		}
+
+		if len(archives) == 0 {
+			return "", nil
+		}
+
+		for _, ar := range archives {
+			key := strings.TrimPrefix(ar.Name, base)
+			after = ar.Name
+
+			if res.Delimiter != "" {
+				if i := strings.Index(key[len(res.Prefix):], res.Delimiter); i >= 0 {
+					cp := key[:len(res.Prefix)+i+len(res.Delimiter)]
+					if !seen[cp] {
+						seen[cp] = true
+						res.CommonPrefixes = append(res.CommonPrefixes, CommonPrefix{Prefix: cp})
+						res.KeyCount++
+					}
+
+					// skip the remaining keys with the common prefix
+					after = base + cp + "\xff"
+					break
+				}
+			}
+
+			res.Contents = append(res.Contents, Object{
+				Key:          key,
+				LastModified: formatTime(ar.Created),
+				ETag:         quote(ar.ETag),
+				Size:         ar.Size,
+				StorageClass: storageClass,
+			})
+
+			res.KeyCount++
+		}
+	}
+
+	// see if there is more
+	archives, err := srv.List(ctx, prefix, after, 1)
+	if err != nil {
+		return "", err
+	}
+
+	if len(archives) == 0 {
+		return "", nil
+	}
+
+	return after, nil
+}
+
+// objectArchive returns the name of the archive holding the requested object
+// after checking that the bucket exists.
+func objectArchive(ctx context.Context, srv *server.Server, req *http.Request) (string, error) {
+	vars := mux.Vars(req)
+
+	if _, err := srv.Bucket(ctx, vars["bucket"]); err != nil {
+		return "", err
+	}
+
+	return server.ObjectArchive(vars["bucket"], vars["key"]), nil
+}
+
+// PutObject stores an object, replacing any existing object with the same
+// key. Requests with an uploadId are parts of a multipart upload.
+func PutObject(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := req.URL.Query()
+
+	if req.Header.Get("X-Amz-Copy-Source") != "" {
+		writeErrorCode(rw, req, "NotImplemented", "copying objects is not supported", http.StatusNotImplemented)
+		return
+	}
+
+	if strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		writeErrorCode(rw, req, "NotImplemented", "aws-chunked payloads are not supported", http.StatusNotImplemented)
+		return
+	}
+
+	pol, err := policy.Construct(req)
+	if err != nil {
+		writeErrorCode(rw, req, "InvalidArgument", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx = policy.Wrap(ctx, pol)
+
+	expect, err := obj.ParseDigests(req)
+	if err != nil {
+		writeErrorCode(rw, req, "InvalidDigest", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	archive, err := objectArchive(ctx, srv, req)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	if id := q.Get("uploadId"); id != "" {
+		n, err := strconv.Atoi(q.Get("partNumber"))
+		if err != nil {
+			writeErrorCode(rw, req, "InvalidArgument", "invalid partNumber", http.StatusBadRequest)
+			return
+		}
+
+		part, err := srv.StorePart(ctx, archive, id, n, req.Body, expect...)
+		if err != nil {
+			writeError(rw, req, err)
+			return
+		}
+
+		rw.Header().Set("ETag", quote(part.ETag))
+		rw.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// the existing object is kept if the put fails
+	receipt, err := srv.Replace(ctx, archive, req.Body, expect...)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	rw.Header().Set("ETag", quote(receipt.MD5))
+	rw.WriteHeader(http.StatusOK)
+}
+
+// setObjectHeaders describes the archive in the response headers, including
+// the state of its recall, if any.
+func setObjectHeaders(ctx context.Context, srv *server.Server, rw http.ResponseWriter, ar *server.Archive) {
+	h := rw.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Length", strconv.FormatInt(ar.Size, 10))
+	h.Set("Last-Modified", ar.Created.Format(http.TimeFormat))
+	h.Set("ETag", quote(ar.ETag))
+	h.Set("X-Amz-Storage-Class", storageClass)
+
+	if job, err := srv.RecallStatus(ctx, ar.Name); err == nil && job.Created.Equal(ar.Created) {
+		switch job.State {
+		case server.RecallQueued, server.RecallStaging:
+			h.Set("X-Amz-Restore", `ongoing-request="true"`)
+		case server.RecallReady:
+			h.Set("X-Amz-Restore", `ongoing-request="false"`)
+		}
+	}
+}
+
+// GetObject retrieves an object. Requests with an uploadId list the parts of
+// a multipart upload. Range requests are not supported; the whole object is
+// returned.
+func GetObject(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	archive, err := objectArchive(ctx, srv, req)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	if id := req.URL.Query().Get("uploadId"); id != "" {
+		listParts(ctx, srv, rw, req, archive, id)
+		return
+	}
+
+	ar, err := srv.Stat(ctx, archive)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	w := &objectWriter{
+		ResponseWriter: rw,
+		header: func() {
+			setObjectHeaders(ctx, srv, rw, ar)
+		},
+	}
+
+	if err := srv.Retrieve(ctx, archive, w); err != nil {
+		// the status has been sent once data is written
+		if w.written {
+			log.Print(err)
+			return
+		}
+
+		writeError(rw, req, err)
+		return
+	}
+
+	// an empty object
+	if !w.written {
+		setObjectHeaders(ctx, srv, rw, ar)
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// objectWriter sets the object headers on the first write, such that errors
+// reading the object before any data is available can still be reported.
+type objectWriter struct {
+	http.ResponseWriter
+
+	header  func()
+	written bool
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	if !w.written {
+		w.header()
+		w.written = true
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+func listParts(ctx context.Context, srv *server.Server, rw http.ResponseWriter, req *http.Request, archive string, id string) {
+	parts, err := srv.ListParts(ctx, archive, id)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	vars := mux.Vars(req)
+
+	res := &ListPartsResult{
+		Xmlns:    xmlns,
+		Bucket:   vars["bucket"],
+		Key:      vars["key"],
+		UploadID: id,
+	}
+
+	for _, part := range parts {
+		res.Parts = append(res.Parts, Part{
+			PartNumber:   part.Number,
+			LastModified: formatTime(part.Written),
+			ETag:         quote(part.ETag),
+			Size:         part.Size,
+		})
+	}
+
+	writeXML(rw, http.StatusOK, res)
+}
+
+// HeadObject describes an object.
+func HeadObject(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	archive, err := objectArchive(ctx, srv, req)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	ar, err := srv.Stat(ctx, archive)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	setObjectHeaders(ctx, srv, rw, ar)
+	rw.WriteHeader(http.StatusOK)
+}
+
+// DeleteObject deletes an object. Deleting an object that does not exist
+// succeeds. Requests with an uploadId abort a multipart upload.
+func DeleteObject(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	archive, err := objectArchive(ctx, srv, req)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	if id := req.URL.Query().Get("uploadId"); id != "" {
+		err = srv.AbortUpload(ctx, archive, id)
+	} else {
+		err = srv.Delete(ctx, archive)
+		if errors.Cause(err) == server.ErrNoSuchArchive {
+			err = nil
+		}
+	}
+
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// PostObject initiates (uploads) and completes (uploadId) multipart uploads
+// and restores objects (restore).
+func PostObject(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := req.URL.Query()
+
+	archive, err := objectArchive(ctx, srv, req)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	if _, ok := q["uploads"]; ok {
+		initiateUpload(ctx, srv, rw, req, archive)
+		return
+	}
+
+	if id := q.Get("uploadId"); id != "" {
+		completeUpload(ctx, srv, rw, req, archive, id)
+		return
+	}
+
+	if _, ok := q["restore"]; ok {
+		restoreObject(ctx, srv, rw, req, archive)
+		return
+	}
+
+	writeErrorCode(rw, req, "NotImplemented", "unsupported operation", http.StatusNotImplemented)
+}
+
+// initiateUpload starts a multipart upload. An existing object with the same
+// key is deleted.
+func initiateUpload(ctx context.Context, srv *server.Server, rw http.ResponseWriter, req *http.Request, archive string) {
+	pol, err := policy.Construct(req)
+	if err != nil {
+		writeErrorCode(rw, req, "InvalidArgument", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx = policy.Wrap(ctx, pol)
+
+	id, err := srv.InitiateUpload(ctx, archive)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	vars := mux.Vars(req)
+
+	writeXML(rw, http.StatusOK, &InitiateMultipartUploadResult{
+		Xmlns:    xmlns,
+		Bucket:   vars["bucket"],
+		Key:      vars["key"],
+		UploadID: id,
+	})
+}
+
+func completeUpload(ctx context.Context, srv *server.Server, rw http.ResponseWriter, req *http.Request, archive string, id string) {
+	completion := new(CompleteMultipartUpload)
+	if err := xml.NewDecoder(req.Body).Decode(completion); err != nil {
+		writeErrorCode(rw, req, "MalformedXML", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(completion.Parts) == 0 {
+		writeErrorCode(rw, req, "MalformedXML", "no parts", http.StatusBadRequest)
+		return
+	}
+
+	parts := make([]*server.PartInfo, len(completion.Parts))
+	for i, part := range completion.Parts {
+		parts[i] = &server.PartInfo{
+			Number: part.PartNumber,
+			ETag:   unquote(part.ETag),
+		}
+	}
+
+	receipt, err := srv.CompleteUpload(ctx, archive, id, parts)
+	if err != nil {
+		writeError(rw, req, err)
+		return
+	}
+
+	vars := mux.Vars(req)
+
+	writeXML(rw, http.StatusOK, &CompleteMultipartUploadResult{
+		Xmlns:    xmlns,
+		Location: "/" + vars["bucket"] + "/" + vars["key"],
+		Bucket:   vars["bucket"],
+		Key:      vars["key"],
+		ETag:     quote(receipt.ETag),
+	})
+}
+
+// restoreObject recalls an object to the recall cache. The request is
+// accepted until the object has been staged. Without a recall cache objects
+// are read directly from tape when retrieved, so they are always restored.
+func restoreObject(ctx context.Context, srv *server.Server, rw http.ResponseWriter, req *http.Request, archive string) {
+	job, err := srv.Recall(ctx, archive)
+	if err != nil {
+		if errors.Cause(err) == server.ErrRecallDisabled {
+			rw.WriteHeader(http.StatusOK)
+			return
+		}
+
+		writeError(rw, req, err)
+		return
+	}
+
+	if job.State == server.RecallReady {
+		rw.WriteHeader(http.StatusOK)
+		return
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+}
@@ -5,10 +5,19 @@ import (
 	"log"
 	"net/http"
 
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/inventory"
 	"github.com/bh107/tapr/server"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 )
 
+// StateRequest is the state to move a volume to.
+type StateRequest struct {
+	State inventory.State `json:"state"`
+}
+
 func List(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 
@@ -36,3 +45,59 @@ func List(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
 
 	http.Error(rw, "Bad Request", http.StatusBadRequest)
 }
+
+// stateError responds with the status matching err.
+func stateError(rw http.ResponseWriter, err error) {
+	if _, ok := errors.Cause(err).(*inventory.TransitionError); ok {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+
+	switch errors.Cause(err) {
+	case server.ErrInvalidState:
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+
+	case inventory.ErrNoSuchVolume:
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+
+	case server.ErrVolumeBusy, server.ErrVolumeNotEmpty:
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+
+	log.Print(err)
+	http.Error(rw, err.Error(), http.StatusInternalServerError)
+}
+
+// SetState moves a volume to the requested state, e.g. to mark it damaged or
+// retired.
+func SetState(srv *server.Server, rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	var stateReq StateRequest
+	if err := json.NewDecoder(req.Body).Decode(&stateReq); err != nil {
+		http.Error(rw, "expected a volume state", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	info, err := srv.SetVolumeState(ctx, vars["serial"], stateReq.State)
+	if err != nil {
+		stateError(rw, err)
+		return
+	}
+
+	js, err := json.Marshal(info)
+	if err != nil {
+		log.Print(err)
+		http.Error(rw, "vol/state failed", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(js)
+}
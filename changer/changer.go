@@ -6,10 +6,13 @@ import (
 	"github.com/bh107/tapr/util/mtx"
 	"github.com/bh107/tapr/util/mtx/mock"
 	"github.com/bh107/tapr/util/mtx/scsi"
+	"github.com/bh107/tapr/util/mtx/sgio"
 )
 
+// Changer is a library changer with a cached status, such that the status is
+// only queried from the robot again after volumes have been moved.
 type Changer struct {
-	mtx.Interface
+	*mtx.Cache
 
 	mu sync.Mutex
 }
@@ -22,6 +25,14 @@ func Mock(path string) *Changer {
 	return newChanger(path, true)
 }
 
+// Native returns a changer issuing SCSI media changer commands directly to the
+// generic scsi device at path instead of calling the 'mtx' program.
+func Native(path string) *Changer {
+	return &Changer{
+		Cache: mtx.NewCache(sgio.New(path)),
+	}
+}
+
 func newChanger(path string, mocked bool) *Changer {
 	var impl mtx.Interface
 	if mocked {
@@ -31,7 +42,7 @@ func newChanger(path string, mocked bool) *Changer {
 	}
 
 	chgr := &Changer{
-		Interface: impl,
+		Cache: mtx.NewCache(impl),
 	}
 
 	return chgr
@@ -55,10 +66,18 @@ type Tx struct {
 	chgr *Changer
 }
 
+// Status returns the status of the library, queried from the robot if
+// volumes have been moved since the last query.
 func (tx *Tx) Status() (*mtx.StatusInfo, error) {
 	return mtx.Status(tx.chgr)
 }
 
+// Refresh drops the cached status such that the next call to Status queries
+// the robot.
+func (tx *Tx) Refresh() {
+	tx.chgr.Invalidate()
+}
+
 func (tx *Tx) Load(slot int, drivenum int) error {
 	return mtx.Load(tx.chgr, slot, drivenum)
 }
@@ -66,3 +85,7 @@ func (tx *Tx) Load(slot int, drivenum int) error {
 func (tx *Tx) Unload(slot int, drivenum int) error {
 	return mtx.Unload(tx.chgr, slot, drivenum)
 }
+
+func (tx *Tx) Transfer(from int, to int) error {
+	return mtx.Transfer(tx.chgr, from, to)
+}
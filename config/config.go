@@ -9,11 +9,18 @@ import (
 )
 
 type Config struct {
-	Debug      DebugConfig     `hcl:"debug"`
-	Chunkstore DBConfig        `hcl:"chunkstore"`
-	Inventory  DBConfig        `hcl:"inventory"`
-	LTFS       LTFSConfig      `hcl:"ltfs"`
-	Libraries  []LibraryConfig `hcl:"library"`
+	Debug      DebugConfig      `hcl:"debug"`
+	Chunkstore DBConfig         `hcl:"chunkstore"`
+	Inventory  DBConfig         `hcl:"inventory"`
+	LTFS       LTFSConfig       `hcl:"ltfs"`
+	Stream     StreamConfig     `hcl:"stream"`
+	Reclaim    ReclaimConfig    `hcl:"reclaim"`
+	Pack       PackConfig       `hcl:"pack"`
+	Recall     RecallConfig     `hcl:"recall"`
+	Spool      SpoolConfig      `hcl:"spool"`
+	Encryption EncryptionConfig `hcl:"encryption"`
+	Libraries  []LibraryConfig  `hcl:"library"`
+	Groups     []GroupConfig    `hcl:"group"`
 }
 
 type DebugConfig struct {
@@ -21,6 +28,7 @@ type DebugConfig struct {
 }
 
 type MockingConfig struct {
+	// ChunkSize overrides the default chunk size when mocking.
 	ChunkSize int           `hcl:"chunksize"`
 	Timings   TimingsConfig `hcl:"timings"`
 }
@@ -42,6 +50,71 @@ type LTFSConfig struct {
 	Root string `hcl:"root"`
 }
 
+type StreamConfig struct {
+	Checksum string `hcl:"checksum"`
+
+	// Copies is the default number of copies of each chunk.
+	Copies int `hcl:"copies"`
+
+	// ChunkSize is the default chunk size in bytes.
+	ChunkSize int `hcl:"chunksize"`
+}
+
+type EncryptionConfig struct {
+	// KeyFile is the path of the file holding the master keys. Chunks are
+	// only encrypted if set.
+	KeyFile string `hcl:"keyfile"`
+}
+
+type ReclaimConfig struct {
+	// Threshold is the fraction of live data below which a volume is
+	// reclaimed. Reclamation is disabled if it is zero and uses the server
+	// default if not set.
+	Threshold *float64 `hcl:"threshold"`
+
+	// Interval is the time between reclamation runs. Reclamation only runs
+	// on request if empty.
+	Interval string `hcl:"interval"`
+}
+
+type PackConfig struct {
+	// Threshold is the size below which archives are packed with others in
+	// a single chunk. Packing is disabled if zero.
+	Threshold int `hcl:"threshold"`
+
+	// Size is the size of a pack, a valid chunk size; a full pack is written
+	// at once.
+	Size int `hcl:"size"`
+
+	// Age is the longest time a pack is held open for more archives.
+	Age string `hcl:"age"`
+}
+
+type RecallConfig struct {
+	// Cache is the directory recalled archives are staged to. Recall is
+	// disabled if empty.
+	Cache string `hcl:"cache"`
+
+	// Size is the capacity of the cache in bytes. The least recently used
+	// archives are evicted to make room for new recalls.
+	Size int `hcl:"size"`
+}
+
+type SpoolConfig struct {
+	// Dir is the directory archives written with the spool policy land in
+	// before migration to tape. Spooling is disabled if empty and cannot be
+	// combined with encryption.
+	Dir string `hcl:"dir"`
+
+	// Size is the capacity of the spool in bytes. Archives that do not fit
+	// are refused until spooled archives have been migrated.
+	Size int `hcl:"size"`
+
+	// Interval is the time between attempts to migrate archives that
+	// failed to migrate.
+	Interval string `hcl:"interval"`
+}
+
 type DriveConfig struct {
 	Path  string `hcl:",key"`
 	Type  string `hcl:"type"`
@@ -49,6 +122,15 @@ type DriveConfig struct {
 	Group string `hcl:"group"`
 }
 
+// GroupConfig configures a write group. If Data and Parity are set, chunks
+// written to the group are erasure coded in stripes of Data chunks with Parity
+// parity chunks.
+type GroupConfig struct {
+	Name   string `hcl:",key"`
+	Data   int    `hcl:"data"`
+	Parity int    `hcl:"parity"`
+}
+
 type ChangerConfig struct {
 	Path string `hcl:",key"`
 	Type string `hcl:"type"`
@@ -4,5 +4,9 @@ create table volume (
 	serial text not null unique,
 	slot integer,
 	status text not null,
-	library text
+	library text,
+	live integer not null default 0,
+	dead integer not null default 0,
+	chunks integer not null default 0,
+	prior_status text
 );
@@ -2,6 +2,8 @@ package inventory
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 
 	// import for side effects (load the sqlite3 driver)
 	_ "github.com/mattn/go-sqlite3"
@@ -11,6 +13,100 @@ import (
 	"github.com/bh107/tapr/util/proc"
 )
 
+var (
+	// ErrNoSuchVolume is returned for volumes not in the inventory.
+	ErrNoSuchVolume = errors.New("no such volume")
+
+	// ErrOffsite is returned when locating a volume that has been exported
+	// from its library. The volume must be imported before it can be read.
+	ErrOffsite = errors.New("volume is offsite")
+)
+
+// State is the state of a volume in its life cycle.
+type State string
+
+// Volume states. Volumes found in a library are scratch volumes, unless
+// imported as foreign volumes which are readonly.
+const (
+	StateScratch State = "scratch"
+
+	// StateFilling volumes are being written and StateFull volumes have
+	// no room left.
+	StateFilling State = "filling"
+	StateFull    State = "full"
+
+	// StateReadonly volumes hold data that must be kept, e.g. written
+	// elsewhere; they are never used as scratch.
+	StateReadonly State = "readonly"
+
+	// StateInTransit volumes have been exported to a mail slot and become
+	// StateOffsite once taken out of the library.
+	StateInTransit State = "in-transit"
+	StateOffsite   State = "offsite"
+
+	StateDamaged State = "damaged"
+	StateRetired State = "retired"
+)
+
+// transitions holds the legal transitions between volume states. Offsite
+// volumes may only return to the library through an import.
+var transitions = map[State][]State{
+	StateScratch:   {StateFilling, StateReadonly, StateInTransit, StateDamaged, StateRetired},
+	StateFilling:   {StateFull, StateScratch, StateReadonly, StateInTransit, StateDamaged},
+	StateFull:      {StateScratch, StateReadonly, StateInTransit, StateDamaged},
+	StateReadonly:  {StateScratch, StateInTransit, StateDamaged, StateRetired},
+	StateInTransit: {StateOffsite},
+	StateOffsite:   {StateScratch, StateFull, StateReadonly, StateDamaged, StateRetired},
+	StateDamaged:   {StateReadonly, StateInTransit, StateRetired},
+	StateRetired:   {StateInTransit},
+}
+
+// Valid returns true if s is a known volume state.
+func (s State) Valid() bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// Onsite returns true if volumes in state s are in the library.
+func (s State) Onsite() bool {
+	return s != StateInTransit && s != StateOffsite
+}
+
+// CanTransition returns true if a volume may go from state s to state to.
+func (s State) CanTransition(to State) bool {
+	for _, st := range transitions[s] {
+		if st == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TransitionError is returned for illegal volume state transitions.
+type TransitionError struct {
+	Serial   string
+	From, To State
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("volume %s cannot go from %s to %s", e.Serial, e.From, e.To)
+}
+
+// VolumeInfo describes a volume in the inventory.
+type VolumeInfo struct {
+	Serial  string `json:"serial"`
+	Status  State  `json:"status"`
+	Library string `json:"library,omitempty"`
+
+	// Slot is the slot holding the volume, or 0 if it is not in the library.
+	Slot int `json:"slot,omitempty"`
+
+	// Live is the number of live bytes in Chunks live chunks on the volume.
+	Live   int64 `json:"live"`
+	Chunks int   `json:"chunks"`
+}
+
 type Inventory struct {
 	*proc.Proc
 
@@ -24,6 +120,11 @@ func New(dbname string) (*Inventory, error) {
 		return nil, err
 	}
 
+	if err := migrate(handle); err != nil {
+		handle.Close()
+		return nil, err
+	}
+
 	inv := &Inventory{db: handle}
 
 	inv.Proc = proc.Create(inv)
@@ -31,6 +132,79 @@ func New(dbname string) (*Inventory, error) {
 	return inv, nil
 }
 
+// columns holds the columns added to the volume table since it was first
+// created, with their definitions.
+var columns = []struct {
+	name, def string
+}{
+	{"live", "integer not null default 0"},
+	{"dead", "integer not null default 0"},
+	{"chunks", "integer not null default 0"},
+	{"prior_status", "text"},
+}
+
+// migrate adds the columns missing from the volume table of an inventory
+// created by an earlier version and renames the statuses used before volume
+// states were introduced. Databases without a volume table are left alone.
+func migrate(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA table_info(volume)`)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	have := make(map[string]bool)
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, typ string
+		var dflt sql.NullString
+
+		if err := rows.Scan(&cid, &name, &typ, &notnull, &dflt, &pk); err != nil {
+			return err
+		}
+
+		have[name] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(have) == 0 {
+		return nil
+	}
+
+	for _, col := range columns {
+		if have[col.name] {
+			continue
+		}
+
+		if _, err := db.Exec(`ALTER TABLE volume ADD COLUMN ` + col.name + ` ` + col.def); err != nil {
+			return fmt.Errorf("failed to add column %s: %v", col.name, err)
+		}
+	}
+
+	// offsite volumes used to keep their mail slot until taken out of the
+	// library
+	_, err = db.Exec(`
+		UPDATE volume
+		SET status = CASE
+			WHEN status = "alloc" THEN "filling"
+			WHEN status = "foreign" THEN "readonly"
+			ELSE "in-transit"
+		END
+		WHERE status IN ("alloc", "foreign")
+			OR (status = "offsite" AND slot IS NOT NULL)`,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to rename volume statuses: %v", err)
+	}
+
+	return nil
+}
+
 func (inv *Inventory) ProcessName() string {
 	return "inventory"
 }
@@ -59,6 +233,47 @@ func (inv *Inventory) Locate(ctx context.Context, vol *mtx.Volume) (string, erro
 	return libname, nil
 }
 
+// Lookup returns the volume identified by serial (with its home slot) and the
+// name of the library holding it. Offsite and damaged volumes cannot be read.
+func (inv *Inventory) Lookup(ctx context.Context, serial string) (*mtx.Volume, string, error) {
+	var libname string
+	var status State
+	var slot sql.NullInt64
+
+	req := func(ctx context.Context) error {
+		row := inv.db.QueryRow(`
+			SELECT slot, library, status
+			FROM volume
+			WHERE serial = ?`,
+			serial,
+		)
+
+		if err := row.Scan(&slot, &libname, &status); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	if err := inv.Wait(ctx, req); err != nil {
+		return nil, "", err
+	}
+
+	if !status.Onsite() {
+		return nil, "", ErrOffsite
+	}
+
+	if status == StateDamaged {
+		return nil, "", fmt.Errorf("volume %s is damaged", serial)
+	}
+
+	if !slot.Valid {
+		return nil, "", fmt.Errorf("volume %s is not in a library slot", serial)
+	}
+
+	return &mtx.Volume{Serial: serial, Home: int(slot.Int64)}, libname, nil
+}
+
 func (inv *Inventory) Volumes(ctx context.Context, libname string) ([]*mtx.Volume, error) {
 	var vols []*mtx.Volume
 
@@ -127,7 +342,7 @@ func (inv *Inventory) GetScratch(ctx context.Context, libname string) (*mtx.Volu
 
 		_, err = tx.Exec(`
 		UPDATE volume
-		SET status = "alloc"
+		SET status = "filling"
 		WHERE serial = ?
 			AND status = "scratch"
 	`, serial)
@@ -154,6 +369,135 @@ func (inv *Inventory) GetScratch(ctx context.Context, libname string) (*mtx.Volu
 	return &mtx.Volume{Serial: serial, Home: slot}, nil
 }
 
+// AddChunk accounts for a live chunk of size bytes written to the volume
+// identified by serial.
+func (inv *Inventory) AddChunk(ctx context.Context, serial string, size int) error {
+	req := func(ctx context.Context) error {
+		_, err := inv.db.Exec(`
+			UPDATE volume
+			SET live = live + ?, chunks = chunks + 1
+			WHERE serial = ?`,
+			size, serial,
+		)
+
+		return err
+	}
+
+	return inv.Wait(ctx, req)
+}
+
+// KillChunk accounts for a chunk of size bytes on the volume identified by
+// serial becoming dead. It returns the number of live chunks left on the
+// volume.
+func (inv *Inventory) KillChunk(ctx context.Context, serial string, size int) (int, error) {
+	var chunks int
+
+	req := func(ctx context.Context) error {
+		_, err := inv.db.Exec(`
+			UPDATE volume
+			SET live = live - ?, dead = dead + ?, chunks = chunks - 1
+			WHERE serial = ?`,
+			size, size, serial,
+		)
+
+		if err != nil {
+			return err
+		}
+
+		row := inv.db.QueryRow(`SELECT chunks FROM volume WHERE serial = ?`, serial)
+
+		return row.Scan(&chunks)
+	}
+
+	if err := inv.Wait(ctx, req); err != nil {
+		return -1, err
+	}
+
+	return chunks, nil
+}
+
+// Usage returns the number of live and dead bytes and the number of live
+// chunks on the volume identified by serial.
+func (inv *Inventory) Usage(ctx context.Context, serial string) (live, dead int64, chunks int, err error) {
+	req := func(ctx context.Context) error {
+		row := inv.db.QueryRow(`
+			SELECT live, dead, chunks
+			FROM volume
+			WHERE serial = ?`,
+			serial,
+		)
+
+		return row.Scan(&live, &dead, &chunks)
+	}
+
+	if err := inv.Wait(ctx, req); err != nil {
+		return 0, 0, 0, err
+	}
+
+	return live, dead, chunks, nil
+}
+
+// Scratch returns a filling or full volume to the scratch pool, resetting its
+// accounting. Volumes in other states are left alone.
+func (inv *Inventory) Scratch(ctx context.Context, serial string) error {
+	req := func(ctx context.Context) error {
+		state, err := inv.state(serial)
+		if err != nil {
+			return err
+		}
+
+		if state != StateFilling && state != StateFull {
+			return nil
+		}
+
+		return inv.transition(serial, StateScratch)
+	}
+
+	return inv.Wait(ctx, req)
+}
+
+// Reclaimable returns the serials of full volumes holding dead chunks whose
+// live data amounts to less than threshold (a fraction between 0 and 1) of the
+// data written to them. Volumes with the least live data come first.
+func (inv *Inventory) Reclaimable(ctx context.Context, threshold float64) ([]string, error) {
+	var serials []string
+
+	req := func(ctx context.Context) error {
+		rows, err := inv.db.Query(`
+			SELECT serial
+			FROM volume
+			WHERE status = "full"
+				AND dead > 0
+				AND live < ? * (live + dead)
+			ORDER BY live`,
+			threshold,
+		)
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			var serial string
+			if err := rows.Scan(&serial); err != nil {
+				return err
+			}
+
+			serials = append(serials, serial)
+		}
+
+		return rows.Err()
+	}
+
+	if err := inv.Wait(ctx, req); err != nil {
+		return nil, err
+	}
+
+	return serials, nil
+}
+
 func (inv *Inventory) Close(ctx context.Context) error {
 	req := func(ctx context.Context) error {
 		return inv.db.Close()
@@ -164,14 +508,20 @@ func (inv *Inventory) Close(ctx context.Context) error {
 
 func (inv *Inventory) Audit(ctx context.Context, status *mtx.StatusInfo, libname string) error {
 	req := func(ctx context.Context) error {
-		// update volume locations
+		// update volume locations; volumes in mail slots are only registered
+		// when imported
 		for _, slot := range status.Slots {
-			if slot.Vol != nil {
+			if slot.Type == mtx.MailSlot {
+				continue
+			}
+
+			// volumes without a barcode label cannot be tracked
+			if slot.Vol != nil && slot.Vol.Serial != "" {
 				// try to insert the row
 				_, err := inv.db.Exec(`
 					INSERT OR IGNORE INTO volume (serial, slot, status, library)
 					VALUES (?, ?, ?, ?)`,
-					slot.Vol.Serial, slot.Num, "scratch", libname,
+					slot.Vol.Serial, slot.Num, StateScratch, libname,
 				)
 
 				if err != nil {
@@ -198,3 +548,310 @@ func (inv *Inventory) Audit(ctx context.Context, status *mtx.StatusInfo, libname
 
 	return inv.Wait(ctx, req)
 }
+
+// state returns the state of the volume identified by serial. It must be
+// called from a request.
+func (inv *Inventory) state(serial string) (State, error) {
+	var state State
+
+	row := inv.db.QueryRow(`SELECT status FROM volume WHERE serial = ?`, serial)
+	if err := row.Scan(&state); err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrNoSuchVolume
+		}
+
+		return "", err
+	}
+
+	return state, nil
+}
+
+// transition moves the volume identified by serial to state to if that is a
+// legal transition from its current state. The accounting of volumes returned
+// to scratch is reset. It must be called from a request.
+func (inv *Inventory) transition(serial string, to State) error {
+	from, err := inv.state(serial)
+	if err != nil {
+		return err
+	}
+
+	if !from.CanTransition(to) {
+		return &TransitionError{Serial: serial, From: from, To: to}
+	}
+
+	if to == StateScratch {
+		_, err = inv.db.Exec(`
+			UPDATE volume
+			SET status = ?, live = 0, dead = 0, chunks = 0
+			WHERE serial = ?`,
+			to, serial,
+		)
+
+		return err
+	}
+
+	_, err = inv.db.Exec(`
+		UPDATE volume
+		SET status = ?
+		WHERE serial = ?`,
+		to, serial,
+	)
+
+	return err
+}
+
+// SetState moves the volume identified by serial to state to. A
+// *TransitionError is returned if the volume cannot go to that state.
+func (inv *Inventory) SetState(ctx context.Context, serial string, to State) error {
+	req := func(ctx context.Context) error {
+		return inv.transition(serial, to)
+	}
+
+	return inv.Wait(ctx, req)
+}
+
+// InState returns the volumes of the library in state, ordered by serial.
+func (inv *Inventory) InState(ctx context.Context, libname string, state State) ([]*VolumeInfo, error) {
+	var vols []*VolumeInfo
+
+	req := func(ctx context.Context) error {
+		rows, err := inv.db.Query(`
+			SELECT serial, slot, live, chunks
+			FROM volume
+			WHERE status = ?
+				AND library = ?
+			ORDER BY serial`,
+			state, libname,
+		)
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			var slot sql.NullInt64
+
+			info := &VolumeInfo{Status: state, Library: libname}
+			if err := rows.Scan(&info.Serial, &slot, &info.Live, &info.Chunks); err != nil {
+				return err
+			}
+
+			info.Slot = int(slot.Int64)
+
+			vols = append(vols, info)
+		}
+
+		return rows.Err()
+	}
+
+	if err := inv.Wait(ctx, req); err != nil {
+		return nil, err
+	}
+
+	return vols, nil
+}
+
+// Info returns the inventory record of the volume identified by serial.
+func (inv *Inventory) Info(ctx context.Context, serial string) (*VolumeInfo, error) {
+	info := &VolumeInfo{Serial: serial}
+
+	req := func(ctx context.Context) error {
+		var slot sql.NullInt64
+		var libname sql.NullString
+
+		row := inv.db.QueryRow(`
+			SELECT status, slot, library, live, chunks
+			FROM volume
+			WHERE serial = ?`,
+			serial,
+		)
+
+		if err := row.Scan(&info.Status, &slot, &libname, &info.Live, &info.Chunks); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrNoSuchVolume
+			}
+
+			return err
+		}
+
+		info.Slot = int(slot.Int64)
+		info.Library = libname.String
+
+		return nil
+	}
+
+	if err := inv.Wait(ctx, req); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// Import registers the volume identified by serial as moved into slot of the
+// library and returns its state. Unknown volumes are added as scratch
+// volumes, or as readonly volumes if foreign is set. Offsite volumes return to
+// the state they were exported in (volumes being filled come back full). An
+// offsite volume only becomes scratch again if it was scratch when exported;
+// volumes exported before their state was recorded become full, or readonly if
+// they hold no data.
+func (inv *Inventory) Import(ctx context.Context, serial string, slot int, libname string, foreign bool) (State, error) {
+	var state State
+
+	req := func(ctx context.Context) error {
+		var prior sql.NullString
+		var live, dead int64
+		var chunks int
+
+		row := inv.db.QueryRow(`
+			SELECT status, prior_status, live, dead, chunks
+			FROM volume
+			WHERE serial = ?`,
+			serial,
+		)
+
+		err := row.Scan(&state, &prior, &live, &dead, &chunks)
+		if err == sql.ErrNoRows {
+			state = StateScratch
+			if foreign {
+				state = StateReadonly
+			}
+
+			_, err = inv.db.Exec(`
+				INSERT INTO volume (serial, slot, status, library)
+				VALUES (?, ?, ?, ?)`,
+				serial, slot, state, libname,
+			)
+
+			return err
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if state == StateOffsite {
+			to := State(prior.String)
+			switch {
+			case to == StateFilling:
+				to = StateFull
+			case to == StateScratch && foreign:
+				to = StateReadonly
+			case !StateOffsite.CanTransition(to):
+				to = StateReadonly
+				if chunks > 0 || live > 0 || dead > 0 {
+					to = StateFull
+				}
+			}
+
+			if err := inv.transition(serial, to); err != nil {
+				return err
+			}
+
+			state = to
+		}
+
+		_, err = inv.db.Exec(`
+			UPDATE volume
+			SET slot = ?, library = ?, prior_status = NULL
+			WHERE serial = ?`,
+			slot, libname, serial,
+		)
+
+		return err
+	}
+
+	if err := inv.Wait(ctx, req); err != nil {
+		return "", err
+	}
+
+	return state, nil
+}
+
+// Export moves the volume identified by serial to the in-transit state,
+// placed in the mail slot of its library for removal. The state of the volume
+// is kept to be restored when it is imported again.
+func (inv *Inventory) Export(ctx context.Context, serial string, slot int) error {
+	req := func(ctx context.Context) error {
+		prior, err := inv.state(serial)
+		if err != nil {
+			return err
+		}
+
+		if err := inv.transition(serial, StateInTransit); err != nil {
+			return err
+		}
+
+		_, err = inv.db.Exec(`
+			UPDATE volume
+			SET slot = ?, prior_status = ?
+			WHERE serial = ?`,
+			slot, prior, serial,
+		)
+
+		return err
+	}
+
+	return inv.Wait(ctx, req)
+}
+
+// Departing returns the in-transit volumes of the library.
+func (inv *Inventory) Departing(ctx context.Context, libname string) ([]*VolumeInfo, error) {
+	var vols []*VolumeInfo
+
+	req := func(ctx context.Context) error {
+		rows, err := inv.db.Query(`
+			SELECT serial, slot
+			FROM volume
+			WHERE status = "in-transit"
+				AND library = ?
+				AND slot IS NOT NULL`,
+			libname,
+		)
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			info := &VolumeInfo{Status: StateInTransit, Library: libname}
+			if err := rows.Scan(&info.Serial, &info.Slot); err != nil {
+				return err
+			}
+
+			vols = append(vols, info)
+		}
+
+		return rows.Err()
+	}
+
+	if err := inv.Wait(ctx, req); err != nil {
+		return nil, err
+	}
+
+	return vols, nil
+}
+
+// Departed records that the in-transit volume identified by serial has been
+// taken out of its mail slot and is offsite.
+func (inv *Inventory) Departed(ctx context.Context, serial string) error {
+	req := func(ctx context.Context) error {
+		if err := inv.transition(serial, StateOffsite); err != nil {
+			return err
+		}
+
+		_, err := inv.db.Exec(`
+			UPDATE volume
+			SET slot = NULL
+			WHERE serial = ?`,
+			serial,
+		)
+
+		return err
+	}
+
+	return inv.Wait(ctx, req)
+}
@@ -0,0 +1,290 @@
+package inventory
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// oldSchema is the volume table created by the first version of init.sql.
+const oldSchema = `
+create table volume (
+	id integer primary key,
+	serial text not null unique,
+	slot integer,
+	status text not null,
+	library text
+);`
+
+func newInventory(t *testing.T) (*Inventory, func()) {
+	schema, err := ioutil.ReadFile(filepath.Join("..", "init.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newInventoryWithSchema(t, string(schema))
+}
+
+// newInventoryWithSchema returns an inventory in a database created by
+// schema.
+func newInventoryWithSchema(t *testing.T, schema string) (*Inventory, func()) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbname := filepath.Join(dir, "inventory.db")
+
+	db, err := sql.Open("sqlite3", dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	inv, err := New(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return inv, func() {
+		inv.Close(context.Background())
+		os.RemoveAll(dir)
+	}
+}
+
+func TestStates(t *testing.T) {
+	inv, cleanup := newInventory(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	if _, err := inv.Import(ctx, "A00000L6", 1, "primary", false); err != nil {
+		t.Fatal(err)
+	}
+
+	vol, err := inv.GetScratch(ctx, "primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := inv.AddChunk(ctx, vol.Serial, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	// volumes are only taken out of the library through the mail slots
+	err = inv.SetState(ctx, vol.Serial, StateOffsite)
+	if _, ok := err.(*TransitionError); !ok {
+		t.Fatalf("expected transition error, got %v", err)
+	}
+
+	if err := inv.SetState(ctx, vol.Serial, StateFull); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := inv.Export(ctx, vol.Serial, 33); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := inv.Lookup(ctx, vol.Serial); err != ErrOffsite {
+		t.Fatalf("expected %v, got %v", ErrOffsite, err)
+	}
+
+	if err := inv.Departed(ctx, vol.Serial); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := inv.Import(ctx, vol.Serial, 2, "primary", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state != StateFull {
+		t.Fatalf("expected imported volume holding data to be %s, got %s", StateFull, state)
+	}
+
+	if _, _, err := inv.Lookup(ctx, vol.Serial); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportRestoresState(t *testing.T) {
+	inv, cleanup := newInventory(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	vols := []struct {
+		serial   string
+		foreign  bool
+		set      State
+		expected State
+	}{
+		{"A00000L6", false, StateScratch, StateScratch},
+		{"A00001L6", true, StateReadonly, StateReadonly},
+		{"A00002L6", false, StateDamaged, StateDamaged},
+		{"A00003L6", false, StateRetired, StateRetired},
+		{"A00004L6", false, StateFilling, StateFull},
+	}
+
+	for i, v := range vols {
+		if _, err := inv.Import(ctx, v.serial, i+1, "primary", v.foreign); err != nil {
+			t.Fatal(err)
+		}
+
+		if v.set != StateScratch && v.set != StateReadonly {
+			if err := inv.SetState(ctx, v.serial, v.set); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := inv.Export(ctx, v.serial, 33); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := inv.Departed(ctx, v.serial); err != nil {
+			t.Fatal(err)
+		}
+
+		state, err := inv.Import(ctx, v.serial, i+1, "primary", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if state != v.expected {
+			t.Errorf("%s: expected %s volume to be imported as %s, got %s", v.serial, v.set, v.expected, state)
+		}
+	}
+
+	// empty volumes exported without a recorded state must not become scratch
+	if _, err := inv.db.Exec(`INSERT INTO volume (serial, status) VALUES ("A00005L6", "offsite")`); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := inv.Import(ctx, "A00005L6", 6, "primary", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state != StateReadonly {
+		t.Errorf("expected volume without recorded state to be imported as %s, got %s", StateReadonly, state)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	inv, cleanup := newInventoryWithSchema(t, oldSchema)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	if _, err := inv.db.Exec(`INSERT INTO volume (serial, slot, status, library) VALUES ("A00000L6", 1, "scratch", "primary")`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := inv.AddChunk(ctx, "A00000L6", 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	live, dead, chunks, err := inv.Usage(ctx, "A00000L6")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if live != 1024 || dead != 0 || chunks != 1 {
+		t.Errorf("expected 1024 live bytes in 1 chunk, got %d live, %d dead in %d chunks", live, dead, chunks)
+	}
+
+	// migrating again is a no-op
+	if err := migrate(inv.db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateStatuses(t *testing.T) {
+	inv, cleanup := newInventoryWithSchema(t, oldSchema+`
+		INSERT INTO volume (serial, slot, status, library) VALUES
+			("A00000L6", 1, "alloc", "primary"),
+			("A00001L6", 2, "foreign", "primary"),
+			("A00002L6", 33, "offsite", "primary"),
+			("A00003L6", NULL, "offsite", "primary"),
+			("A00004L6", 4, "scratch", "primary");`,
+	)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	expected := map[string]State{
+		"A00000L6": StateFilling,
+		"A00001L6": StateReadonly,
+		"A00002L6": StateInTransit,
+		"A00003L6": StateOffsite,
+		"A00004L6": StateScratch,
+	}
+
+	for serial, st := range expected {
+		info, err := inv.Info(ctx, serial)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Status != st {
+			t.Errorf("expected %s to be %s, got %s", serial, st, info.Status)
+		}
+	}
+
+	// volumes being written before the migration can be filled up
+	if err := inv.SetState(ctx, "A00000L6", StateFull); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReclaimable(t *testing.T) {
+	inv, cleanup := newInventory(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	for i, serial := range []string{"A00000L6", "A00001L6"} {
+		if _, err := inv.Import(ctx, serial, i+1, "primary", false); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := inv.SetState(ctx, serial, StateFilling); err != nil {
+			t.Fatal(err)
+		}
+
+		for j := 0; j < 4; j++ {
+			if err := inv.AddChunk(ctx, serial, 1024); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for j := 0; j < 3; j++ {
+			if _, err := inv.KillChunk(ctx, serial, 1024); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// volumes still being filled are never reclaimed
+	if err := inv.SetState(ctx, "A00001L6", StateFull); err != nil {
+		t.Fatal(err)
+	}
+
+	serials, err := inv.Reclaimable(ctx, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(serials) != 1 || serials[0] != "A00001L6" {
+		t.Errorf("expected only the full volume to be reclaimable, got %v", serials)
+	}
+}
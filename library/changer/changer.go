@@ -53,7 +53,7 @@ func (chgr *Changer) Status(ctx context.Context) (*mtx.StatusInfo, error) {
 
 	req := func(ctx context.Context) error {
 		var err error
-		status, err = mtx.Status(chgr)
+		status, err = mtx.Status(chgr.Interface)
 		if err != nil {
 			return err
 		}
@@ -70,18 +70,18 @@ func (chgr *Changer) Status(ctx context.Context) (*mtx.StatusInfo, error) {
 
 func (chgr *Changer) Load(ctx context.Context, slot, drivenum int) error {
 	return chgr.Wait(ctx, func(ctx context.Context) error {
-		return mtx.Load(chgr, slot, drivenum)
+		return mtx.Load(chgr.Interface, slot, drivenum)
 	})
 }
 
 func (chgr *Changer) Unload(ctx context.Context, slot, drivenum int) error {
 	return chgr.Wait(ctx, func(ctx context.Context) error {
-		return mtx.Unload(chgr, slot, drivenum)
+		return mtx.Unload(chgr.Interface, slot, drivenum)
 	})
 }
 
 func (chgr *Changer) Transfer(ctx context.Context, from, to int) error {
 	return chgr.Wait(ctx, func(ctx context.Context) error {
-		return mtx.Transfer(chgr, from, to)
+		return mtx.Transfer(chgr.Interface, from, to)
 	})
 }
@@ -1,38 +1,554 @@
 package server
 
 import (
-	"container/list"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"log"
+	"time"
 
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/stream"
+	"github.com/bh107/tapr/stream/policy"
 	"github.com/bh107/tapr/util/mtx"
 )
 
+var (
+	// metaBucket is the name of the bucket nested in every archive bucket
+	// that holds the archive metadata.
+	metaBucket = []byte("meta")
+
+	archiveKey = []byte("archive")
+)
+
+// Archive describes an archive in the chunkstore.
 type Archive struct {
-	name   string
-	chunks *list.List
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+
+	// Size and SHA256 are set when the archive has been completely stored.
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+
+	// Policy is the write policy used to store the archive.
+	Policy *policy.Policy `json:"policy"`
+
+	// Erasure is the erasure code protecting the chunks, if any.
+	Erasure *stream.Erasure `json:"erasure,omitempty"`
+
+	// Key is the wrapped data key the chunks are encrypted with, if any.
+	Key *stream.WrappedKey `json:"key,omitempty"`
+
+	// Upload is the id of the multipart upload to the archive while it is in
+	// progress. ETag is the S3 style digest of the archive; the MD5 digest or
+	// a digest of the part digests followed by the number of parts.
+	Upload string `json:"upload,omitempty"`
+	ETag   string `json:"etag,omitempty"`
+	Parts  int    `json:"parts,omitempty"`
+
+	// Pack locates the archive data if the archive was packed with other
+	// small archives. The archive then has no chunks of its own.
+	Pack *PackRef `json:"pack,omitempty"`
+
+	// Spooled is set while the archive data is in the disk spool awaiting
+	// migration to tape.
+	Spooled bool `json:"spooled,omitempty"`
+
+	chunks []*ChunkInfo
 }
 
 func NewArchive(name string) *Archive {
 	return &Archive{
-		name:   name,
-		chunks: list.New(),
+		Name:    name,
+		Created: time.Now().UTC(),
 	}
 }
 
 func (ar *Archive) String() string {
-	return fmt.Sprintf("%s(%d chunks)", ar.name, ar.chunks.Len())
+	return fmt.Sprintf("%s(%d chunks)", ar.Name, ar.Chunks())
 }
 
-func (ar *Archive) Volumes() []*mtx.Volume {
-	var seen map[string]bool
-	for e := ar.chunks.Front(); e != nil; e = e.Next() {
-		seen[e.Value.(string)] = true
+// Chunks returns the number of chunks in the archive, not counting copies.
+func (ar *Archive) Chunks() int {
+	var n int
+	for _, info := range ar.chunks {
+		if info.Copy == 0 && !info.Parity {
+			n++
+		}
+	}
+
+	return n
+}
+
+// stripe returns all chunks, including parity chunks and copies, in the given
+// erasure coded stripe.
+func (ar *Archive) stripe(n int) []*ChunkInfo {
+	var cnks []*ChunkInfo
+	for _, info := range ar.chunks {
+		if info.Stripe == n {
+			cnks = append(cnks, info)
+		}
 	}
 
+	return cnks
+}
+
+// Volumes returns the volumes holding chunks of the archive in the order they
+// are first used.
+func (ar *Archive) Volumes() []*mtx.Volume {
+	seen := make(map[string]bool)
+
 	var vols []*mtx.Volume
-	for serial := range seen {
-		vols = append(vols, &mtx.Volume{Serial: serial})
+	for _, info := range ar.chunks {
+		// references to deduplicated chunks not yet committed
+		if info.Volume == "" {
+			continue
+		}
+
+		if !seen[info.Volume] {
+			seen[info.Volume] = true
+			vols = append(vols, &mtx.Volume{Serial: info.Volume})
+		}
 	}
 
 	return vols
 }
+
+// putArchive writes the archive metadata to the archive bucket.
+func putArchive(bkt *bolt.Bucket, ar *Archive) error {
+	meta, err := bkt.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(ar)
+	if err != nil {
+		return err
+	}
+
+	return meta.Put(archiveKey, buf)
+}
+
+// getArchive reads the archive metadata and chunks from the archive bucket.
+// It returns nil if the bucket is not an archive bucket.
+func getArchive(bkt *bolt.Bucket) (*Archive, error) {
+	meta := bkt.Bucket(metaBucket)
+	if meta == nil {
+		return nil, nil
+	}
+
+	ar := new(Archive)
+	if err := json.Unmarshal(meta.Get(archiveKey), ar); err != nil {
+		return nil, err
+	}
+
+	var err error
+	ar.chunks, err = readChunks(bkt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resolveChunks(bkt.Tx(), ar.chunks); err != nil {
+		return nil, err
+	}
+
+	if ar.Pack != nil {
+		if ar.chunks, err = readPack(bkt.Tx(), ar.Pack.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	parity, err := readParity(bkt)
+	if err != nil {
+		return nil, err
+	}
+
+	ar.chunks = append(ar.chunks, parity...)
+
+	return ar, nil
+}
+
+// Stat returns the archive identified by name. Archives of multipart uploads
+// in progress do not exist.
+func (srv *Server) Stat(ctx context.Context, name string) (*Archive, error) {
+	ar, err := srv.stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if ar.Upload != "" {
+		return nil, ErrNoSuchArchive
+	}
+
+	return ar, nil
+}
+
+// stat returns the archive identified by name, including archives of
+// multipart uploads in progress.
+func (srv *Server) stat(name string) (*Archive, error) {
+	var ar *Archive
+
+	err := srv.chunkdb.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(name))
+		if bkt == nil {
+			return ErrNoSuchArchive
+		}
+
+		var err error
+		ar, err = getArchive(bkt)
+		if err != nil {
+			return err
+		}
+
+		if ar == nil {
+			return ErrNoSuchArchive
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ar, nil
+}
+
+// List returns at most limit archives whose names start with prefix, in
+// lexical order. If after is non-empty, listing starts after the archive with
+// that name.
+func (srv *Server) List(ctx context.Context, prefix string, after string, limit int) ([]*Archive, error) {
+	var archives []*Archive
+
+	err := srv.chunkdb.View(func(tx *bolt.Tx) error {
+		c := tx.Cursor()
+
+		seek := []byte(prefix)
+		if after > prefix {
+			seek = []byte(after)
+		}
+
+		for k, v := c.Seek(seek); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			// internal buckets are named with a leading dot
+			if v != nil || string(k) == after || k[0] == '.' {
+				continue
+			}
+
+			ar, err := getArchive(tx.Bucket(k))
+			if err != nil {
+				return err
+			}
+
+			// not an archive bucket or an upload in progress
+			if ar == nil || ar.Upload != "" {
+				continue
+			}
+
+			archives = append(archives, ar)
+
+			if len(archives) == limit {
+				break
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return archives, nil
+}
+
+// complete records the result of storing the archive. The ETag of the archive
+// is its MD5 digest.
+func (srv *Server) complete(name string, digest *digester, pol *policy.Policy, ec *stream.Erasure) error {
+	return srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(name))
+		if bkt == nil {
+			return ErrNoSuchArchive
+		}
+
+		ar, err := getArchive(bkt)
+		if err != nil {
+			return err
+		}
+
+		if ar == nil {
+			ar = NewArchive(name)
+		}
+
+		ar.Size = digest.size
+		ar.SHA256 = hex.EncodeToString(digest.sum(DigestSHA256))
+		ar.ETag = hex.EncodeToString(digest.sum(DigestMD5))
+		ar.Policy = pol
+		ar.Erasure = ec
+
+		return putArchive(bkt, ar)
+	})
+}
+
+// setKey records the wrapped data key of the archive identified by name. The
+// key is also kept in the keys bucket, since deduplicated chunks encrypted
+// with it may outlive the archive.
+func (srv *Server) setKey(name string, key *stream.WrappedKey) error {
+	return srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(name))
+		if bkt == nil {
+			return ErrNoSuchArchive
+		}
+
+		ar, err := getArchive(bkt)
+		if err != nil {
+			return err
+		}
+
+		if ar == nil {
+			ar = NewArchive(name)
+		}
+
+		ar.Key = key
+
+		if err := putKey(tx, key); err != nil {
+			return err
+		}
+
+		return putArchive(bkt, ar)
+	})
+}
+
+// Delete removes archive from the chunkstore and marks its chunk files dead.
+// Deduplicated chunks are only marked dead when no other archive references
+// them. Volumes left without any live chunks are returned to the scratch pool.
+func (srv *Server) Delete(ctx context.Context, name string) error {
+	log.Printf("delete archive: %s", name)
+
+	// chunks being migrated from the spool are dropped with the rest
+	if srv.spool != nil {
+		if err := srv.spool.forget(name); err != nil {
+			return err
+		}
+	}
+
+	var cnks []*ChunkInfo
+
+	err := srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(name))
+		if bkt == nil {
+			return ErrNoSuchArchive
+		}
+
+		ar, err := getArchive(bkt)
+		if err != nil {
+			return err
+		}
+
+		// the pack chunk is dead once all its members are
+		if ar != nil && ar.Pack != nil {
+			if cnks, err = unpackTx(tx, ar.Pack.Name, -1); err != nil {
+				return err
+			}
+
+			return tx.DeleteBucket([]byte(name))
+		}
+
+		cnks, err = readChunks(bkt)
+		if err != nil {
+			return err
+		}
+
+		parity, err := readParity(bkt)
+		if err != nil {
+			return err
+		}
+
+		cnks = append(cnks, parity...)
+
+		var dead []*ChunkInfo
+		for _, info := range cnks {
+			if info.ref() {
+				stored, err := unref(tx, info)
+				if err != nil {
+					return err
+				}
+
+				if stored != nil {
+					dead = append(dead, stored)
+				}
+
+				continue
+			}
+
+			if err := killChunk(tx, info); err != nil {
+				return err
+			}
+
+			dead = append(dead, info)
+		}
+
+		cnks = dead
+
+		return tx.DeleteBucket([]byte(name))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if srv.recall != nil {
+		srv.recall.forget(name)
+	}
+
+	return srv.killChunks(ctx, cnks)
+}
+
+// rename moves the archive identified by from to the name to, replacing any
+// archive of that name.
+func (srv *Server) rename(ctx context.Context, from string, to string) error {
+	log.Printf("rename archive: %s -> %s", from, to)
+
+	if err := srv.Delete(ctx, to); err != nil && errors.Cause(err) != ErrNoSuchArchive {
+		return err
+	}
+
+	fn := func(tx *bolt.Tx) error {
+		return renameTx(tx, from, to)
+	}
+
+	// the spooled data moves along with the archive
+	if srv.spool != nil {
+		return srv.spool.rename(from, to, fn)
+	}
+
+	return srv.chunkdb.Update(fn)
+}
+
+// renameTx moves the archive bucket identified by from to the name to and
+// updates the volume index of its chunks.
+func renameTx(tx *bolt.Tx, from string, to string) error {
+	src := tx.Bucket([]byte(from))
+	if src == nil {
+		return ErrNoSuchArchive
+	}
+
+	dst, err := tx.CreateBucket([]byte(to))
+	if err != nil {
+		return err
+	}
+
+	if err := copyBucket(dst, src); err != nil {
+		return err
+	}
+
+	ar, err := getArchive(dst)
+	if err != nil {
+		return err
+	}
+
+	ar.Name = to
+	if err := putArchive(dst, ar); err != nil {
+		return err
+	}
+
+	cnks, err := readChunks(dst)
+	if err != nil {
+		return err
+	}
+
+	parity, err := readParity(dst)
+	if err != nil {
+		return err
+	}
+
+	// references to pooled chunks are indexed by the pool
+	for _, info := range append(cnks, parity...) {
+		if info.ref() {
+			continue
+		}
+
+		if err := indexChunk(tx, to, info); err != nil {
+			return err
+		}
+	}
+
+	return tx.DeleteBucket([]byte(from))
+}
+
+// copyBucket copies the keys and nested buckets of src to dst.
+func copyBucket(dst *bolt.Bucket, src *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+
+		nested, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+
+		return copyBucket(nested, src.Bucket(k))
+	})
+}
+
+// killChunks accounts the given chunks dead in the inventory. Volumes left
+// without any live chunks are returned to the scratch pool.
+func (srv *Server) killChunks(ctx context.Context, cnks []*ChunkInfo) error {
+	for _, info := range cnks {
+		chunks, err := srv.inv.KillChunk(ctx, info.Volume, info.Size)
+		if err != nil {
+			return err
+		}
+
+		if chunks == 0 {
+			if err := srv.scratchIfEmpty(ctx, info.Volume); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// scratchIfEmpty returns the volume identified by serial to the scratch pool
+// if it holds dead chunks only. Volumes loaded in a drive are left alone; they
+// are checked again when unloaded.
+func (srv *Server) scratchIfEmpty(ctx context.Context, serial string) error {
+	for _, drvs := range srv.drives {
+		for _, drv := range drvs {
+			if drv.holds(serial) {
+				return nil
+			}
+		}
+	}
+
+	_, dead, chunks, err := srv.inv.Usage(ctx, serial)
+	if err != nil {
+		return err
+	}
+
+	if chunks > 0 || dead == 0 {
+		return nil
+	}
+
+	log.Printf("volume %s has no live chunks, returning it to scratch", serial)
+
+	err = srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		vols := tx.Bucket(volumesBucket)
+		if vols == nil || vols.Bucket([]byte(serial)) == nil {
+			return nil
+		}
+
+		return vols.DeleteBucket([]byte(serial))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return srv.inv.Scratch(ctx, serial)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/inventory"
+	"github.com/bh107/tapr/stream/policy"
+)
+
+// usage returns the accounting of the volume identified by serial.
+func usage(t *testing.T, srv *Server, serial string) (live, dead int64, chunks int) {
+	live, dead, chunks, err := srv.inv.Usage(context.Background(), serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return live, dead, chunks
+}
+
+func TestDeleteAccounting(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	pol := policy.NewDefaultPolicy()
+
+	var size int64
+	var serial string
+	for _, archive := range []string{"first", "second"} {
+		receipt, err := store(t, srv, archive, pol, custodian)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		serial = receipt.Volumes[0]
+
+		ar, err := srv.Stat(ctx, archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		size = 0
+		for _, info := range ar.chunks {
+			size += int64(info.Size)
+		}
+	}
+
+	if live, dead, chunks := usage(t, srv, serial); live != 2*size || dead != 0 || chunks != 2 {
+		t.Fatalf("expected %d live bytes in 2 chunks, got %d live, %d dead in %d chunks", 2*size, live, dead, chunks)
+	}
+
+	if err := srv.Delete(ctx, "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := srv.Stat(ctx, "first"); err != ErrNoSuchArchive {
+		t.Fatalf("expected %v, got %v", ErrNoSuchArchive, err)
+	}
+
+	if live, dead, chunks := usage(t, srv, serial); live != size || dead != size || chunks != 1 {
+		t.Fatalf("expected %d live and dead bytes, got %d live, %d dead in %d chunks", size, live, dead, chunks)
+	}
+
+	if err := srv.Delete(ctx, "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the volume is still being written
+	if st := state(t, srv, serial); st != inventory.StateFilling {
+		t.Fatalf("expected %s to be %s, got %s", serial, inventory.StateFilling, st)
+	}
+
+	drv := srv.drives["write"][0]
+	if err := srv.unmount(drv); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.Unload(drv); err != nil {
+		t.Fatal(err)
+	}
+
+	// the volume holds dead chunks only once unloaded
+	if st := state(t, srv, serial); st != inventory.StateScratch {
+		t.Fatalf("expected %s to be %s, got %s", serial, inventory.StateScratch, st)
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+var (
+	ErrNoSuchBucket   = errors.New("no such bucket")
+	ErrBucketExists   = errors.New("bucket exists")
+	ErrBucketNotEmpty = errors.New("bucket not empty")
+	ErrInvalidBucket  = errors.New("invalid bucket name")
+)
+
+// bucketsBucket is the top-level bucket holding the buckets of the S3 API,
+// keyed by name.
+var bucketsBucket = []byte(".buckets")
+
+// bucketName matches valid bucket names.
+var bucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// reservedBuckets are the names that would be shadowed by the native API.
+var reservedBuckets = map[string]bool{
+	"obj": true,
+	"vol": true,
+	"cmd": true,
+	"lib": true,
+}
+
+// Bucket is a namespace of archives. The archives of a bucket are named by the
+// bucket name and the object key separated by a slash.
+type Bucket struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// ObjectArchive returns the name of the archive holding the object identified
+// by key in bucket.
+func ObjectArchive(bucket string, key string) string {
+	return bucket + "/" + key
+}
+
+// CreateBucket creates the bucket identified by name.
+func (srv *Server) CreateBucket(ctx context.Context, name string) error {
+	log.Printf("create bucket: %s", name)
+
+	if !bucketName.MatchString(name) || reservedBuckets[name] {
+		return errors.Wrap(ErrInvalidBucket, name)
+	}
+
+	return srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(bucketsBucket)
+		if err != nil {
+			return err
+		}
+
+		if bkt.Get([]byte(name)) != nil {
+			return errors.Wrap(ErrBucketExists, name)
+		}
+
+		buf, err := json.Marshal(&Bucket{
+			Name:    name,
+			Created: time.Now().UTC(),
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return bkt.Put([]byte(name), buf)
+	})
+}
+
+// Bucket returns the bucket identified by name.
+func (srv *Server) Bucket(ctx context.Context, name string) (*Bucket, error) {
+	b := new(Bucket)
+
+	err := srv.chunkdb.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucketsBucket)
+		if bkt == nil {
+			return errors.Wrap(ErrNoSuchBucket, name)
+		}
+
+		v := bkt.Get([]byte(name))
+		if v == nil {
+			return errors.Wrap(ErrNoSuchBucket, name)
+		}
+
+		return json.Unmarshal(v, b)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Buckets returns all buckets in lexical order.
+func (srv *Server) Buckets(ctx context.Context) ([]*Bucket, error) {
+	buckets := make([]*Bucket, 0)
+
+	err := srv.chunkdb.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(bucketsBucket)
+		if bkt == nil {
+			return nil
+		}
+
+		return bkt.ForEach(func(k, v []byte) error {
+			b := new(Bucket)
+			if err := json.Unmarshal(v, b); err != nil {
+				return err
+			}
+
+			buckets = append(buckets, b)
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buckets, nil
+}
+
+// DeleteBucket removes the bucket identified by name. The bucket must not hold
+// any archives.
+func (srv *Server) DeleteBucket(ctx context.Context, name string) error {
+	log.Printf("delete bucket: %s", name)
+
+	if _, err := srv.Bucket(ctx, name); err != nil {
+		return err
+	}
+
+	archives, err := srv.List(ctx, ObjectArchive(name, ""), "", 1)
+	if err != nil {
+		return err
+	}
+
+	if len(archives) > 0 {
+		return errors.Wrap(ErrBucketNotEmpty, name)
+	}
+
+	return srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketsBucket).Delete([]byte(name))
+	})
+}
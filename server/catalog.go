@@ -0,0 +1,393 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/stream"
+	"github.com/bh107/tapr/util"
+	"github.com/bh107/tapr/util/mtx"
+)
+
+var ErrNoSuchArchive = errors.New("no such archive")
+
+// ChunkInfo describes where a chunk of an archive is stored.
+type ChunkInfo struct {
+	// ID is the sequence number of the chunk within the archive.
+	ID int `json:"id"`
+
+	// Copy is the copy number of the chunk. Copies of a chunk are stored in
+	// separate libraries.
+	Copy int `json:"copy"`
+
+	// Volume is the serial of the volume holding the chunk.
+	Volume string `json:"volume"`
+
+	// Name is the file name of the chunk on the LTFS formatted volume.
+	Name string `json:"name"`
+
+	// Size is the number of bytes in the chunk file.
+	Size int `json:"size"`
+
+	// Checksum is the checksum of the chunk file as computed by
+	// stream.Checksum, e.g. "sha256:<hex>".
+	Checksum string `json:"checksum"`
+
+	// Written is the time the chunk was committed to the volume.
+	Written time.Time `json:"written"`
+
+	// Stripe and Shard locate the chunk in its erasure coded stripe. Stripe
+	// is zero if the archive is not erasure coded. Parity chunks are not part
+	// of the archive data and have no ID.
+	Stripe int  `json:"stripe,omitempty"`
+	Shard  int  `json:"shard,omitempty"`
+	Parity bool `json:"parity,omitempty"`
+
+	// Key is the id of the data key the chunk is encrypted with, if any.
+	Key string `json:"key,omitempty"`
+
+	// Codec is the compression codec of the chunk, if any, and Length the
+	// uncompressed length of the chunk.
+	Codec  string `json:"codec,omitempty"`
+	Length int    `json:"length,omitempty"`
+
+	// Fingerprint identifies the content of deduplicated chunks. Records of
+	// deduplicated chunks in the archive bucket are references to the chunk
+	// record in the pool, which has no ID.
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// meta returns the stream.Meta describing how the chunk is stored.
+func (info *ChunkInfo) meta() stream.Meta {
+	return stream.Meta{
+		Shard: stream.Shard{
+			Stripe: info.Stripe,
+			Index:  info.Shard,
+			Parity: info.Parity,
+		},
+		Key:         info.Key,
+		Codec:       info.Codec,
+		Length:      info.Length,
+		Fingerprint: info.Fingerprint,
+	}
+}
+
+// key returns the key of the chunk record in the archive bucket, in the parity
+// bucket for parity chunks or in the pool for deduplicated chunks.
+func (info *ChunkInfo) key() []byte {
+	if info.Parity {
+		return chunkKey(info.Stripe, info.Copy, info.Shard)
+	}
+
+	if info.pooled() {
+		return poolKey(info.Fingerprint, info.Copy)
+	}
+
+	return chunkKey(info.ID, info.Copy)
+}
+
+// chunkKey returns the key of a chunk record. The first copy of a chunk is
+// keyed on its id alone and further copies sort right after it. Parity chunks
+// are keyed on the stripe and copy, followed by the shard index.
+func chunkKey(id int, copy int, shard ...int) []byte {
+	key := util.Itob(id)
+	if copy > 0 || len(shard) > 0 {
+		key = append(key, util.Itob(copy)...)
+	}
+
+	for _, idx := range shard {
+		key = append(key, util.Itob(idx)...)
+	}
+
+	return key
+}
+
+// parityBucket is the bucket nested in erasure coded archive buckets holding
+// the parity chunk records.
+var parityBucket = []byte("parity")
+
+// putChunk adds the chunk record to the archive bucket.
+func putChunk(bkt *bolt.Bucket, info *ChunkInfo) error {
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	if info.Parity {
+		bkt, err = bkt.CreateBucketIfNotExists(parityBucket)
+		if err != nil {
+			return err
+		}
+	}
+
+	return bkt.Put(info.key(), buf)
+}
+
+// getChunk returns the record of the chunk identified by the key of ref from
+// the archive bucket or nil if there is no such chunk.
+func getChunk(bkt *bolt.Bucket, ref *ChunkInfo) (*ChunkInfo, error) {
+	if ref.Parity {
+		if bkt = bkt.Bucket(parityBucket); bkt == nil {
+			return nil, nil
+		}
+	}
+
+	v := bkt.Get(ref.key())
+	if v == nil {
+		return nil, nil
+	}
+
+	info := new(ChunkInfo)
+	if err := json.Unmarshal(v, info); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// volumesBucket is the top-level bucket indexing chunk files by volume. It
+// holds a nested bucket per volume, keyed by the file names of the chunks.
+var volumesBucket = []byte(".volumes")
+
+// fileEntry is an entry in the volume index.
+type fileEntry struct {
+	Archive string `json:"archive"`
+	ID      int    `json:"id"`
+	Copy    int    `json:"copy"`
+	Size    int    `json:"size"`
+
+	Stripe int  `json:"stripe,omitempty"`
+	Shard  int  `json:"shard,omitempty"`
+	Parity bool `json:"parity,omitempty"`
+
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Dead is true if the chunk no longer belongs to an archive.
+	Dead bool `json:"dead"`
+}
+
+// indexChunk adds the chunk to the volume index.
+func indexChunk(tx *bolt.Tx, archive string, info *ChunkInfo) error {
+	vols, err := tx.CreateBucketIfNotExists(volumesBucket)
+	if err != nil {
+		return err
+	}
+
+	bkt, err := vols.CreateBucketIfNotExists([]byte(info.Volume))
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(&fileEntry{
+		Archive:     archive,
+		ID:          info.ID,
+		Copy:        info.Copy,
+		Size:        info.Size,
+		Stripe:      info.Stripe,
+		Shard:       info.Shard,
+		Parity:      info.Parity,
+		Fingerprint: info.Fingerprint,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return bkt.Put([]byte(info.Name), buf)
+}
+
+// killChunk marks the chunk file as dead in the volume index.
+func killChunk(tx *bolt.Tx, info *ChunkInfo) error {
+	vols := tx.Bucket(volumesBucket)
+	if vols == nil {
+		return nil
+	}
+
+	bkt := vols.Bucket([]byte(info.Volume))
+	if bkt == nil {
+		return nil
+	}
+
+	v := bkt.Get([]byte(info.Name))
+	if v == nil {
+		return nil
+	}
+
+	entry := new(fileEntry)
+	if err := json.Unmarshal(v, entry); err != nil {
+		return err
+	}
+
+	entry.Dead = true
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return bkt.Put([]byte(info.Name), buf)
+}
+
+// commit returns a stream.CommitFunc that records chunks written to vol in
+// the chunkstore. Deduplicated chunks are recorded in the pool; the archive
+// holds a reference to them.
+func (srv *Server) commit(vol *mtx.Volume) stream.CommitFunc {
+	return func(cnk *stream.Chunk, fname string) error {
+		info := &ChunkInfo{
+			ID:       cnk.ID(),
+			Copy:     cnk.Upstream().Copy(),
+			Volume:   vol.Serial,
+			Name:     fname,
+			Size:     len(cnk.Bytes()),
+			Checksum: cnk.Checksum(),
+			Written:  time.Now().UTC(),
+			Stripe:   cnk.Meta().Shard.Stripe,
+			Shard:    cnk.Meta().Shard.Index,
+			Parity:   cnk.Meta().Shard.Parity,
+			Key:      cnk.Meta().Key,
+			Codec:    cnk.Meta().Codec,
+			Length:   cnk.Meta().Length,
+
+			Fingerprint: cnk.Meta().Fingerprint,
+		}
+
+		// deduplicated chunks written by archives, as opposed to pooled
+		// chunks moved by reclamation, may already have been committed by
+		// another stream; such duplicates are dead on arrival
+		archive := cnk.Upstream().String()
+		rewrite := archive == string(poolBucket)
+		if info.Fingerprint != "" {
+			archive = string(poolBucket)
+			info.ID = 0
+		}
+
+		var duplicate bool
+
+		err := srv.chunkdb.Update(func(tx *bolt.Tx) error {
+			bkt := tx.Bucket([]byte(archive))
+			if info.pooled() {
+				var err error
+				if bkt, err = tx.CreateBucketIfNotExists(poolBucket); err != nil {
+					return err
+				}
+
+				duplicate = !rewrite && bkt.Get(info.key()) != nil
+			}
+
+			if bkt == nil {
+				return errors.Wrap(ErrNoSuchArchive, archive)
+			}
+
+			if !duplicate {
+				if err := putChunk(bkt, info); err != nil {
+					return err
+				}
+			}
+
+			if err := indexChunk(tx, archive, info); err != nil {
+				return err
+			}
+
+			if duplicate {
+				return killChunk(tx, info)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if err := srv.inv.AddChunk(context.Background(), vol.Serial, info.Size); err != nil {
+			return err
+		}
+
+		if duplicate {
+			return srv.killChunks(context.Background(), []*ChunkInfo{info})
+		}
+
+		return nil
+	}
+}
+
+// chunks returns the chunks of archive ordered by their sequence number. All
+// copies of a chunk are returned, ordered by copy number.
+func (srv *Server) chunks(archive string) ([]*ChunkInfo, error) {
+	var cnks []*ChunkInfo
+
+	err := srv.chunkdb.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(archive))
+		if bkt == nil {
+			return ErrNoSuchArchive
+		}
+
+		var err error
+		cnks, err = readChunks(bkt)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cnks, nil
+}
+
+// readParity returns the parity chunks recorded in the archive bucket.
+func readParity(bkt *bolt.Bucket) ([]*ChunkInfo, error) {
+	if bkt = bkt.Bucket(parityBucket); bkt == nil {
+		return nil, nil
+	}
+
+	return readChunks(bkt)
+}
+
+// readChunks returns the chunks recorded in the archive bucket, not including
+// parity chunks.
+func readChunks(bkt *bolt.Bucket) ([]*ChunkInfo, error) {
+	var cnks []*ChunkInfo
+
+	err := bkt.ForEach(func(k, v []byte) error {
+		// skip nested buckets
+		if v == nil {
+			return nil
+		}
+
+		info := new(ChunkInfo)
+		if err := json.Unmarshal(v, info); err != nil {
+			return err
+		}
+
+		cnks = append(cnks, info)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cnks, nil
+}
+
+// volumes returns the serials of the volumes holding chunks of archive in the
+// order they are first used.
+func (srv *Server) volumes(ctx context.Context, archive string) ([]string, error) {
+	ar, err := srv.Stat(ctx, archive)
+	if err != nil {
+		return nil, err
+	}
+
+	serials := make([]string, 0)
+	for _, vol := range ar.Volumes() {
+		serials = append(serials, vol.Serial)
+	}
+
+	return serials, nil
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+
+	"github.com/bh107/tapr/stream"
+	"github.com/bh107/tapr/util"
+)
+
+var (
+	// poolBucket is the top-level bucket holding the records of
+	// deduplicated chunks, keyed by fingerprint and copy. The chunks are
+	// shared by all archives referencing them.
+	poolBucket = []byte(".pool")
+
+	// refsBucket is the top-level bucket counting the archive chunks
+	// referencing each chunk in the pool.
+	refsBucket = []byte(".refs")
+)
+
+// poolKey returns the key of the given copy of the chunk identified by
+// fingerprint in the pool.
+func poolKey(fingerprint string, copy int) []byte {
+	key := []byte(fingerprint)
+	if copy > 0 {
+		key = append(key, util.Itob(copy)...)
+	}
+
+	return key
+}
+
+// pooled returns true if info is the record of a chunk stored in the pool.
+func (info *ChunkInfo) pooled() bool {
+	return info.Fingerprint != "" && info.ID == 0
+}
+
+// ref returns true if info is a reference to a chunk in the pool.
+func (info *ChunkInfo) ref() bool {
+	return info.Fingerprint != "" && info.ID != 0
+}
+
+// dedup is the stream.DedupFunc of deduplicating streams. It records a
+// reference to the chunk in the archive and reports whether the chunk is
+// already in the pool. Chunks are only in the pool once committed; until then
+// every stream writing the chunk stores its own copy and the copies committed
+// after the first are dead. The references taken by a failed store are
+// dropped with its chunk records.
+func (srv *Server) dedup(cnk *stream.Chunk) (bool, error) {
+	archive := cnk.Upstream().String()
+
+	ref := &ChunkInfo{
+		ID:          cnk.ID(),
+		Copy:        cnk.Upstream().Copy(),
+		Fingerprint: cnk.Meta().Fingerprint,
+		Written:     time.Now().UTC(),
+	}
+
+	var found bool
+
+	err := srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(archive))
+		if bkt == nil {
+			return errors.Wrap(ErrNoSuchArchive, archive)
+		}
+
+		refs, err := tx.CreateBucketIfNotExists(refsBucket)
+		if err != nil {
+			return err
+		}
+
+		key := poolKey(ref.Fingerprint, ref.Copy)
+
+		if pool := tx.Bucket(poolBucket); pool != nil {
+			found = pool.Get(key) != nil
+		}
+
+		var n uint64
+		if v := refs.Get(key); v != nil {
+			n = binary.BigEndian.Uint64(v)
+		}
+
+		if err := refs.Put(key, util.Itob(int(n+1))); err != nil {
+			return err
+		}
+
+		return putChunk(bkt, ref)
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return found, nil
+}
+
+// resolveChunks replaces references to pooled chunks with the records of the
+// chunks in the pool, keeping the id of the reference. References to chunks
+// that have not yet been committed are left as is.
+func resolveChunks(tx *bolt.Tx, cnks []*ChunkInfo) error {
+	pool := tx.Bucket(poolBucket)
+	if pool == nil {
+		return nil
+	}
+
+	for i, info := range cnks {
+		if !info.ref() {
+			continue
+		}
+
+		stored, err := getChunk(pool, &ChunkInfo{Fingerprint: info.Fingerprint, Copy: info.Copy})
+		if err != nil {
+			return err
+		}
+
+		if stored == nil {
+			continue
+		}
+
+		stored.ID = info.ID
+		cnks[i] = stored
+	}
+
+	return nil
+}
+
+// unref drops a reference to a pooled chunk. If it was the last reference,
+// the chunk is removed from the pool, its file is marked dead and its record
+// is returned.
+func unref(tx *bolt.Tx, ref *ChunkInfo) (*ChunkInfo, error) {
+	refs := tx.Bucket(refsBucket)
+	if refs == nil {
+		return nil, nil
+	}
+
+	key := poolKey(ref.Fingerprint, ref.Copy)
+
+	v := refs.Get(key)
+	if v == nil {
+		return nil, nil
+	}
+
+	if n := binary.BigEndian.Uint64(v); n > 1 {
+		return nil, refs.Put(key, util.Itob(int(n-1)))
+	}
+
+	if err := refs.Delete(key); err != nil {
+		return nil, err
+	}
+
+	pool := tx.Bucket(poolBucket)
+	if pool == nil {
+		return nil, nil
+	}
+
+	stored, err := getChunk(pool, &ChunkInfo{Fingerprint: ref.Fingerprint, Copy: ref.Copy})
+	if err != nil || stored == nil {
+		return nil, err
+	}
+
+	if err := killChunk(tx, stored); err != nil {
+		return nil, err
+	}
+
+	if err := pool.Delete(key); err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// keysBucket is the top-level bucket holding the wrapped data keys of all
+// archives, keyed by key id.
+var keysBucket = []byte(".keys")
+
+// putKey adds the wrapped data key to the keys bucket.
+func putKey(tx *bolt.Tx, key *stream.WrappedKey) error {
+	bkt, err := tx.CreateBucketIfNotExists(keysBucket)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	return bkt.Put([]byte(key.ID), buf)
+}
+
+// dataKey returns the unwrapped data key identified by id.
+func (srv *Server) dataKey(id string) ([]byte, error) {
+	if srv.keyring == nil {
+		return nil, errors.Errorf("data key %s: no keys are configured", id)
+	}
+
+	wk := new(stream.WrappedKey)
+
+	err := srv.chunkdb.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(keysBucket)
+		if bkt == nil {
+			return errors.Errorf("data key %s: %v", id, stream.ErrNoSuchKey)
+		}
+
+		v := bkt.Get([]byte(id))
+		if v == nil {
+			return errors.Errorf("data key %s: %v", id, stream.ErrNoSuchKey)
+		}
+
+		return json.Unmarshal(v, wk)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return srv.keyring.Unwrap(wk)
+}
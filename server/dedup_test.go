@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/stream/policy"
+)
+
+// refs returns the reference counts of the chunks in the pool.
+func refs(t *testing.T, srv *Server) []uint64 {
+	var counts []uint64
+
+	err := srv.chunkdb.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(refsBucket)
+		if bkt == nil {
+			return nil
+		}
+
+		return bkt.ForEach(func(k, v []byte) error {
+			counts = append(counts, binary.BigEndian.Uint64(v))
+			return nil
+		})
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return counts
+}
+
+func TestDedupFailedWrite(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+
+	pol := policy.NewDefaultPolicy()
+	pol.Dedup = true
+
+	// fail the write by pulling the file system from under the drive
+	mountpoint, err := srv.drives["write"][0].Mountpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(mountpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store(t, srv, "first", pol, custodian); err == nil {
+		t.Fatal("expected store to fail")
+	}
+
+	if counts := refs(t, srv); len(counts) != 0 {
+		t.Fatalf("expected the references of the failed store to be dropped, got %v", counts)
+	}
+
+	if err := os.MkdirAll(mountpoint, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	// the content must be written again, as it never made it to the pool
+	for _, archive := range []string{"second", "third"} {
+		if _, err := store(t, srv, archive, pol, custodian); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := retrieve(t, srv, archive); !bytes.Equal(got, custodian) {
+			t.Fatalf("%s: retrieved %d bytes, expected %d", archive, len(got), len(custodian))
+		}
+	}
+
+	if counts := refs(t, srv); len(counts) != 1 || counts[0] != 2 {
+		t.Fatalf("expected a single pooled chunk with 2 references, got %v", counts)
+	}
+}
+
+func TestDedupDelete(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	pol := policy.NewDefaultPolicy()
+	pol.Dedup = true
+
+	var serial string
+	for _, archive := range []string{"first", "second"} {
+		receipt, err := store(t, srv, archive, pol, custodian)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		serial = receipt.Volumes[0]
+	}
+
+	if err := srv.Delete(ctx, "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pooled chunk lives on in the other archive
+	if counts := refs(t, srv); len(counts) != 1 || counts[0] != 1 {
+		t.Fatalf("expected a single pooled chunk with 1 reference, got %v", counts)
+	}
+
+	if _, dead, chunks := usage(t, srv, serial); dead != 0 || chunks != 1 {
+		t.Fatalf("expected 1 live chunk and no dead bytes, got %d chunks and %d dead bytes", chunks, dead)
+	}
+
+	if got := retrieve(t, srv, "second"); !bytes.Equal(got, custodian) {
+		t.Fatalf("retrieved %d bytes, expected %d", len(got), len(custodian))
+	}
+
+	if err := srv.Delete(ctx, "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	if counts := refs(t, srv); len(counts) != 0 {
+		t.Fatalf("expected the pool to be empty, got %v", counts)
+	}
+
+	if _, dead, chunks := usage(t, srv, serial); dead == 0 || chunks != 0 {
+		t.Fatalf("expected the pooled chunk to be dead, got %d chunks and %d dead bytes", chunks, dead)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+)
+
+// Supported whole-archive digest algorithms.
+const (
+	DigestMD5    = "md5"
+	DigestSHA256 = "sha256"
+)
+
+// Digest is a digest computed over the entire contents of an archive.
+type Digest struct {
+	// Alg is the digest algorithm, DigestMD5 or DigestSHA256.
+	Alg string
+
+	// Sum is the raw digest.
+	Sum []byte
+}
+
+type ErrDigestMismatch struct {
+	Alg string
+}
+
+func (e ErrDigestMismatch) Error() string {
+	return fmt.Sprintf("%s digest mismatch", e.Alg)
+}
+
+// Receipt summarises a stored archive.
+type Receipt struct {
+	Archive string   `json:"archive"`
+	Size    int64    `json:"size"`
+	Chunks  int      `json:"chunks"`
+	Volumes []string `json:"volumes"`
+	MD5     string   `json:"md5"`
+	SHA256  string   `json:"sha256"`
+
+	// ETag is set for archives stored by multipart upload, which have no
+	// whole-archive digests.
+	ETag string `json:"etag,omitempty"`
+
+	// Spooled is set if the archive is in the disk spool and not yet on
+	// tape.
+	Spooled bool `json:"spooled,omitempty"`
+}
+
+// digester computes the digests of all bytes written to it.
+type digester struct {
+	size int64
+
+	hashes map[string]hash.Hash
+}
+
+func newDigester() *digester {
+	return &digester{
+		hashes: map[string]hash.Hash{
+			DigestMD5:    md5.New(),
+			DigestSHA256: sha256.New(),
+		},
+	}
+}
+
+func (d *digester) Write(p []byte) (int, error) {
+	for _, h := range d.hashes {
+		h.Write(p)
+	}
+
+	d.size += int64(len(p))
+
+	return len(p), nil
+}
+
+func (d *digester) sum(alg string) []byte {
+	return d.hashes[alg].Sum(nil)
+}
+
+// verify checks the computed digests against the expected ones.
+func (d *digester) verify(expect []Digest) error {
+	for _, digest := range expect {
+		h, ok := d.hashes[digest.Alg]
+		if !ok {
+			return fmt.Errorf("unsupported digest algorithm: %s", digest.Alg)
+		}
+
+		if !bytes.Equal(h.Sum(nil), digest.Sum) {
+			return ErrDigestMismatch{digest.Alg}
+		}
+	}
+
+	return nil
+}
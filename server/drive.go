@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"log"
 	"path"
+	"sync"
 	"syscall"
 
+	"github.com/bh107/tapr/ltfs"
 	"github.com/bh107/tapr/stream"
 	"github.com/bh107/tapr/stream/policy"
 	"github.com/bh107/tapr/util/mtx"
@@ -44,7 +46,33 @@ type Drive struct {
 
 	group *driveGroup
 
+	// mu guards vol, which is read by other goroutines looking for the drive
+	// holding a volume.
+	mu  sync.Mutex
 	vol *mtx.Volume
+
+	ltfs *ltfs.Handle
+}
+
+// Volume returns the volume loaded in the drive, or nil if the drive is empty.
+func (drv *Drive) Volume() *mtx.Volume {
+	drv.mu.Lock()
+	defer drv.mu.Unlock()
+
+	return drv.vol
+}
+
+func (drv *Drive) setVolume(vol *mtx.Volume) {
+	drv.mu.Lock()
+	defer drv.mu.Unlock()
+
+	drv.vol = vol
+}
+
+// holds returns true if the volume identified by serial is loaded in the drive.
+func (drv *Drive) holds(serial string) bool {
+	vol := drv.Volume()
+	return vol != nil && vol.Serial == serial
 }
 
 func (drv *Drive) Agg() chan *stream.Chunk {
@@ -56,11 +84,36 @@ func (drv *Drive) Agg() chan *stream.Chunk {
 }
 
 func (drv *Drive) Mountpoint() (string, error) {
-	if drv.vol == nil {
+	vol := drv.Volume()
+	if vol == nil {
 		return "", errors.New("no volume")
 	}
 
-	return path.Join(drv.srv.cfg.LTFS.Root, drv.devtype, drv.vol.Serial), nil
+	// a volume can only be loaded in one drive at a time, so key the
+	// mountpoint on the volume alone. When mocking, this also allows a read
+	// drive to find the chunks written by a write drive.
+	return path.Join(drv.srv.cfg.LTFS.Root, vol.Serial), nil
+}
+
+// newWriter returns a stream.Writer for the volume currently mounted in the
+// drive.
+func (drv *Drive) newWriter() (*stream.Writer, error) {
+	mountpoint, err := drv.Mountpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	return stream.NewWriter(mountpoint, drv.in, drv.Agg(), drv.path, drv.srv.commit(drv.Volume())), nil
+}
+
+// scratchWriter loads a scratch volume into drv and returns a writer to it.
+// The volume being written, if any, is full.
+func (drv *Drive) scratchWriter() (*stream.Writer, error) {
+	if _, err := drv.srv.GetScratch(drv); err != nil {
+		return nil, err
+	}
+
+	return drv.newWriter()
 }
 
 func (srv *Server) NewDrive(path string, devtype string, slot int, lib *Library) *Drive {
@@ -282,8 +335,32 @@ func (drv *Drive) Ctrl(req Request) {
 
 func (drv *Drive) Run() {
 	for {
+		// read drives have no writer; receiving on a nil channel blocks
+		var errc <-chan error
+		if drv.writer != nil {
+			errc = drv.writer.Errc()
+		}
+
+		// a write drive without a writer has no volume to write to; it takes
+		// the chunks sent to it and tries loading a scratch volume again
+		var in chan *stream.Chunk
+		if drv.writer == nil && drv.devtype == "write" {
+			in = drv.in
+		}
+
 		select {
-		case err := <-drv.writer.Errc():
+		case cnk := <-in:
+			wr, err := drv.scratchWriter()
+			if err != nil {
+				log.Printf("%v: ERROR: %s", drv, err)
+				cnk.Upstream().Report(err)
+				continue
+			}
+
+			drv.writer = wr
+			go func() { drv.in <- cnk }()
+
+		case err := <-errc:
 			if errIO, ok := err.(stream.ErrIO); ok {
 				cnk := errIO.Chunk
 
@@ -298,38 +375,42 @@ func (drv *Drive) Run() {
 					// Get a cancellable context
 					ctx, cancel := context.WithCancel(context.Background())
 
-					// Start the request for another drive
-					reqDrive := make(chan *Drive)
-					go func() {
-						defer cancel()
+					// Copies must stay in the library they were assigned to
+					pool := drv.srv.drives["write"]
+					if cnk.Upstream().Policy().Copies > 1 {
+						pool = drv.srv.writeDrives(drv.lib.name)
+					}
 
-						new, err := acquireDrive(ctx, drv.srv.drives["write"], cnk.Upstream().Policy())
-						if err != nil {
-							log.Print(err)
-							return
-						}
+					// Start the request for another drive. Erasure coded
+					// chunks stay on this drive; the other chunks of the
+					// stripe are on the other drives.
+					var reqDrive chan *Drive
+					if cnk.Meta().Shard.Stripe == 0 {
+						reqDrive = make(chan *Drive)
+						go func() {
+							defer cancel()
+
+							new, err := acquireDrive(ctx, pool, cnk.Upstream().Policy())
+							if err != nil {
+								log.Print(err)
+								return
+							}
 
-						reqDrive <- new
-					}()
+							reqDrive <- new
+						}()
+					}
 
 					// No context needed, should not be cancelled in any case.
+					var errWriter error
 					reqWriter := make(chan *stream.Writer)
 					go func() {
-						_, err := drv.srv.GetScratch(drv)
-						if err != nil {
-							log.Print(err)
-							reqWriter <- nil
-							return
-						}
-
-						mountpoint, err := drv.Mountpoint()
+						wr, err := drv.scratchWriter()
 						if err != nil {
 							log.Print(err)
-							reqWriter <- nil
-							return
+							errWriter = err
 						}
 
-						reqWriter <- stream.NewWriter(mountpoint, drv.in, drv.Agg(), drv.path)
+						reqWriter <- wr
 					}()
 
 					var handedoff bool
@@ -349,13 +430,21 @@ func (drv *Drive) Run() {
 							// cancel the GetDrive request
 							cancel()
 
-							// update our writer
+							// update our writer; the old one stopped at the
+							// full volume. Without a new volume, the drive
+							// fails the chunks sent to it until one can be
+							// loaded.
 							drv.writer = newwr
 
 							// if this chunk's stream wasn't offloaded to
-							// another drive, send the chunk to the new writer.
+							// another drive, send the chunk to the new writer
+							// or fail it if there is none.
 							if !handedoff {
-								go func() { drv.in <- cnk }()
+								if errWriter != nil {
+									cnk.Upstream().Report(errWriter)
+								} else {
+									go func() { drv.in <- cnk }()
+								}
 							}
 						}
 
@@ -364,7 +453,7 @@ func (drv *Drive) Run() {
 				} else {
 					// XXX other error, report to stream. Mark volume as
 					// suspicious and mount new one.
-					cnk.Upstream().Errc() <- errIO.Err
+					cnk.Upstream().Report(errIO.Err)
 				}
 			} else {
 				log.Printf("%v: ERROR: %s", drv, err)
@@ -0,0 +1,567 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/stream"
+	"github.com/bh107/tapr/stream/policy"
+)
+
+// DefaultPackAge is the time a pack is held open for more objects if not
+// configured.
+const DefaultPackAge = time.Minute
+
+// packAttempts is the number of times writing a pack is attempted before its
+// members are given up.
+const packAttempts = 3
+
+// packsBucket is the top-level bucket holding the metadata of packs, keyed by
+// pack name. The chunk of a pack is recorded in a bucket named after the pack.
+var packsBucket = []byte(".packs")
+
+// PackRef locates an archive packed with other small archives in a single
+// chunk.
+type PackRef struct {
+	// Name is the name of the pack.
+	Name string `json:"name"`
+
+	// Offset and Length locate the archive data in the pack chunk.
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+}
+
+// PackInfo describes a pack.
+type PackInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+
+	// Members is the number of archives in the pack that have not been
+	// deleted.
+	Members int `json:"members"`
+}
+
+// pack is a pack being filled or written.
+type pack struct {
+	name     string
+	buf      []byte
+	members  int
+	archives []string
+	timer    *time.Timer
+
+	// done is closed when the pack has been written; err is set first.
+	done chan struct{}
+	err  error
+}
+
+// packer buffers small archives in packs, which are written as a single chunk
+// when full or old enough.
+type packer struct {
+	srv *Server
+
+	threshold int
+	size      int
+	age       time.Duration
+
+	mu  sync.Mutex
+	cur *pack
+
+	// flushing holds the packs being written.
+	flushing map[string]*pack
+}
+
+func newPacker(srv *Server, threshold int, size int, age time.Duration) *packer {
+	return &packer{
+		srv:       srv,
+		threshold: threshold,
+		size:      size,
+		age:       age,
+		flushing:  make(map[string]*pack),
+	}
+}
+
+// add appends p, the data of archive, to the current pack and records the
+// location of the archive. The returned pack is done when written.
+func (pk *packer) add(archive string, p []byte) (*pack, error) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	if pk.cur != nil && len(pk.cur.buf)+len(p) > pk.size {
+		pk.flush(pk.cur)
+	}
+
+	if pk.cur == nil {
+		pk.cur = &pack{
+			name: fmt.Sprintf(".pack-%s", time.Now().UTC().Format("20060102T150405.000000000")),
+			buf:  make([]byte, 0, pk.size),
+			done: make(chan struct{}),
+		}
+
+		cur := pk.cur
+		cur.timer = time.AfterFunc(pk.age, func() {
+			pk.mu.Lock()
+			defer pk.mu.Unlock()
+
+			if pk.cur == cur {
+				pk.flush(cur)
+			}
+		})
+	}
+
+	cur := pk.cur
+
+	ref := &PackRef{
+		Name:   cur.name,
+		Offset: len(cur.buf),
+		Length: len(p),
+	}
+
+	err := pk.srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(archive))
+		if bkt == nil {
+			return ErrNoSuchArchive
+		}
+
+		ar, err := getArchive(bkt)
+		if err != nil {
+			return err
+		}
+
+		if ar == nil {
+			ar = NewArchive(archive)
+		}
+
+		ar.Pack = ref
+
+		if err := putArchive(bkt, ar); err != nil {
+			return err
+		}
+
+		return updatePack(tx, cur.name, 1)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	cur.buf = append(cur.buf, p...)
+	cur.members++
+	cur.archives = append(cur.archives, archive)
+
+	if len(cur.buf) >= pk.size {
+		pk.flush(cur)
+	}
+
+	return cur, nil
+}
+
+// flush closes the current pack and writes it in the background. It must be
+// called with pk.mu held.
+func (pk *packer) flush(pck *pack) {
+	pck.timer.Stop()
+
+	pk.cur = nil
+	pk.flushing[pck.name] = pck
+
+	go func() {
+		for attempt := 1; attempt <= packAttempts; attempt++ {
+			if pck.err = pk.write(pck); pck.err == nil {
+				break
+			}
+
+			log.Printf("pack %s: attempt %d failed: %v", pck.name, attempt, pck.err)
+
+			// forget what the failed attempt wrote
+			if err := pk.srv.resetChunks(context.Background(), pck.name); err != nil && err != ErrNoSuchArchive {
+				log.Printf("pack %s: %v", pck.name, err)
+			}
+		}
+
+		if pck.err != nil {
+			if err := pk.fail(pck); err != nil {
+				log.Printf("pack %s: %v", pck.name, err)
+			}
+		}
+
+		pk.mu.Lock()
+		delete(pk.flushing, pck.name)
+		pk.mu.Unlock()
+
+		close(pck.done)
+	}()
+}
+
+// write writes the pack as a single chunk.
+func (pk *packer) write(pck *pack) error {
+	ctx := context.Background()
+
+	log.Printf("writing pack %s with %d archives, %d bytes", pck.name, pck.members, len(pck.buf))
+
+	// members are read by byte range, so the chunk is stored as is
+	pol := pk.srv.writePolicy(ctx)
+	pol.AcknowledgedWrite = true
+	pol.WriteGroup = policy.DefaultPolicy.WriteGroup
+	pol.Copies = 1
+	pol.Compression = stream.CompressionNone
+	pol.Dedup = false
+	pol.ChunkSize = pk.size
+
+	err := pk.srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(pck.name))
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	s, err := pk.srv.openStream(ctx, pck.name, pol, 0, "")
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.Write(ctx, pck.buf, false); err != nil {
+		s.Abort()
+		return err
+	}
+
+	if err := s.Close(ctx); err != nil {
+		return err
+	}
+
+	// all members may have been deleted while the pack was written
+	return pk.srv.unpack(ctx, pck.name, 0)
+}
+
+// fail deletes the members of a pack that could not be written and removes
+// the pack. Archives since deleted and replaced by archives outside the pack
+// are left alone.
+func (pk *packer) fail(pck *pack) error {
+	ctx := context.Background()
+
+	for _, archive := range pck.archives {
+		ar, err := pk.srv.stat(archive)
+		if err != nil {
+			if errors.Cause(err) == ErrNoSuchArchive {
+				continue
+			}
+
+			return err
+		}
+
+		if ar.Pack == nil || ar.Pack.Name != pck.name {
+			continue
+		}
+
+		log.Printf("pack %s: deleting member %s", pck.name, archive)
+
+		if err := pk.srv.Delete(ctx, archive); err != nil && err != ErrNoSuchArchive {
+			return err
+		}
+	}
+
+	return pk.srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(pck.name)) != nil {
+			if err := tx.DeleteBucket([]byte(pck.name)); err != nil {
+				return err
+			}
+		}
+
+		if packs := tx.Bucket(packsBucket); packs != nil {
+			return packs.Delete([]byte(pck.name))
+		}
+
+		return nil
+	})
+}
+
+// pending returns the data of the pack identified by name if it has not yet
+// been written.
+func (pk *packer) pending(name string) ([]byte, bool) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+
+	if pk.cur != nil && pk.cur.name == name {
+		return pk.cur.buf, true
+	}
+
+	if pck, ok := pk.flushing[name]; ok {
+		return pck.buf, true
+	}
+
+	return nil, false
+}
+
+// updatePack adds delta to the member count of the pack identified by name.
+func updatePack(tx *bolt.Tx, name string, delta int) error {
+	bkt, err := tx.CreateBucketIfNotExists(packsBucket)
+	if err != nil {
+		return err
+	}
+
+	info := &PackInfo{
+		Name:    name,
+		Created: time.Now().UTC(),
+	}
+
+	if v := bkt.Get([]byte(name)); v != nil {
+		if err := json.Unmarshal(v, info); err != nil {
+			return err
+		}
+	}
+
+	info.Members += delta
+
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return bkt.Put([]byte(name), buf)
+}
+
+// packable returns true if archives written with pol may be packed.
+// Encrypted archives are never packed, since members could not be read by
+// byte range.
+func (srv *Server) packable(pol *policy.Policy) bool {
+	if srv.packer == nil || srv.keyring != nil {
+		return false
+	}
+
+	if pol.Copies > 1 || pol.Dedup || pol.Parallel() {
+		return false
+	}
+
+	return pol.Compression == "" || pol.Compression == stream.CompressionNone
+}
+
+// storePacked stores p, the complete data of archive, in a pack. Unless the
+// write policy disables acknowledged writes, it returns when the pack has been
+// written, which may take up to the configured pack age.
+func (srv *Server) storePacked(ctx context.Context, archive string, p []byte, pol *policy.Policy, expect ...Digest) (*Receipt, error) {
+	digest := newDigester()
+	digest.Write(p)
+
+	if err := digest.verify(expect); err != nil {
+		if err := srv.Delete(ctx, archive); err != nil {
+			log.Printf("failed to delete archive %s: %v", archive, err)
+		}
+
+		return nil, err
+	}
+
+	pck, err := srv.packer.add(archive, p)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := hex.EncodeToString(digest.sum(DigestSHA256))
+
+	if err := srv.complete(archive, digest, pol, nil); err != nil {
+		return nil, err
+	}
+
+	if pol.AcknowledgedWrite {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-pck.done:
+		}
+
+		if pck.err != nil {
+			return nil, errors.Wrapf(pck.err, "failed to write pack %s", pck.name)
+		}
+	}
+
+	vols, err := srv.volumes(ctx, archive)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Receipt{
+		Archive: archive,
+		Size:    digest.size,
+		Chunks:  0,
+		Volumes: vols,
+		MD5:     hex.EncodeToString(digest.sum(DigestMD5)),
+		SHA256:  sum,
+	}, nil
+}
+
+// retrievePacked writes the data of the packed archive ar to w. Only the byte
+// range of the archive is read from the pack chunk.
+func (srv *Server) retrievePacked(ctx context.Context, ar *Archive, w io.Writer) error {
+	ref := ar.Pack
+
+	var p []byte
+	if buf, ok := srv.pending(ref.Name); ok {
+		p = buf[ref.Offset : ref.Offset+ref.Length]
+	}
+
+	var err error
+	if p == nil {
+		if len(ar.chunks) == 0 {
+			return errors.Errorf("pack %s of %s is not yet stored", ref.Name, ar.Name)
+		}
+
+		for _, info := range ar.chunks {
+			if p, err = srv.readRange(ctx, info, ref.Offset, ref.Length); err == nil {
+				break
+			}
+
+			log.Printf("retrieve: %v", err)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	sum := sha256.Sum256(p)
+	if hex.EncodeToString(sum[:]) != ar.SHA256 {
+		return errors.Errorf("archive %s in pack %s: %v", ar.Name, ref.Name, stream.ErrChecksumMismatch)
+	}
+
+	_, err = w.Write(p)
+
+	return err
+}
+
+// pending returns the buffered data of the pack identified by name if it has
+// not yet been written.
+func (srv *Server) pending(name string) ([]byte, bool) {
+	if srv.packer == nil {
+		return nil, false
+	}
+
+	p, ok := srv.packer.pending(name)
+	if !ok {
+		return nil, false
+	}
+
+	return append([]byte(nil), p...), true
+}
+
+// readRange reads length bytes at offset from the chunk file described by
+// info.
+func (srv *Server) readRange(ctx context.Context, info *ChunkInfo, offset int, length int) ([]byte, error) {
+	mountpoint, drv, err := srv.acquireVolume(ctx, info.Volume)
+	if err != nil {
+		return nil, err
+	}
+
+	if drv != nil {
+		defer drv.Release()
+	}
+
+	f, err := os.Open(path.Join(mountpoint, info.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	p := make([]byte, length)
+	if _, err := f.ReadAt(p, int64(offset)); err != nil {
+		return nil, errors.Wrapf(err, "chunk %s on volume %s", info.Name, info.Volume)
+	}
+
+	return p, nil
+}
+
+// unpack adds delta to the member count of the pack identified by name. Once
+// the pack has been written and all its members deleted, its chunk is marked
+// dead.
+func (srv *Server) unpack(ctx context.Context, name string, delta int) error {
+	var cnks []*ChunkInfo
+
+	err := srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		var err error
+		cnks, err = unpackTx(tx, name, delta)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return srv.killChunks(ctx, cnks)
+}
+
+// unpackTx is unpack within a transaction. It returns the chunks marked dead.
+func unpackTx(tx *bolt.Tx, name string, delta int) ([]*ChunkInfo, error) {
+	if err := updatePack(tx, name, delta); err != nil {
+		return nil, err
+	}
+
+	info := new(PackInfo)
+	if err := json.Unmarshal(tx.Bucket(packsBucket).Get([]byte(name)), info); err != nil {
+		return nil, err
+	}
+
+	bkt := tx.Bucket([]byte(name))
+	if info.Members > 0 || bkt == nil {
+		return nil, nil
+	}
+
+	cnks, err := readChunks(bkt)
+	if err != nil {
+		return nil, err
+	}
+
+	// not yet written
+	if len(cnks) == 0 {
+		return nil, nil
+	}
+
+	for _, cnk := range cnks {
+		if err := killChunk(tx, cnk); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.DeleteBucket([]byte(name)); err != nil {
+		return nil, err
+	}
+
+	return cnks, tx.Bucket(packsBucket).Delete([]byte(name))
+}
+
+// readPack returns the chunks of the pack identified by name.
+func readPack(tx *bolt.Tx, name string) ([]*ChunkInfo, error) {
+	bkt := tx.Bucket([]byte(name))
+	if bkt == nil {
+		return nil, nil
+	}
+
+	return readChunks(bkt)
+}
+
+// packHead reads up to the pack threshold from rd. If rd holds less, the data
+// is returned with ok set. Otherwise a reader yielding all of rd is returned.
+func (srv *Server) packHead(rd io.Reader) (p []byte, ok bool, r io.Reader, err error) {
+	head := make([]byte, srv.packer.threshold)
+
+	n, err := io.ReadFull(rd, head)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		return head[:n], true, nil, nil
+	case nil:
+		return nil, false, io.MultiReader(bytes.NewReader(head), rd), nil
+	}
+
+	return nil, false, nil, err
+}
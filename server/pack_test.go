@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/config"
+	"github.com/bh107/tapr/stream/policy"
+)
+
+func TestPackFailure(t *testing.T) {
+	srv, cleanup := newTestServer(t, func(cfg *config.Config, dir string) {
+		cfg.Pack = config.PackConfig{Threshold: 1 << 10, Size: 1 << 19, Age: "10ms"}
+	})
+	defer cleanup()
+
+	pol := policy.NewDefaultPolicy()
+	data := []byte("the tape custodian")
+
+	// fail the write by pulling the file system from under the drive
+	mountpoint, err := srv.drives["write"][0].Mountpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(mountpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store(t, srv, "small", pol, data); err == nil {
+		t.Fatal("expected store to fail")
+	}
+
+	if _, err := srv.Stat(context.Background(), "small"); err != ErrNoSuchArchive {
+		t.Fatalf("expected member of failed pack to be deleted, got %v", err)
+	}
+
+	err = srv.chunkdb.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if bytes.HasPrefix(name, []byte(".pack-")) {
+				t.Errorf("expected failed pack %s to be removed", name)
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(mountpoint, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store(t, srv, "other", pol, data); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := retrieve(t, srv, "other"); !bytes.Equal(got, data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+}
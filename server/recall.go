@@ -0,0 +1,580 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+var (
+	ErrNoSuchRecall   = errors.New("no such recall")
+	ErrRecallDisabled = errors.New("recall is not configured")
+)
+
+// recallsBucket is the top-level bucket holding the recall jobs, keyed by
+// archive name.
+var recallsBucket = []byte(".recalls")
+
+// RecallState is the state of a recall job.
+type RecallState string
+
+const (
+	RecallQueued  RecallState = "queued"
+	RecallStaging RecallState = "staging"
+	RecallReady   RecallState = "ready"
+	RecallFailed  RecallState = "failed"
+
+	// RecallOffsite jobs wait for offsite volumes to be imported.
+	RecallOffsite RecallState = "offsite"
+)
+
+// RecallJob stages an archive from tape to the recall cache. Once ready, the
+// archive is retrieved from the cache until evicted.
+type RecallJob struct {
+	Archive string      `json:"archive"`
+	State   RecallState `json:"state"`
+	Error   string      `json:"error,omitempty"`
+	Size    int64       `json:"size"`
+
+	// Created is the creation time of the recalled archive; the staged copy
+	// of an archive that has since been replaced is stale.
+	Created time.Time `json:"created"`
+
+	Requested time.Time `json:"requested"`
+	Staged    time.Time `json:"staged"`
+
+	// Volume is the volume holding the first chunk of the archive and
+	// position the time that chunk was written, which orders the jobs
+	// reading from the same volume. Volumes are read in library.
+	Volume   string `json:"volume,omitempty"`
+	position time.Time
+	library  string
+
+	// Offsite lists the volumes that must be imported before the archive
+	// can be staged.
+	Offsite []string `json:"offsite,omitempty"`
+
+	elem *list.Element
+}
+
+// recaller runs the recall jobs and manages the cache the archives are
+// staged to. Staged archives are evicted in least recently used order when
+// room is needed for another.
+type recaller struct {
+	srv  *Server
+	dir  string
+	size int64
+
+	mu    sync.Mutex
+	jobs  map[string]*RecallJob
+	queue []*RecallJob
+	wake  chan struct{}
+
+	// active holds the batches being read, keyed by volume serial, and busy
+	// the read drives assigned to them.
+	active map[string]*batch
+	busy   map[*Drive]bool
+
+	// lru holds the ready jobs, most recently used first. used is the
+	// number of bytes in the cache, including the space reserved by jobs
+	// being staged.
+	lru  *list.List
+	used int64
+}
+
+// newRecaller creates a recaller staging to dir. Jobs persisted by a
+// previous run are resumed and staged archives still in dir are put back in
+// the cache.
+func newRecaller(srv *Server, dir string, size int64) (*recaller, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	r := &recaller{
+		srv:  srv,
+		dir:  dir,
+		size: size,
+		jobs: make(map[string]*RecallJob),
+		wake: make(chan struct{}, 1),
+		lru:  list.New(),
+
+		active: make(map[string]*batch),
+		busy:   make(map[*Drive]bool),
+	}
+
+	var jobs []*RecallJob
+
+	err := srv.chunkdb.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(recallsBucket)
+		if bkt == nil {
+			return nil
+		}
+
+		return bkt.ForEach(func(k, v []byte) error {
+			job := new(RecallJob)
+			if err := json.Unmarshal(v, job); err != nil {
+				return err
+			}
+
+			jobs = append(jobs, job)
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the most recently staged archives are the most recently used ones
+	// as far as we know
+	sort.Sort(byStaged(jobs))
+
+	keep := make(map[string]bool)
+	for _, job := range jobs {
+		switch job.State {
+		case RecallReady:
+			if _, err := os.Stat(r.path(job.Archive)); err != nil {
+				log.Printf("recall: staged copy of %s is gone: %v", job.Archive, err)
+				if err := r.drop(job.Archive); err != nil {
+					return nil, err
+				}
+
+				continue
+			}
+
+			job.elem = r.lru.PushBack(job)
+			r.used += job.Size
+			keep[path.Base(r.path(job.Archive))] = true
+
+		case RecallQueued, RecallStaging:
+			job.State = RecallQueued
+			if ar, err := srv.Stat(context.Background(), job.Archive); err == nil {
+				if !srv.checkOffsite(context.Background(), ar, job) {
+					break
+				}
+			}
+
+			r.queue = append(r.queue, job)
+		}
+
+		r.jobs[job.Archive] = job
+	}
+
+	// remove partially staged archives
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fi := range files {
+		if !keep[fi.Name()] {
+			if err := os.Remove(path.Join(dir, fi.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	go r.run()
+
+	if len(r.queue) > 0 {
+		r.notify()
+	}
+
+	return r, nil
+}
+
+type byStaged []*RecallJob
+
+func (s byStaged) Len() int           { return len(s) }
+func (s byStaged) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStaged) Less(i, j int) bool { return s[i].Staged.After(s[j].Staged) }
+
+// path returns the path of the staged copy of archive.
+func (r *recaller) path(archive string) string {
+	sum := sha256.Sum256([]byte(archive))
+	return path.Join(r.dir, hex.EncodeToString(sum[:]))
+}
+
+func (r *recaller) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// put persists job.
+func (r *recaller) put(job *RecallJob) error {
+	buf, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return r.srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(recallsBucket)
+		if err != nil {
+			return err
+		}
+
+		return bkt.Put([]byte(job.Archive), buf)
+	})
+}
+
+// drop removes the persisted job of archive.
+func (r *recaller) drop(archive string) error {
+	return r.srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(recallsBucket)
+		if bkt == nil {
+			return nil
+		}
+
+		return bkt.Delete([]byte(archive))
+	})
+}
+
+// run schedules the queued jobs until the server exits.
+func (r *recaller) run() {
+	for range r.wake {
+		r.schedule()
+	}
+}
+
+// stage reads the archive of job from tape into the cache.
+func (r *recaller) stage(ctx context.Context, job *RecallJob) {
+	log.Printf("recall: staging %s", job.Archive)
+
+	err := r.reserve(job)
+	reserved := err == nil
+	if err == nil {
+		err = r.retrieve(ctx, job)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil && reserved {
+		r.used -= job.Size
+	}
+
+	// the archive was deleted or replaced while staging
+	if r.jobs[job.Archive] != job {
+		if err == nil {
+			r.used -= job.Size
+
+			if cur, ok := r.jobs[job.Archive]; !ok || cur.State != RecallReady {
+				os.Remove(r.path(job.Archive))
+			}
+		}
+
+		return
+	}
+
+	if err != nil {
+		log.Printf("recall: failed to stage %s: %v", job.Archive, err)
+
+		job.State = RecallFailed
+		job.Error = err.Error()
+	} else {
+		job.State = RecallReady
+		job.Staged = time.Now().UTC()
+		job.elem = r.lru.PushFront(job)
+	}
+
+	if err := r.put(job); err != nil {
+		log.Printf("recall: %v", err)
+	}
+}
+
+// reserve makes room in the cache for the archive of job, evicting the least
+// recently used archives as needed.
+func (r *recaller) reserve(job *RecallJob) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if job.Size > r.size {
+		return errors.Errorf("archive size %d exceeds recall cache size %d", job.Size, r.size)
+	}
+
+	for r.used+job.Size > r.size {
+		elem := r.lru.Back()
+		if elem == nil {
+			return errors.New("recall cache is full")
+		}
+
+		r.evict(elem.Value.(*RecallJob))
+	}
+
+	// the archive was deleted while queued
+	if r.jobs[job.Archive] != job {
+		return errors.Errorf("recall of %s was canceled", job.Archive)
+	}
+
+	job.State = RecallStaging
+	if err := r.put(job); err != nil {
+		return err
+	}
+
+	r.used += job.Size
+
+	return nil
+}
+
+// evict removes the staged copy of a ready job. The caller must hold r.mu.
+func (r *recaller) evict(job *RecallJob) {
+	log.Printf("recall: evicting %s", job.Archive)
+
+	r.lru.Remove(job.elem)
+	r.used -= job.Size
+	delete(r.jobs, job.Archive)
+
+	if err := os.Remove(r.path(job.Archive)); err != nil && !os.IsNotExist(err) {
+		log.Printf("recall: %v", err)
+	}
+
+	if err := r.drop(job.Archive); err != nil {
+		log.Printf("recall: %v", err)
+	}
+}
+
+// retrieve writes the archive of job to its staged copy. The copy only
+// appears once complete.
+func (r *recaller) retrieve(ctx context.Context, job *RecallJob) error {
+	f, err := ioutil.TempFile(r.dir, ".staging-")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	ar, err := r.srv.Stat(ctx, job.Archive)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if !ar.Created.Equal(job.Created) {
+		f.Close()
+		return errors.Errorf("archive %s was replaced", job.Archive)
+	}
+
+	if err := r.srv.retrieve(ctx, ar, f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), r.path(job.Archive))
+}
+
+// open returns the staged copy of ar, if any.
+func (r *recaller) open(ar *Archive) (*os.File, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[ar.Name]
+	if !ok || job.State != RecallReady {
+		return nil, false
+	}
+
+	if !job.Created.Equal(ar.Created) {
+		r.evict(job)
+		return nil, false
+	}
+
+	// an evicted copy that is still open can be read until closed
+	f, err := os.Open(r.path(ar.Name))
+	if err != nil {
+		log.Printf("recall: %v", err)
+		r.evict(job)
+		return nil, false
+	}
+
+	r.lru.MoveToFront(job.elem)
+
+	return f, true
+}
+
+// forget drops the job and staged copy of archive, if any.
+func (r *recaller) forget(archive string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[archive]
+	if !ok {
+		return
+	}
+
+	switch job.State {
+	case RecallReady:
+		r.evict(job)
+		return
+
+	case RecallQueued:
+		r.dequeue(job)
+	}
+
+	// a job being staged is discarded when done
+	delete(r.jobs, archive)
+
+	if err := r.drop(archive); err != nil {
+		log.Printf("recall: %v", err)
+	}
+}
+
+// Recall queues a job staging archive from tape to the recall cache and
+// returns it. If the archive is already staged or being staged, the existing
+// job is returned. Failed jobs are retried. If some of the archive is only
+// on offsite volumes, the job waits for those to be imported.
+func (srv *Server) Recall(ctx context.Context, archive string) (*RecallJob, error) {
+	if srv.recall == nil {
+		return nil, ErrRecallDisabled
+	}
+
+	ar, err := srv.Stat(ctx, archive)
+	if err != nil {
+		return nil, err
+	}
+
+	r := srv.recall
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if job, ok := r.jobs[archive]; ok && job.State != RecallFailed && job.State != RecallOffsite {
+		if job.Created.Equal(ar.Created) {
+			cp := *job
+			return &cp, nil
+		}
+
+		// the archive was replaced
+		if job.State == RecallReady {
+			r.evict(job)
+		}
+	}
+
+	log.Printf("recall archive: %s", archive)
+
+	job := &RecallJob{
+		Archive:   archive,
+		State:     RecallQueued,
+		Size:      ar.Size,
+		Created:   ar.Created,
+		Requested: time.Now().UTC(),
+	}
+
+	queued := srv.checkOffsite(ctx, ar, job)
+	if !queued {
+		log.Printf("recall: %s waits for offsite volumes %v", archive, job.Offsite)
+	}
+
+	if err := r.put(job); err != nil {
+		return nil, err
+	}
+
+	r.jobs[archive] = job
+
+	if queued {
+		r.queue = append(r.queue, job)
+		r.notify()
+	}
+
+	cp := *job
+	return &cp, nil
+}
+
+// imported queues the jobs that were waiting for offsite volumes if all of
+// their archive is now onsite.
+func (r *recaller) imported(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var queued bool
+	for _, job := range r.jobs {
+		if job.State != RecallOffsite {
+			continue
+		}
+
+		ar, err := r.srv.Stat(ctx, job.Archive)
+		if err != nil || !ar.Created.Equal(job.Created) {
+			// recalling the archive again replaces the job
+			continue
+		}
+
+		if !r.srv.checkOffsite(ctx, ar, job) {
+			continue
+		}
+
+		log.Printf("recall: %s is onsite again, queuing", job.Archive)
+
+		if err := r.put(job); err != nil {
+			log.Printf("recall: %v", err)
+		}
+
+		r.queue = append(r.queue, job)
+		queued = true
+	}
+
+	if queued {
+		r.notify()
+	}
+}
+
+// RecallStatus returns the recall job of archive.
+func (srv *Server) RecallStatus(ctx context.Context, archive string) (*RecallJob, error) {
+	if srv.recall == nil {
+		return nil, ErrRecallDisabled
+	}
+
+	r := srv.recall
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[archive]
+	if !ok {
+		return nil, errors.Wrap(ErrNoSuchRecall, archive)
+	}
+
+	cp := *job
+	return &cp, nil
+}
+
+// cached writes the staged copy of ar to w if the archive has been recalled.
+// It returns false if it has not.
+func (srv *Server) cached(ar *Archive, w io.Writer) (bool, error) {
+	if srv.recall == nil {
+		return false, nil
+	}
+
+	f, ok := srv.recall.open(ar)
+	if !ok {
+		return false, nil
+	}
+
+	defer f.Close()
+
+	_, err := io.Copy(w, f)
+
+	return true, err
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/config"
+	"github.com/bh107/tapr/stream/policy"
+)
+
+// recalled recalls archive and waits for it to be staged.
+func recalled(t *testing.T, srv *Server, archive string) {
+	ctx := context.Background()
+
+	if _, err := srv.Recall(ctx, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		job, err := srv.RecallStatus(ctx, archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch job.State {
+		case RecallReady:
+			return
+		case RecallFailed:
+			t.Fatalf("recall of %s failed: %s", archive, job.Error)
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s to be staged", archive)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRecallEviction(t *testing.T) {
+	srv, cleanup := newTestServer(t, func(cfg *config.Config, dir string) {
+		cfg.Recall = config.RecallConfig{
+			Cache: filepath.Join(dir, "recall"),
+			Size:  2*len(custodian) + len(custodian)/2,
+		}
+	})
+	defer cleanup()
+
+	ctx := context.Background()
+	pol := policy.NewDefaultPolicy()
+
+	for _, archive := range []string{"first", "second", "third"} {
+		if _, err := store(t, srv, archive, pol, custodian); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recalled(t, srv, "first")
+	recalled(t, srv, "second")
+
+	// reading the first archive makes the second the least recently used
+	if got := retrieve(t, srv, "first"); !bytes.Equal(got, custodian) {
+		t.Fatalf("retrieved %d bytes, expected %d", len(got), len(custodian))
+	}
+
+	recalled(t, srv, "third")
+
+	if _, err := srv.RecallStatus(ctx, "second"); errors.Cause(err) != ErrNoSuchRecall {
+		t.Fatalf("expected second to be evicted, got %v", err)
+	}
+
+	for _, archive := range []string{"first", "third"} {
+		job, err := srv.RecallStatus(ctx, archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if job.State != RecallReady {
+			t.Fatalf("expected %s to be %s, got %s", archive, RecallReady, job.State)
+		}
+	}
+
+	// evicted archives are read from tape again
+	if got := retrieve(t, srv, "second"); !bytes.Equal(got, custodian) {
+		t.Fatalf("retrieved %d bytes, expected %d", len(got), len(custodian))
+	}
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/stream"
+)
+
+// DefaultReclaimThreshold is the fraction of live data below which volumes
+// are reclaimed if not configured.
+const DefaultReclaimThreshold = 0.5
+
+// reclaimLoop runs Reclaim every interval.
+func (srv *Server) reclaimLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := srv.Reclaim(context.Background()); err != nil {
+			log.Printf("reclaim: %v", err)
+		}
+	}
+}
+
+// reclaimThreshold returns the configured reclaim threshold, or
+// DefaultReclaimThreshold if none is configured. A zero threshold disables
+// reclamation.
+func (srv *Server) reclaimThreshold() float64 {
+	if srv.cfg.Reclaim.Threshold == nil {
+		return DefaultReclaimThreshold
+	}
+
+	return *srv.cfg.Reclaim.Threshold
+}
+
+// Reclaim repacks full volumes whose live data has dropped below the
+// configured threshold. The live chunks of each volume are read using a read
+// drive and rewritten to fresh volumes through the regular write path, after
+// which the old volume is returned to the scratch pool. Reclaim returns the
+// serials of the volumes reclaimed.
+func (srv *Server) Reclaim(ctx context.Context) ([]string, error) {
+	srv.reclaimMu.Lock()
+	defer srv.reclaimMu.Unlock()
+
+	reclaimed := make([]string, 0)
+
+	threshold := srv.reclaimThreshold()
+	if threshold <= 0 {
+		return reclaimed, nil
+	}
+
+	serials, err := srv.inv.Reclaimable(ctx, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, serial := range serials {
+		// volumes still being appended to are left alone
+		if srv.writing(serial) {
+			continue
+		}
+
+		if err := srv.reclaimVolume(ctx, serial); err != nil {
+			return reclaimed, errors.Wrapf(err, "failed to reclaim volume %s", serial)
+		}
+
+		reclaimed = append(reclaimed, serial)
+	}
+
+	return reclaimed, nil
+}
+
+// writing returns true if the volume identified by serial is loaded in a write
+// drive.
+func (srv *Server) writing(serial string) bool {
+	for _, drv := range srv.drives["write"] {
+		if drv.holds(serial) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// liveChunks returns the live chunks on the volume identified by serial
+// grouped by archive. Index entries no longer referenced by their archive are
+// returned separately.
+func (srv *Server) liveChunks(serial string) (map[string][]*ChunkInfo, []*ChunkInfo, error) {
+	live := make(map[string][]*ChunkInfo)
+
+	var stale []*ChunkInfo
+
+	err := srv.chunkdb.View(func(tx *bolt.Tx) error {
+		vols := tx.Bucket(volumesBucket)
+		if vols == nil {
+			return nil
+		}
+
+		bkt := vols.Bucket([]byte(serial))
+		if bkt == nil {
+			return nil
+		}
+
+		return bkt.ForEach(func(k, v []byte) error {
+			entry := new(fileEntry)
+			if err := json.Unmarshal(v, entry); err != nil {
+				return err
+			}
+
+			if entry.Dead {
+				return nil
+			}
+
+			ref := &ChunkInfo{
+				ID:     entry.ID,
+				Copy:   entry.Copy,
+				Volume: serial,
+				Name:   string(k),
+				Size:   entry.Size,
+				Stripe: entry.Stripe,
+				Shard:  entry.Shard,
+				Parity: entry.Parity,
+
+				Fingerprint: entry.Fingerprint,
+			}
+
+			// the archive must still reference the file
+			var info *ChunkInfo
+			if ar := tx.Bucket([]byte(entry.Archive)); ar != nil {
+				var err error
+				if info, err = getChunk(ar, ref); err != nil {
+					return err
+				}
+			}
+
+			if info == nil || info.Volume != serial || info.Name != string(k) {
+				stale = append(stale, ref)
+				return nil
+			}
+
+			live[entry.Archive] = append(live[entry.Archive], info)
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return live, stale, nil
+}
+
+// reclaimVolume moves the live chunks off the volume identified by serial and
+// returns it to the scratch pool.
+func (srv *Server) reclaimVolume(ctx context.Context, serial string) error {
+	live, stale, err := srv.liveChunks(serial)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("reclaim: volume %s has live chunks from %d archives", serial, len(live))
+
+	if err := srv.retire(ctx, stale); err != nil {
+		return err
+	}
+
+	if len(live) > 0 {
+		_, libname, err := srv.inv.Lookup(ctx, serial)
+		if err != nil {
+			return err
+		}
+
+		mountpoint, drv, err := srv.acquireVolume(ctx, serial)
+		if err != nil {
+			return err
+		}
+
+		if drv != nil {
+			defer drv.Release()
+		}
+
+		archives := make([]string, 0, len(live))
+		for archive := range live {
+			archives = append(archives, archive)
+		}
+
+		sort.Strings(archives)
+
+		for _, archive := range archives {
+			cnks := live[archive]
+
+			if err := srv.rewrite(ctx, archive, libname, mountpoint, cnks); err != nil {
+				return errors.Wrapf(err, "archive %s", archive)
+			}
+
+			if err := srv.retire(ctx, cnks); err != nil {
+				return err
+			}
+		}
+
+		// unloading the volume returns it to the scratch pool
+		if drv != nil {
+			if err := srv.unmount(drv); err != nil {
+				return err
+			}
+
+			return srv.Unload(drv)
+		}
+	}
+
+	return srv.scratchIfEmpty(ctx, serial)
+}
+
+// rewrite reads the given chunks of archive from mountpoint and writes them to
+// new volumes in the library identified by libname, replacing the chunk
+// records of the archive.
+func (srv *Server) rewrite(ctx context.Context, archive string, libname string, mountpoint string, cnks []*ChunkInfo) error {
+	// read chunks in the order they were written to tape
+	sort.Slice(cnks, func(i, j int) bool { return cnks[i].Name < cnks[j].Name })
+
+	// keep the copy count of the archive, such that the chunks stay in the
+	// library if a volume fills up; deduplicated chunks in the pool and packs
+	// have no archive metadata and use the configured count
+	pol := srv.writePolicy(context.Background())
+	if archive[0] != '.' {
+		ar, err := srv.stat(archive)
+		if err != nil {
+			return err
+		}
+
+		if ar.Policy != nil {
+			pol.Copies = ar.Policy.Copies
+		}
+	}
+
+	// chunks of different copies are written through separate streams
+	streams := make(map[int]*stream.Stream)
+
+	for _, info := range cnks {
+		buf, err := ioutil.ReadFile(path.Join(mountpoint, info.Name))
+		if err == nil {
+			err = errors.Wrapf(stream.Verify(info.Checksum, buf), "chunk %s on volume %s", info.Name, info.Volume)
+		}
+
+		// streams are opened once the first chunk has been read, such that
+		// closing them never writes an empty chunk
+		s, ok := streams[info.Copy]
+		if err == nil && !ok {
+			s, err = srv.openStream(ctx, archive, pol, info.Copy, libname)
+			if err == nil {
+				streams[info.Copy] = s
+			}
+		}
+
+		if err == nil {
+			err = s.Rewrite(ctx, info.ID, info.meta(), buf)
+		}
+
+		if err != nil {
+			for _, s := range streams {
+				s.Abort()
+			}
+
+			return err
+		}
+	}
+
+	var err error
+	for _, s := range streams {
+		if cerr := s.Close(ctx); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// retire marks the given chunk files dead.
+func (srv *Server) retire(ctx context.Context, cnks []*ChunkInfo) error {
+	err := srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		for _, info := range cnks {
+			if err := killChunk(tx, info); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, info := range cnks {
+		if _, err := srv.inv.KillChunk(ctx, info.Volume, info.Size); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
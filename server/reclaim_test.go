@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/config"
+	"github.com/bh107/tapr/inventory"
+	"github.com/bh107/tapr/stream/policy"
+)
+
+// fillVolume stores archives until the first volume written is full and
+// deletes all but one of the archives on it. It returns the serial of the full
+// volume, the archive left on it and the archive on the volume being filled.
+func fillVolume(t *testing.T, srv *Server) (string, string, string) {
+	ctx := context.Background()
+	pol := policy.NewDefaultPolicy()
+
+	var full string
+	var archives []string
+	for i := 0; ; i++ {
+		archive := fmt.Sprintf("archive-%d", i)
+
+		receipt, err := store(t, srv, archive, pol, custodian)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if full == "" {
+			full = receipt.Volumes[0]
+		}
+
+		// the mock volumes hold a MiB
+		if receipt.Volumes[0] != full {
+			break
+		}
+
+		archives = append(archives, archive)
+	}
+
+	for _, archive := range archives[1:] {
+		if err := srv.Delete(ctx, archive); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return full, archives[0], fmt.Sprintf("archive-%d", len(archives))
+}
+
+func TestReclaim(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	full, kept, filling := fillVolume(t, srv)
+
+	// leave a third of the volume being filled live
+	for _, archive := range []string{"deleted-1", "deleted-2"} {
+		if _, err := store(t, srv, archive, policy.NewDefaultPolicy(), custodian); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := srv.Delete(ctx, archive); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reclaimed, err := srv.Reclaim(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// volumes being filled are left alone
+	if len(reclaimed) != 1 || reclaimed[0] != full {
+		t.Fatalf("expected %s to be reclaimed, got %v", full, reclaimed)
+	}
+
+	if st := state(t, srv, full); st != inventory.StateScratch {
+		t.Fatalf("expected %s to be %s, got %s", full, inventory.StateScratch, st)
+	}
+
+	ar, err := srv.Stat(ctx, kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, vol := range ar.Volumes() {
+		if vol.Serial == full {
+			t.Fatalf("expected the live chunks to be moved off %s", full)
+		}
+	}
+
+	for _, archive := range []string{kept, filling} {
+		if got := retrieve(t, srv, archive); !bytes.Equal(got, custodian) {
+			t.Fatalf("%s: retrieved %d bytes, expected %d", archive, len(got), len(custodian))
+		}
+	}
+}
+
+func TestReclaimDisabled(t *testing.T) {
+	srv, cleanup := newTestServer(t, func(cfg *config.Config, dir string) {
+		threshold := 0.0
+		cfg.Reclaim.Threshold = &threshold
+	})
+	defer cleanup()
+
+	full, _, _ := fillVolume(t, srv)
+
+	reclaimed, err := srv.Reclaim(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reclaimed) != 0 {
+		t.Fatalf("expected reclamation to be disabled, got %v", reclaimed)
+	}
+
+	if st := state(t, srv, full); st != inventory.StateFull {
+		t.Fatalf("expected %s to be %s, got %s", full, inventory.StateFull, st)
+	}
+}
@@ -0,0 +1,376 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/inventory"
+	"github.com/bh107/tapr/stream"
+	"github.com/bh107/tapr/stream/policy"
+)
+
+// readPolicy is used when acquiring read drives. A read drive is always used
+// exclusively since it holds a single volume at a time.
+var readPolicy = &policy.Policy{
+	Exclusive: true,
+}
+
+// chunkFunc is called with the data of a chunk that has been read and
+// verified.
+type chunkFunc func(info *ChunkInfo, p []byte) error
+
+// Retrieve writes the contents of archive to w. Volumes holding the archive
+// are loaded into read drives in the library holding the volume, unless they
+// are already mounted in a drive. Chunks are read from their first copy; other
+// copies are only used if the first one cannot be read. Recalled archives are
+// read from the recall cache instead.
+func (srv *Server) Retrieve(ctx context.Context, archive string, w io.Writer) error {
+	log.Printf("retrieve archive: %s", archive)
+
+	ar, err := srv.Stat(ctx, archive)
+	if err != nil {
+		return err
+	}
+
+	if ok, err := srv.cached(ar, w); ok {
+		return err
+	}
+
+	return srv.retrieve(ctx, ar, w)
+}
+
+// retrieve writes the contents of ar to w, reading the chunks from tape or the
+// disk spool.
+func (srv *Server) retrieve(ctx context.Context, ar *Archive, w io.Writer) error {
+	archive := ar.Name
+
+	if ar.Spooled && srv.spool != nil {
+		ok, err := srv.retrieveSpooled(ar, w)
+		if ok {
+			return err
+		}
+
+		// migrated meanwhile
+		if ar, err = srv.Stat(ctx, archive); err != nil {
+			return err
+		}
+	}
+
+	// fail before anything is written if some of the archive is offsite
+	offsite, err := srv.offsite(ctx, ar)
+	if err != nil {
+		return err
+	}
+
+	if len(offsite) > 0 {
+		return errors.Wrapf(inventory.ErrOffsite, "archive %s needs volumes %v", archive, offsite)
+	}
+
+	if ar.Pack != nil {
+		return srv.retrievePacked(ctx, ar, w)
+	}
+
+	// group the copies of each chunk
+	var cnks [][]*ChunkInfo
+	for _, info := range ar.chunks {
+		if info.Parity {
+			continue
+		}
+
+		if info.Volume == "" {
+			return errors.Errorf("chunk %d of %s is not yet stored", info.ID, archive)
+		}
+
+		if n := len(cnks); n > 0 && cnks[n-1][0].ID == info.ID {
+			cnks[n-1] = append(cnks[n-1], info)
+			continue
+		}
+
+		cnks = append(cnks, []*ChunkInfo{info})
+	}
+
+	fn, err := srv.decoder(ar, w)
+	if err != nil {
+		return err
+	}
+
+	for len(cnks) > 0 {
+		// read the run of chunks located on the same volume in one go
+		run := []*ChunkInfo{cnks[0][0]}
+		for len(run) < len(cnks) && cnks[len(run)][0].Volume == run[0].Volume {
+			run = append(run, cnks[len(run)][0])
+		}
+
+		n, err := srv.readChunks(ctx, run[0].Volume, run, fn)
+		if err != nil {
+			// try the remaining copies of the failed chunk
+			err = srv.readCopies(ctx, cnks[n][1:], fn, err)
+
+			// and then the rest of its stripe
+			if err != nil && cnks[n][0].Stripe > 0 {
+				log.Printf("retrieve: %v, reconstructing chunk %d of %s", err, cnks[n][0].ID, archive)
+				err = srv.reconstruct(ctx, ar, cnks[n][0], fn)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			n++
+		}
+
+		cnks = cnks[n:]
+	}
+
+	return nil
+}
+
+// decoder returns a chunkFunc writing the decrypted and decompressed data of
+// the chunks of ar to w. Deduplicated chunks may be encrypted with the data key
+// of another archive.
+func (srv *Server) decoder(ar *Archive, w io.Writer) (chunkFunc, error) {
+	keys := make(map[string][]byte)
+	if ar.Key != nil {
+		if srv.keyring == nil {
+			return nil, errors.Errorf("archive %s is encrypted, but no keys are configured", ar.Name)
+		}
+
+		key, err := srv.keyring.Unwrap(ar.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to unwrap key of archive %s", ar.Name)
+		}
+
+		keys[ar.Key.ID] = key
+	}
+
+	return func(info *ChunkInfo, p []byte) error {
+		if info.Key != "" {
+			key, ok := keys[info.Key]
+			if !ok {
+				var err error
+				if key, err = srv.dataKey(info.Key); err != nil {
+					return errors.Wrapf(err, "chunk %d of %s", info.ID, ar.Name)
+				}
+
+				keys[info.Key] = key
+			}
+
+			var err error
+			if info.Fingerprint != "" {
+				p, err = stream.Decrypt(key, info.Fingerprint, 0, p)
+			} else {
+				p, err = stream.Decrypt(key, info.Key, info.ID, p)
+			}
+
+			if err != nil {
+				return errors.Wrapf(err, "failed to decrypt chunk %d of %s", info.ID, ar.Name)
+			}
+		}
+
+		if info.Codec != "" {
+			var err error
+			if p, err = stream.Decompress(info.Codec, p, info.Length); err != nil {
+				return errors.Wrapf(err, "failed to decompress chunk %d of %s", info.ID, ar.Name)
+			}
+		}
+
+		_, err := w.Write(p)
+
+		return err
+	}, nil
+}
+
+// readCopies reads the first readable of the given copies of a chunk. If no
+// copy can be read, err is returned.
+func (srv *Server) readCopies(ctx context.Context, copies []*ChunkInfo, fn chunkFunc, err error) error {
+	for _, info := range copies {
+		log.Printf("retrieve: %v, trying copy %d on volume %s", err, info.Copy, info.Volume)
+
+		if _, err = srv.readChunks(ctx, info.Volume, []*ChunkInfo{info}, fn); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// reconstruct rebuilds the lost chunk of ar from the other chunks in its
+// erasure coded stripe.
+func (srv *Server) reconstruct(ctx context.Context, ar *Archive, lost *ChunkInfo, fn chunkFunc) error {
+	if ar.Erasure == nil {
+		return errors.Errorf("archive %s is not erasure coded", ar.Name)
+	}
+
+	enc, err := ar.Erasure.Encoder()
+	if err != nil {
+		return err
+	}
+
+	stripe := ar.stripe(lost.Stripe)
+
+	// all chunks of the stripe are padded to the size of the largest one
+	var size int
+	exists := make([]bool, ar.Erasure.Shards())
+	for _, info := range stripe {
+		if info.Size > size {
+			size = info.Size
+		}
+
+		exists[info.Shard] = true
+	}
+
+	shards := make([][]byte, ar.Erasure.Shards())
+	for _, info := range stripe {
+		if info.Shard == lost.Shard || shards[info.Shard] != nil {
+			continue
+		}
+
+		_, err := srv.readChunks(ctx, info.Volume, []*ChunkInfo{info}, func(info *ChunkInfo, p []byte) error {
+			shards[info.Shard] = append(p, make([]byte, size-len(p))...)
+			return nil
+		})
+
+		if err != nil {
+			log.Printf("reconstruct: %v", err)
+		}
+	}
+
+	// data chunks missing from the catalog are the zeros completing a
+	// partial stripe
+	for i := 0; i < ar.Erasure.Data; i++ {
+		if !exists[i] {
+			shards[i] = make([]byte, size)
+		}
+	}
+
+	if err := enc.ReconstructData(shards); err != nil {
+		return errors.Wrapf(err, "failed to reconstruct chunk %d of %s", lost.ID, ar.Name)
+	}
+
+	buf := shards[lost.Shard][:lost.Size]
+
+	if err := stream.Verify(lost.Checksum, buf); err != nil {
+		return errors.Wrapf(err, "reconstructed chunk %d of %s", lost.ID, ar.Name)
+	}
+
+	return fn(lost, buf)
+}
+
+// readChunks reads the given chunks from the volume identified by serial and
+// passes them to fn. It returns the number of chunks passed on.
+func (srv *Server) readChunks(ctx context.Context, serial string, cnks []*ChunkInfo, fn chunkFunc) (int, error) {
+	mountpoint, drv, err := srv.acquireVolume(ctx, serial)
+	if err != nil {
+		return 0, err
+	}
+
+	if drv != nil {
+		defer drv.Release()
+	}
+
+	for n, info := range cnks {
+		// the whole chunk is read and verified before any of it is passed on
+		buf, err := ioutil.ReadFile(path.Join(mountpoint, info.Name))
+		if err != nil {
+			return n, err
+		}
+
+		if err := stream.Verify(info.Checksum, buf); err != nil {
+			return n, errors.Wrapf(err, "chunk %s on volume %s", info.Name, serial)
+		}
+
+		if err := fn(info, buf); err != nil {
+			return n, err
+		}
+	}
+
+	return len(cnks), nil
+}
+
+// acquireVolume makes the volume identified by serial available for reading
+// and returns the path it is mounted at. If the volume was loaded into a read
+// drive, the drive is returned and must be released when the caller is done
+// reading from the volume. If the context holds a read drive in the library of
+// the volume, the volume is loaded into that drive, unless it is already in
+// another drive.
+func (srv *Server) acquireVolume(ctx context.Context, serial string) (string, *Drive, error) {
+	// the volume may be mounted in a write drive that is still appending to
+	// it; reading completed chunks from the mounted file system is fine.
+	for _, drv := range srv.drives["write"] {
+		if drv.holds(serial) {
+			mountpoint, err := drv.Mountpoint()
+			if err != nil {
+				return "", nil, err
+			}
+
+			return mountpoint, nil, nil
+		}
+	}
+
+	vol, libname, err := srv.inv.Lookup(ctx, serial)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "failed to locate volume %s", serial)
+	}
+
+	// a volume already in a read drive is read from that drive
+	var loaded *Drive
+	for _, drv := range srv.drives["read"] {
+		if drv.holds(serial) {
+			loaded = drv
+			break
+		}
+	}
+
+	// a drive held by the caller is used for all volumes in its library that
+	// are not in another drive
+	if drv := heldDrive(ctx, libname); drv != nil && (loaded == nil || loaded == drv) {
+		if err := srv.Mount(drv, vol); err != nil {
+			return "", nil, err
+		}
+
+		mountpoint, err := drv.Mountpoint()
+		if err != nil {
+			return "", nil, err
+		}
+
+		return mountpoint, nil, nil
+	}
+
+	// if the volume is already in a read drive, wait for that one
+	pool := []*Drive{loaded}
+	if loaded == nil {
+		pool = nil
+		for _, drv := range srv.drives["read"] {
+			if drv.lib.name == libname {
+				pool = append(pool, drv)
+			}
+		}
+	}
+
+	if len(pool) == 0 {
+		return "", nil, errors.Errorf("no read drives in library %s", libname)
+	}
+
+	drv, err := acquireDrive(ctx, pool, readPolicy)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := srv.Mount(drv, vol); err != nil {
+		drv.Release()
+		return "", nil, err
+	}
+
+	mountpoint, err := drv.Mountpoint()
+	if err != nil {
+		drv.Release()
+		return "", nil, err
+	}
+
+	return mountpoint, drv, nil
+}
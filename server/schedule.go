@@ -0,0 +1,269 @@
+package server
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// heldDriveKey is the context key of a read drive acquired by the caller.
+var heldDriveKey = &contextKey{"held drive"}
+
+// withDrive returns a context in which volumes in the library of drv are read
+// using drv, which the caller must have acquired. The drive is not released
+// between reads.
+func withDrive(ctx context.Context, drv *Drive) context.Context {
+	return context.WithValue(ctx, heldDriveKey, drv)
+}
+
+// heldDrive returns the read drive held by the caller in the library
+// identified by libname, if any.
+func heldDrive(ctx context.Context, libname string) *Drive {
+	drv, ok := ctx.Value(heldDriveKey).(*Drive)
+	if !ok || drv.lib.name != libname {
+		return nil
+	}
+
+	return drv
+}
+
+// batch is the recall jobs reading from the same volume, ordered by the
+// position of their first chunk on the volume, such that the volume is loaded
+// once and read sequentially.
+type batch struct {
+	serial  string
+	library string
+	jobs    []*RecallJob
+
+	// requested is the time of the oldest request in the batch.
+	requested time.Time
+}
+
+// add inserts job in order of position.
+func (b *batch) add(job *RecallJob) {
+	i := sort.Search(len(b.jobs), func(i int) bool {
+		return b.jobs[i].position.After(job.position)
+	})
+
+	b.jobs = append(b.jobs, nil)
+	copy(b.jobs[i+1:], b.jobs[i:])
+	b.jobs[i] = job
+
+	if b.requested.IsZero() || job.Requested.Before(b.requested) {
+		b.requested = job.Requested
+	}
+}
+
+type byRequested []*batch
+
+func (s byRequested) Len() int           { return len(s) }
+func (s byRequested) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byRequested) Less(i, j int) bool { return s[i].requested.Before(s[j].requested) }
+
+// locate sets the volume and position of the first chunk of ar on job and
+// the library holding the volume. Copies on volumes that can be read are
+// preferred. Jobs without a volume, e.g. of archives in a pack not yet
+// written, need no read drive.
+func (srv *Server) locate(ctx context.Context, ar *Archive, job *RecallJob) {
+	job.Volume, job.library = "", ""
+
+	var first *ChunkInfo
+	for _, info := range ar.chunks {
+		if info.Parity || info.Volume == "" {
+			continue
+		}
+
+		if first == nil {
+			first = info
+		} else if info.ID != first.ID {
+			break
+		}
+
+		_, libname, err := srv.inv.Lookup(ctx, info.Volume)
+		if err != nil {
+			log.Printf("recall: failed to locate volume %s: %v", info.Volume, err)
+			continue
+		}
+
+		job.Volume = info.Volume
+		job.position = info.Written
+		job.library = libname
+
+		return
+	}
+
+	if first != nil {
+		job.Volume = first.Volume
+		job.position = first.Written
+	}
+}
+
+// checkOffsite parks job in the offsite state if some of ar is only on
+// offsite volumes. Otherwise the job is located and set queued, and true is
+// returned.
+func (srv *Server) checkOffsite(ctx context.Context, ar *Archive, job *RecallJob) bool {
+	offsite, err := srv.offsite(ctx, ar)
+	if err != nil {
+		// staging reports the error
+		log.Printf("recall: %v", err)
+	}
+
+	job.Offsite = offsite
+
+	if len(offsite) > 0 {
+		job.State = RecallOffsite
+		return false
+	}
+
+	job.State = RecallQueued
+	srv.locate(ctx, ar, job)
+
+	return true
+}
+
+// schedule groups the queued jobs by volume and assigns each group to a free
+// read drive in the library holding the volume, oldest request first. A drive
+// already holding the volume is preferred. Jobs for a volume that is being
+// read join the running batch. Jobs for volumes mounted in a write drive or
+// without a known library are read right away.
+func (r *recaller) schedule() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	batches := make(map[string]*batch)
+	for _, job := range r.queue {
+		if b, ok := r.active[job.Volume]; ok {
+			b.add(job)
+			continue
+		}
+
+		b, ok := batches[job.Volume]
+		if !ok {
+			b = &batch{serial: job.Volume, library: job.library}
+			batches[job.Volume] = b
+		}
+
+		b.add(job)
+	}
+
+	pending := make([]*batch, 0, len(batches))
+	for _, b := range batches {
+		pending = append(pending, b)
+	}
+
+	sort.Sort(byRequested(pending))
+
+	r.queue = nil
+
+	for _, b := range pending {
+		if b.library == "" || r.srv.writing(b.serial) {
+			r.active[b.serial] = b
+			go r.read(b, nil)
+			continue
+		}
+
+		drv := r.freeDrive(b)
+		if drv == nil {
+			r.queue = append(r.queue, b.jobs...)
+			continue
+		}
+
+		r.busy[drv] = true
+		r.active[b.serial] = b
+		go r.read(b, drv)
+	}
+}
+
+// freeDrive returns a read drive in the library of b that is not assigned to
+// another batch, preferring the drive holding the volume of b. The caller
+// must hold r.mu.
+func (r *recaller) freeDrive(b *batch) *Drive {
+	var free *Drive
+	for _, drv := range r.srv.drives["read"] {
+		if drv.lib.name != b.library || r.busy[drv] {
+			continue
+		}
+
+		if drv.holds(b.serial) {
+			return drv
+		}
+
+		if free == nil {
+			free = drv
+		}
+	}
+
+	return free
+}
+
+// read stages the jobs of b in order using drv, if given.
+func (r *recaller) read(b *batch, drv *Drive) {
+	ctx := context.Background()
+
+	if drv != nil {
+		log.Printf("recall: reading volume %s in %v", b.serial, drv)
+
+		// wait for retrievals not going through the scheduler
+		if _, err := acquireDrive(ctx, []*Drive{drv}, readPolicy); err != nil {
+			log.Printf("recall: %v", err)
+		} else {
+			defer drv.Release()
+			ctx = withDrive(ctx, drv)
+		}
+	}
+
+	for {
+		job := r.pop(b, drv)
+		if job == nil {
+			return
+		}
+
+		r.stage(ctx, job)
+	}
+}
+
+// pop dequeues the next job of b. If there are none, the batch is done and
+// its drive is free for another.
+func (r *recaller) pop(b *batch, drv *Drive) *RecallJob {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(b.jobs) == 0 {
+		delete(r.active, b.serial)
+		if drv != nil {
+			delete(r.busy, drv)
+		}
+
+		// the queue may be waiting for a drive
+		r.notify()
+
+		return nil
+	}
+
+	job := b.jobs[0]
+	b.jobs = b.jobs[1:]
+
+	return job
+}
+
+// dequeue removes a queued job from the queue or the batch it joined. The
+// caller must hold r.mu.
+func (r *recaller) dequeue(job *RecallJob) {
+	for i, queued := range r.queue {
+		if queued == job {
+			r.queue = append(r.queue[:i], r.queue[i+1:]...)
+			return
+		}
+	}
+
+	if b, ok := r.active[job.Volume]; ok {
+		for i, queued := range b.jobs {
+			if queued == job {
+				b.jobs = append(b.jobs[:i], b.jobs[i+1:]...)
+				return
+			}
+		}
+	}
+}
@@ -2,11 +2,15 @@ package server
 
 import (
 	"bufio"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
+	"sort"
+	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -42,6 +46,10 @@ func (lib *Library) String() string {
 type driveGroup struct {
 	drives []*Drive
 	in     chan *stream.Chunk
+
+	// erasure is the erasure code applied to streams written to the group,
+	// if any.
+	erasure *stream.Erasure
 }
 
 type Server struct {
@@ -54,6 +62,24 @@ type Server struct {
 
 	groups map[string]*driveGroup
 
+	// keyring holds the master keys if encryption is enabled.
+	keyring *stream.Keyring
+
+	// packer packs small archives if enabled.
+	packer *packer
+
+	// recall stages archives to the recall cache if enabled.
+	recall *recaller
+
+	// spool holds archives awaiting migration to tape if enabled.
+	spool *spooler
+
+	// export moves volumes queued for export to the mail slots.
+	export *exporter
+
+	// reclaimMu serializes reclamation runs.
+	reclaimMu sync.Mutex
+
 	mocked bool
 }
 
@@ -88,6 +114,62 @@ func New(cfg *config.Config, debug bool, audit bool, mock bool) (*Server, error)
 
 	srv.cfg = cfg
 
+	if cfg.Stream.Checksum != "" {
+		if err := stream.ValidChecksum(cfg.Stream.Checksum); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, size := range []int{cfg.Stream.ChunkSize, cfg.Debug.Mocking.ChunkSize} {
+		if size != 0 {
+			if err := validChunkSize(size); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var reclaimInterval time.Duration
+	if cfg.Reclaim.Interval != "" {
+		var err error
+		reclaimInterval, err = time.ParseDuration(cfg.Reclaim.Interval)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid reclaim interval")
+		}
+	}
+
+	if cfg.Pack.Threshold > 0 {
+		size := cfg.Pack.Size
+		if size == 0 {
+			size = defaultChunkSize()
+		}
+
+		if err := validChunkSize(size); err != nil {
+			return nil, errors.Wrap(err, "invalid pack size")
+		}
+
+		if cfg.Pack.Threshold > size {
+			return nil, errors.Errorf("pack threshold %d exceeds pack size %d", cfg.Pack.Threshold, size)
+		}
+
+		age := DefaultPackAge
+		if cfg.Pack.Age != "" {
+			var err error
+			if age, err = time.ParseDuration(cfg.Pack.Age); err != nil {
+				return nil, errors.Wrap(err, "invalid pack age")
+			}
+		}
+
+		srv.packer = newPacker(srv, cfg.Pack.Threshold, size, age)
+	}
+
+	if cfg.Encryption.KeyFile != "" {
+		var err error
+		srv.keyring, err = stream.LoadKeyring(cfg.Encryption.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load master keys")
+		}
+	}
+
 	if mock {
 		srv.mocked = true
 	}
@@ -113,9 +195,12 @@ func New(cfg *config.Config, debug bool, audit bool, mock bool) (*Server, error)
 		lib := NewLibrary(libCfg.Name)
 
 		for _, chgrCfg := range libCfg.Changers {
-			if mock {
+			switch {
+			case mock:
 				lib.chgr = changer.Mock(chgrCfg.Path)
-			} else {
+			case chgrCfg.Type == "sgio":
+				lib.chgr = changer.Native(chgrCfg.Path)
+			default:
 				lib.chgr = changer.New(chgrCfg.Path)
 			}
 		}
@@ -153,27 +238,89 @@ func New(cfg *config.Config, debug bool, audit bool, mock bool) (*Server, error)
 
 	}
 
+	for _, grpCfg := range cfg.Groups {
+		grp, ok := srv.groups[grpCfg.Name]
+		if !ok {
+			return nil, errors.Errorf("no drives in write group %s", grpCfg.Name)
+		}
+
+		if grpCfg.Data == 0 && grpCfg.Parity == 0 {
+			continue
+		}
+
+		ec := &stream.Erasure{Data: grpCfg.Data, Parity: grpCfg.Parity}
+		if ec.Data < 1 || ec.Parity < 1 || ec.Shards() > len(grp.drives) {
+			return nil, errors.Errorf("invalid erasure code for write group %s: %d+%d chunks on %d drives",
+				grpCfg.Name, ec.Data, ec.Parity, len(grp.drives),
+			)
+		}
+
+		grp.erasure = ec
+	}
+
+	if copies := cfg.Stream.Copies; copies > len(srv.writeLibraries()) {
+		return nil, errors.Errorf("cannot store %d copies in %d libraries", copies, len(srv.writeLibraries()))
+	}
+
 	for _, drv := range srv.drives["write"] {
 		_, err := srv.GetScratch(drv)
 		if err != nil {
 			panic(err)
 		}
 
-		mountpoint, err := drv.Mountpoint()
+		drv.writer, err = drv.newWriter()
 		if err != nil {
 			panic(err)
 		}
 
-		var agg chan *stream.Chunk
-		if drv.group != nil {
-			agg = drv.group.in
+		go drv.Run()
+	}
+
+	// read drives are loaded on demand
+	for _, drv := range srv.drives["read"] {
+		go drv.Run()
+	}
+
+	if cfg.Spool.Dir != "" {
+		// spooled archives would be kept on disk unencrypted
+		if srv.keyring != nil {
+			return nil, errors.New("spooling is not supported with encryption enabled")
 		}
 
-		drv.writer = stream.NewWriter(mountpoint, drv.in, agg, drv.path)
+		if cfg.Spool.Size <= 0 {
+			return nil, errors.New("spool size must be positive")
+		}
 
-		go drv.Run()
+		interval := DefaultSpoolInterval
+		if cfg.Spool.Interval != "" {
+			if interval, err = time.ParseDuration(cfg.Spool.Interval); err != nil {
+				return nil, errors.Wrap(err, "invalid spool interval")
+			}
+		}
+
+		srv.spool, err = newSpooler(srv, cfg.Spool.Dir, int64(cfg.Spool.Size), interval)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to initialize spool")
+		}
+	}
+
+	if cfg.Recall.Cache != "" {
+		if cfg.Recall.Size <= 0 {
+			return nil, errors.New("recall cache size must be positive")
+		}
+
+		srv.recall, err = newRecaller(srv, cfg.Recall.Cache, int64(cfg.Recall.Size))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to initialize recall cache")
+		}
 	}
 
+	if reclaimInterval > 0 && srv.reclaimThreshold() > 0 {
+		go srv.reclaimLoop(reclaimInterval)
+	}
+
+	srv.export = newExporter(srv, DefaultExportInterval)
+
 	return srv, nil
 }
 
@@ -189,28 +336,33 @@ func (e ErrShortWrite) Error() string {
 	return fmt.Sprintf("short write: wrote %d bytes", e.Written)
 }
 
-// Store grabs an io.Reader, reads until EOF and stores the data on a tape.
-func (srv *Server) Store(ctx context.Context, archive string, rd io.Reader) error {
-	log.Printf("store archive: %s", archive)
-
-	pol := policy.DefaultPolicy
-
-	// see if there is a write policy associated
-	if newpol, ok := policy.Unwrap(ctx); ok {
-		pol = newpol
-	}
-
+// openStream creates a new stream for the given copy of archive and attaches
+// it to one or more write drives as dictated by pol. If libname is not empty,
+// only drives in that library are used.
+func (srv *Server) openStream(ctx context.Context, archive string, pol *policy.Policy, copy int, libname string) (*stream.Stream, error) {
 	// create new stream
-	stream := stream.New(archive, pol)
+	s := stream.New(archive, pol)
+	s.SetCopy(copy)
 
 	// create a context with setup timeout if necessary
-	var cancel context.CancelFunc
 	if pol.ExclusiveTimeout != 0 {
+		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, pol.ExclusiveTimeout)
+		defer cancel()
 	}
 
 	if pol.Parallel() {
 		if grp, ok := srv.groups[pol.WriteGroup]; ok {
+			// the drives of a group share a single channel, so the chunks
+			// cannot be kept in one library if the group spans several
+			if libname != "" {
+				for _, drv := range grp.drives {
+					if drv.lib.name != libname {
+						return nil, errors.Errorf("write group %s spans libraries", pol.WriteGroup)
+					}
+				}
+			}
+
 			ch := make(chan struct{})
 
 			// send use request to all drives
@@ -231,41 +383,221 @@ func (srv *Server) Store(ctx context.Context, archive string, rd io.Reader) erro
 			for range grp.drives {
 				select {
 				case <-ctx.Done():
-					return ctx.Err()
+					return nil, ctx.Err()
 				case <-ch:
 				}
 			}
 
-			stream.SetOut(grp.in)
+			s.SetOut(grp.in)
 
-			stream.OnClose(func() {
+			s.OnClose(func() {
 				for _, drv := range grp.drives {
 					drv.Release()
 				}
 			})
 
+			// each chunk of an erasure coded stripe goes to its own drive
+			if grp.erasure != nil {
+				outs := make([]chan *stream.Chunk, len(grp.drives))
+				for i, drv := range grp.drives {
+					outs[i] = drv.in
+				}
+
+				if err := s.SetErasure(grp.erasure, outs); err != nil {
+					s.Abort()
+					return nil, err
+				}
+			}
+
 		} else {
-			return errors.New("no such write group")
+			return nil, errors.New("no such write group")
 		}
 	} else {
 		// Get a drive
-		drv, err := acquireDrive(ctx, srv.drives["write"], pol)
+		drv, err := acquireDrive(ctx, srv.writeDrives(libname), pol)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		stream.SetOut(drv.in)
+		s.SetOut(drv.in)
 
-		stream.OnClose(func() {
+		s.OnClose(func() {
 			drv.Release()
 		})
 	}
 
-	if cancel != nil {
-		cancel()
+	return s, nil
+}
+
+// Store grabs an io.Reader, reads until EOF and stores the data on a tape. If
+// any expected digests are given, they are checked against the digests of the
+// data read and the archive is dropped if they differ.
+//
+// Unless the write policy disables acknowledged writes, Store returns when all
+// chunks are durable on tape. Otherwise it returns as soon as the chunks have
+// been handed to the drives and the receipt may not list all volumes. If the
+// policy asks for multiple copies, each copy is stored in a separate library.
+// If the policy asks for spooling, Store returns when the data is durable in
+// the disk spool; it is migrated to tape later.
+func (srv *Server) Store(ctx context.Context, archive string, rd io.Reader, expect ...Digest) (*Receipt, error) {
+	log.Printf("store archive: %s", archive)
+
+	pol := srv.writePolicy(ctx)
+
+	libnames, err := srv.copyLibraries(pol)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validChunkSize(pol.ChunkSize); err != nil {
+		return nil, err
+	}
+
+	if err := stream.ValidChecksum(pol.Checksum); err != nil {
+		return nil, err
+	}
+
+	// chunks are deduplicated by content, which erasure coded stripes do not
+	// allow for
+	if pol.Dedup && srv.erasure(pol) != nil {
+		return nil, errors.Errorf("write group %s is erasure coded and cannot deduplicate", pol.WriteGroup)
+	}
+
+	// without a spool, archives go to tape directly
+	if pol.Spool && srv.spool != nil {
+		return srv.storeSpooled(ctx, archive, pol, rd, expect...)
 	}
 
-	reader := bufio.NewReader(rd)
+	// small archives are packed with others in a single chunk
+	if srv.packable(pol) {
+		p, ok, r, err := srv.packHead(rd)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			return srv.storePacked(ctx, archive, p, pol, expect...)
+		}
+
+		rd = r
+	}
+
+	return srv.store(ctx, archive, pol, libnames, rd, expect...)
+}
+
+// store writes the data read from rd to tape as the chunks of archive.
+func (srv *Server) store(ctx context.Context, archive string, pol *policy.Policy, libnames []string, rd io.Reader, expect ...Digest) (*Receipt, error) {
+	var err error
+
+	// all copies are encrypted with the same data key
+	var key []byte
+	var wk *stream.WrappedKey
+	if srv.keyring != nil {
+		if key, wk, err = srv.keyring.NewDataKey(); err != nil {
+			return nil, err
+		}
+
+		if err := srv.setKey(archive, wk); err != nil {
+			return nil, err
+		}
+	}
+
+	digest, chunks, err := srv.writeCopies(ctx, archive, pol, libnames, key, wk, 0, rd)
+	if err != nil {
+		// drop what was written, including the references to deduplicated
+		// chunks
+		if err := srv.resetChunks(ctx, archive); err != nil {
+			log.Printf("failed to drop chunks of archive %s: %v", archive, err)
+		}
+
+		return nil, err
+	}
+
+	if err := digest.verify(expect); err != nil {
+		// what went to tape is not what the client sent
+		if err := srv.Delete(ctx, archive); err != nil {
+			log.Printf("failed to delete archive %s: %v", archive, err)
+		}
+
+		return nil, err
+	}
+
+	sha256 := hex.EncodeToString(digest.sum(DigestSHA256))
+
+	if err := srv.complete(archive, digest, pol, srv.erasure(pol)); err != nil {
+		return nil, err
+	}
+
+	vols, err := srv.volumes(ctx, archive)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Receipt{
+		Archive: archive,
+		Size:    digest.size,
+		Chunks:  chunks,
+		Volumes: vols,
+		MD5:     hex.EncodeToString(digest.sum(DigestMD5)),
+		SHA256:  sha256,
+	}, nil
+}
+
+// copyLibraries returns the libraries each copy of the chunks written with pol
+// is stored in. An empty library name means any library.
+func (srv *Server) copyLibraries(pol *policy.Policy) ([]string, error) {
+	if pol.Copies <= 1 {
+		return []string{""}, nil
+	}
+
+	libnames := srv.writeLibraries()
+	if len(libnames) < pol.Copies {
+		return nil, errors.Errorf("cannot store %d copies in %d libraries", pol.Copies, len(libnames))
+	}
+
+	return libnames[:pol.Copies], nil
+}
+
+// writeCopies reads rd until EOF and writes the data to archive, one stream
+// per copy. If wk is non-nil, the chunks are encrypted with key. Chunk ids
+// start after base. It returns the digests of the data and the number of
+// chunks written.
+func (srv *Server) writeCopies(ctx context.Context, archive string, pol *policy.Policy, libnames []string, key []byte, wk *stream.WrappedKey, base int, rd io.Reader) (*digester, int, error) {
+	// each copy is written by a separate stream to a separate library
+	streams := make([]*stream.Stream, 0, len(libnames))
+
+	// release the drives of the opened streams if the copies are not all
+	// written; aborting a closed stream does nothing
+	defer func() {
+		for _, s := range streams {
+			s.Abort()
+		}
+	}()
+
+	for i, libname := range libnames {
+		s, err := srv.openStream(ctx, archive, pol, i, libname)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		streams = append(streams, s)
+
+		s.SetBase(base)
+
+		if wk != nil {
+			if err := s.SetKey(wk.ID, key); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		if pol.Dedup {
+			s.SetDedup(srv.dedup)
+		}
+	}
+
+	digest := newDigester()
+
+	reader := bufio.NewReader(io.TeeReader(rd, digest))
 
 	buf := make([]byte, 1024)
 
@@ -283,27 +615,151 @@ func (srv *Server) Store(ctx context.Context, archive string, rd io.Reader) erro
 				break
 			}
 
-			return err
+			return nil, 0, err
 		}
 
 		if err != nil && err != io.EOF {
-			return err
+			return nil, 0, err
 		}
 
-		if written, err = stream.Write(ctx, buf, false); err != nil {
-			return ErrShortWrite{total + written}
+		for _, s := range streams {
+			if written, err = s.Write(ctx, buf, false); err != nil {
+				return nil, 0, ErrShortWrite{total + written}
+			}
 		}
 
 		total += len(buf)
 	}
 
-	if err := stream.Close(ctx); err != nil {
+	// the archive is only acknowledged when all copies are
+	var err error
+	for _, s := range streams {
+		if cerr := s.Close(ctx); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return digest, streams[0].Chunks(), nil
+}
+
+// writePolicy returns a copy of the write policy associated with ctx (or the
+// default policy) with the server configuration applied.
+func (srv *Server) writePolicy(ctx context.Context) *policy.Policy {
+	pol := *policy.DefaultPolicy
+
+	// see if there is a write policy associated
+	if newpol, ok := policy.Unwrap(ctx); ok {
+		pol = *newpol
+	}
+
+	if pol.Checksum == "" {
+		pol.Checksum = srv.cfg.Stream.Checksum
+	}
+
+	if pol.Checksum == "" {
+		pol.Checksum = stream.DefaultChecksum
+	}
+
+	if pol.Copies == 0 {
+		pol.Copies = srv.cfg.Stream.Copies
+	}
+
+	if pol.Copies == 0 {
+		pol.Copies = 1
+	}
+
+	if pol.ChunkSize == 0 {
+		pol.ChunkSize = srv.cfg.Stream.ChunkSize
+		if srv.mocked && srv.cfg.Debug.Mocking.ChunkSize != 0 {
+			pol.ChunkSize = srv.cfg.Debug.Mocking.ChunkSize
+		}
+	}
+
+	if pol.ChunkSize == 0 {
+		pol.ChunkSize = defaultChunkSize()
+	}
+
+	return &pol
+}
+
+// maxChunkSize is the largest chunk size that fits on a volume. A chunk the
+// size of a volume would not fit with its encryption overhead.
+const maxChunkSize = stream.VolumeSize / 2
+
+// validChunkSize returns an error if chunks cannot be size bytes or would not
+// fit on a volume.
+func validChunkSize(size int) error {
+	if err := stream.ValidChunkSize(size); err != nil {
 		return err
 	}
 
+	if size > maxChunkSize {
+		return errors.Errorf("chunk size %d does not fit on a volume; must be at most %d bytes", size, maxChunkSize)
+	}
+
 	return nil
 }
 
+// defaultChunkSize returns the chunk size used if neither the server
+// configuration nor the write policy sets one.
+func defaultChunkSize() int {
+	if stream.DefaultChunkSize > maxChunkSize {
+		return maxChunkSize
+	}
+
+	return stream.DefaultChunkSize
+}
+
+// erasure returns the erasure code applied to streams written with pol, if
+// any.
+func (srv *Server) erasure(pol *policy.Policy) *stream.Erasure {
+	if !pol.Parallel() {
+		return nil
+	}
+
+	if grp, ok := srv.groups[pol.WriteGroup]; ok {
+		return grp.erasure
+	}
+
+	return nil
+}
+
+// writeDrives returns the write drives in the library identified by libname,
+// or all write drives if libname is empty.
+func (srv *Server) writeDrives(libname string) []*Drive {
+	if libname == "" {
+		return srv.drives["write"]
+	}
+
+	var drvs []*Drive
+	for _, drv := range srv.drives["write"] {
+		if drv.lib.name == libname {
+			drvs = append(drvs, drv)
+		}
+	}
+
+	return drvs
+}
+
+// writeLibraries returns the names of the libraries with write drives in
+// lexical order.
+func (srv *Server) writeLibraries() []string {
+	var libnames []string
+	for libname := range srv.libraries {
+		if len(srv.writeDrives(libname)) > 0 {
+			libnames = append(libnames, libname)
+		}
+	}
+
+	sort.Strings(libnames)
+
+	return libnames
+}
+
 func (srv *Server) Shutdown() {
 	fmt.Println()
 	log.Print("shutting down...")
@@ -314,16 +770,79 @@ func (srv *Server) Shutdown() {
 }
 
 func (srv *Server) Create(ctx context.Context, archive string) error {
+	if err := validName(archive); err != nil {
+		return err
+	}
+
+	return srv.create(archive)
+}
+
+// validName returns an error if archive is not a valid archive name.
+func validName(archive string) error {
+	// names starting with a dot are reserved for internal buckets
+	if archive == "" || archive[0] == '.' {
+		return errors.Errorf("invalid archive name: %q", archive)
+	}
+
+	return nil
+}
+
+// create creates the archive bucket identified by name.
+func (srv *Server) create(name string) error {
 	return srv.chunkdb.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucket([]byte(archive))
+		bkt, err := tx.CreateBucket([]byte(name))
 		if err != nil {
 			return errors.Wrap(err, "create archive failed")
 		}
 
-		return nil
+		return putArchive(bkt, NewArchive(name))
 	})
 }
 
+// Replace reads rd until EOF and stores the data as archive, replacing any
+// existing archive of that name. The data is stored under an internal name and
+// only takes the place of the existing archive once committed, so the existing
+// archive is kept if the store fails.
+func (srv *Server) Replace(ctx context.Context, archive string, rd io.Reader, expect ...Digest) (*Receipt, error) {
+	log.Printf("replace archive: %s", archive)
+
+	if err := validName(archive); err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := ".replace-" + id + "-" + archive
+
+	if err := srv.create(tmp); err != nil {
+		return nil, err
+	}
+
+	// the archive cannot be renamed while chunks are being written to it
+	pol := srv.writePolicy(ctx)
+	pol.AcknowledgedWrite = true
+
+	receipt, err := srv.Store(policy.Wrap(ctx, pol), tmp, rd, expect...)
+	if err == nil {
+		err = srv.rename(ctx, tmp, archive)
+	}
+
+	if err != nil {
+		if err := srv.Delete(ctx, tmp); err != nil && errors.Cause(err) != ErrNoSuchArchive {
+			log.Printf("failed to delete archive %s: %v", tmp, err)
+		}
+
+		return nil, err
+	}
+
+	receipt.Archive = archive
+
+	return receipt, nil
+}
+
 func acquireDrive(ctx context.Context, pool []*Drive, pol *policy.Policy) (*Drive, error) {
 	ch := make(chan *Drive)
 
@@ -362,6 +881,9 @@ func (srv *Server) Audit(ctx context.Context, libname string) (*mtx.StatusInfo,
 	if lib, ok := srv.libraries[libname]; ok {
 		var status *mtx.StatusInfo
 		err := lib.chgr.Use(func(tx *changer.Tx) error {
+			// volumes may have been moved by an operator
+			tx.Refresh()
+
 			var err error
 			status, err = tx.Status()
 			if err != nil {
@@ -372,6 +894,10 @@ func (srv *Server) Audit(ctx context.Context, libname string) (*mtx.StatusInfo,
 				return err
 			}
 
+			for _, warning := range status.Warnings {
+				log.Printf("audit: library %s: %s", libname, warning)
+			}
+
 			// we do all auditing inside the changer lock
 			err = srv.inv.Audit(context.Background(), status, libname)
 			return err
@@ -387,9 +913,18 @@ func (srv *Server) Audit(ctx context.Context, libname string) (*mtx.StatusInfo,
 	return nil, errors.Errorf("unknown library: %s", libname)
 }
 
-// Scratch returns a new scratch volume.
+// GetScratch loads a new scratch volume into drv. The volume being written,
+// if any, is full.
 func (srv *Server) GetScratch(drv *Drive) (*mtx.Volume, error) {
-	if drv.vol != nil {
+	if cur := drv.Volume(); cur != nil {
+		if err := srv.inv.SetState(context.Background(), cur.Serial, inventory.StateFull); err != nil {
+			return nil, err
+		}
+
+		if err := srv.unmount(drv); err != nil {
+			return nil, err
+		}
+
 		if err := srv.Unload(drv); err != nil {
 			return nil, err
 		}
@@ -404,40 +939,101 @@ func (srv *Server) GetScratch(drv *Drive) (*mtx.Volume, error) {
 		return nil, err
 	}
 
+	if err := srv.mount(drv, true); err != nil {
+		return nil, err
+	}
+
+	return vol, nil
+}
+
+// Mount loads vol into drv and mounts it, unmounting and unloading any other
+// volume in the drive first. Mount is a no-op if vol is already in the drive.
+func (srv *Server) Mount(drv *Drive, vol *mtx.Volume) error {
+	if cur := drv.Volume(); cur != nil {
+		if cur.Serial == vol.Serial {
+			return nil
+		}
+
+		if err := srv.unmount(drv); err != nil {
+			return err
+		}
+
+		if err := srv.Unload(drv); err != nil {
+			return err
+		}
+	}
+
+	if err := srv.Load(drv, vol); err != nil {
+		return err
+	}
+
+	return srv.mount(drv, false)
+}
+
+// mount mounts the volume loaded in drv, formatting it first if requested.
+func (srv *Server) mount(drv *Drive, format bool) error {
 	mountpoint, err := drv.Mountpoint()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	log.Printf("volume %v mounted at %s", drv.Volume(), mountpoint)
+
+	// when mocking, formatting a (possibly reused) volume amounts to clearing
+	// the directory
+	if srv.mocked && format {
+		if err := os.RemoveAll(mountpoint); err != nil {
+			return err
+		}
 	}
 
-	log.Printf("new volume %v mounted at %s", vol, mountpoint)
 	if err := os.MkdirAll(mountpoint, os.ModePerm); err != nil {
-		return nil, err
+		return err
 	}
 
-	if !srv.mocked {
-		h, err := ltfs.New(drv.path)
-		if err != nil {
-			return nil, err
-		}
+	if srv.mocked {
+		return nil
+	}
 
+	h, err := ltfs.New(drv.path)
+	if err != nil {
+		return err
+	}
+
+	if format {
 		if err := h.Format(); err != nil {
-			return nil, err
+			return err
 		}
+	}
 
-		if err := h.Mount(mountpoint, ltfs.SyncModeUnmount); err != nil {
-			return nil, err
-		}
+	if err := h.Mount(mountpoint, ltfs.SyncModeUnmount); err != nil {
+		return err
 	}
 
-	return vol, nil
+	drv.ltfs = h
+
+	return nil
+}
+
+// unmount unmounts the volume in drv, if mounted.
+func (srv *Server) unmount(drv *Drive) error {
+	if drv.ltfs == nil {
+		return nil
+	}
+
+	if err := drv.ltfs.Unmount(); err != nil {
+		return err
+	}
+
+	drv.ltfs = nil
+
+	return nil
 }
 
 func (srv *Server) Load(dev *Drive, vol *mtx.Volume) error {
-	if dev.vol != nil {
-		if dev.vol.Serial == vol.Serial {
-			log.Printf("load: drive %s already loaded with %s", dev, vol)
-			return nil
-		}
+	if dev.holds(vol.Serial) {
+		log.Printf("load: drive %s already loaded with %s", dev, vol)
+		return nil
 	}
 
 	err := dev.lib.chgr.Use(func(tx *changer.Tx) error {
@@ -460,22 +1056,23 @@ func (srv *Server) Load(dev *Drive, vol *mtx.Volume) error {
 		return err
 	}
 
-	dev.vol = vol
+	dev.setVolume(vol)
 
 	return nil
 }
 
 func (srv *Server) Unload(dev *Drive) error {
-	if dev.vol == nil {
+	vol := dev.Volume()
+	if vol == nil {
 		log.Printf("unload: drive %s already unloaded", dev)
 		return nil
 	}
 
 	err := dev.lib.chgr.Use(func(tx *changer.Tx) error {
-		log.Printf("unloading drive %s, returning volume %s to slot %d", dev, dev.vol, dev.vol.Home)
+		log.Printf("unloading drive %s, returning volume %s to slot %d", dev, vol, vol.Home)
 
 		var err error
-		err = tx.Unload(dev.vol.Home, dev.slot)
+		err = tx.Unload(vol.Home, dev.slot)
 		if err != nil {
 			if exitError, ok := err.(*exec.ExitError); ok {
 				return errors.New(string(exitError.Stderr))
@@ -487,5 +1084,12 @@ func (srv *Server) Unload(dev *Drive) error {
 		return nil
 	})
 
-	return err
+	if err != nil {
+		return err
+	}
+
+	dev.setVolume(nil)
+
+	// all chunks may have been deleted while the volume was loaded
+	return srv.scratchIfEmpty(context.Background(), vol.Serial)
 }
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/config"
+	"github.com/bh107/tapr/inventory"
+	"github.com/bh107/tapr/stream"
+	"github.com/bh107/tapr/stream/policy"
+)
+
+// custodian is the content stored by the tests.
+var custodian = bytes.Repeat([]byte("the tape custodian "), 1024)
+
+// newTestServer returns a mocked server with a single library holding one
+// write drive and one read drive. The configuration may be adjusted by
+// configure before the server is created.
+func newTestServer(t *testing.T, configure ...func(cfg *config.Config, dir string)) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema, err := ioutil.ReadFile(filepath.Join("..", "init.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbname := filepath.Join(dir, "inventory.db")
+
+	db, err := sql.Open("sqlite3", dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+
+	cfg := &config.Config{
+		Chunkstore: config.DBConfig{Type: "boltdb", Path: filepath.Join(dir, "chunks.db")},
+		Inventory:  config.DBConfig{Type: "sqlite3", Path: dbname},
+		LTFS:       config.LTFSConfig{Root: filepath.Join(dir, "ltfs")},
+		Libraries: []config.LibraryConfig{
+			{
+				Name:     "primary",
+				Changers: []config.ChangerConfig{{Path: "/dev/sg0"}},
+				Drives: []config.DriveConfig{
+					{Path: "/dev/st0", Type: "write", Slot: 0},
+					{Path: "/dev/st1", Type: "read", Slot: 1},
+				},
+			},
+		},
+	}
+
+	for _, fn := range configure {
+		fn(cfg, dir)
+	}
+
+	srv, err := New(cfg, false, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return srv, func() {
+		srv.Shutdown()
+		os.RemoveAll(dir)
+	}
+}
+
+// encrypted configures the server to encrypt chunks with a master key.
+func encrypted(t *testing.T) func(cfg *config.Config, dir string) {
+	return func(cfg *config.Config, dir string) {
+		master := bytes.Repeat([]byte{0x42}, stream.KeySize)
+		keyfile := filepath.Join(dir, "master.keys")
+
+		if err := ioutil.WriteFile(keyfile, []byte(hex.EncodeToString(master)+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg.Encryption.KeyFile = keyfile
+	}
+}
+
+// store creates archive and stores data in it with pol.
+func store(t *testing.T, srv *Server, archive string, pol *policy.Policy, data []byte) (*Receipt, error) {
+	ctx := policy.Wrap(context.Background(), pol)
+
+	if err := srv.Create(ctx, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	return srv.Store(ctx, archive, bytes.NewReader(data))
+}
+
+// retrieve returns the contents of archive.
+func retrieve(t *testing.T, srv *Server, archive string) []byte {
+	var buf bytes.Buffer
+	if err := srv.Retrieve(context.Background(), archive, &buf); err != nil {
+		t.Fatalf("retrieve %s: %v", archive, err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestReplace(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+
+	pol := policy.NewDefaultPolicy()
+	ctx := policy.Wrap(context.Background(), pol)
+
+	if _, err := srv.Replace(ctx, "archive", bytes.NewReader(custodian)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the data is stored, but fails verification
+	bad := Digest{Alg: DigestMD5, Sum: make([]byte, 16)}
+
+	if _, err := srv.Replace(ctx, "archive", bytes.NewReader([]byte("lost")), bad); err == nil {
+		t.Fatal("expected replace to fail")
+	}
+
+	if got := retrieve(t, srv, "archive"); !bytes.Equal(got, custodian) {
+		t.Fatalf("expected the archive to be kept, got %d bytes", len(got))
+	}
+
+	data := []byte("the new tape custodian")
+
+	receipt, err := srv.Replace(ctx, "archive", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if receipt.Archive != "archive" {
+		t.Fatalf("expected receipt for archive, got %s", receipt.Archive)
+	}
+
+	if got := retrieve(t, srv, "archive"); !bytes.Equal(got, data) {
+		t.Fatalf("expected %q, got %q", data, got)
+	}
+
+	archives, err := srv.List(context.Background(), "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(archives) != 1 || archives[0].Name != "archive" {
+		t.Fatalf("expected only archive to be listed, got %d archives", len(archives))
+	}
+}
+
+func TestReplaceEncrypted(t *testing.T) {
+	srv, cleanup := newTestServer(t, encrypted(t))
+	defer cleanup()
+
+	pol := policy.NewDefaultPolicy()
+	ctx := policy.Wrap(context.Background(), pol)
+
+	if _, err := store(t, srv, "archive", pol, custodian); err != nil {
+		t.Fatal(err)
+	}
+
+	// the chunks are stored under a temporary name and renamed
+	if _, err := srv.Replace(ctx, "archive", bytes.NewReader(custodian[:1024])); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := retrieve(t, srv, "archive"); !bytes.Equal(got, custodian[:1024]) {
+		t.Fatalf("retrieved %d bytes, expected %d", len(got), 1024)
+	}
+}
+
+func TestStoreLibraryFull(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	pol := policy.NewDefaultPolicy()
+
+	scratch, err := srv.inv.InState(ctx, "primary", inventory.StateScratch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the volume in the write drive is left
+	for _, info := range scratch {
+		if err := srv.inv.SetState(ctx, info.Serial, inventory.StateRetired); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errc := make(chan error)
+	go func() {
+		// the mock volumes hold a MiB
+		for i := 0; i < 100; i++ {
+			if _, err := store(t, srv, fmt.Sprintf("archive-%d", i), pol, custodian); err != nil {
+				errc <- err
+				return
+			}
+		}
+
+		errc <- nil
+	}()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("expected store to fail once the volume is full")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for store to fail")
+	}
+
+	// the drive has no volume to write to
+	if _, err := store(t, srv, "late", pol, custodian); err == nil {
+		t.Fatal("expected store to fail without a volume")
+	}
+}
+
+func TestStoreMultipleVolumes(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+
+	pol := policy.NewDefaultPolicy()
+
+	// the mock volumes hold a MiB
+	data := bytes.Repeat(custodian, 128)
+
+	receipt, err := store(t, srv, "archive", pol, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(receipt.Volumes) < 3 {
+		t.Fatalf("expected %d bytes to span at least 3 volumes, got %v", len(data), receipt.Volumes)
+	}
+
+	if got := retrieve(t, srv, "archive"); !bytes.Equal(got, data) {
+		t.Fatalf("retrieved %d bytes, expected %d", len(got), len(data))
+	}
+
+	// chunks must fit on a volume
+	pol.ChunkSize = stream.VolumeSize
+
+	if _, err := store(t, srv, "too-large", pol, custodian); err == nil {
+		t.Fatal("expected chunks the size of a volume to be rejected")
+	}
+}
@@ -0,0 +1,662 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/stream/policy"
+)
+
+// DefaultSpoolInterval is the time between attempts to migrate spooled
+// archives that failed to migrate if not configured.
+const DefaultSpoolInterval = time.Minute
+
+// ErrSpoolFull is returned when spooling an archive that does not fit in the
+// spool.
+var ErrSpoolFull = errors.New("spool is full")
+
+// spoolBucket is the top-level bucket holding the spooled archives awaiting
+// migration to tape, keyed by archive name.
+var spoolBucket = []byte(".spool")
+
+// SpoolEntry is an archive in the disk spool.
+type SpoolEntry struct {
+	Archive string `json:"archive"`
+	Size    int64  `json:"size"`
+
+	// Created is the creation time of the spooled archive; the entry of an
+	// archive that has since been replaced is stale.
+	Created time.Time `json:"created"`
+
+	// Policy is the write policy the archive is migrated with.
+	Policy *policy.Policy `json:"policy"`
+
+	Spooled  time.Time `json:"spooled"`
+	Attempts int       `json:"attempts,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// spooler lands archives in the spool directory and migrates them to tape.
+// The data of a spooled archive is a single file in the spool directory; it
+// is removed once the archive is durable on tape. Archives are refused once
+// size bytes are awaiting migration.
+type spooler struct {
+	srv      *Server
+	dir      string
+	size     int64
+	interval time.Duration
+	wake     chan struct{}
+
+	// migrating is the archive being migrated; deleting it waits for done.
+	// used is the number of bytes spooled.
+	mu        sync.Mutex
+	done      *sync.Cond
+	migrating string
+	used      int64
+}
+
+// newSpooler creates a spooler using dir and starts migrating the archives
+// spooled by a previous run.
+func newSpooler(srv *Server, dir string, size int64, interval time.Duration) (*spooler, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	sp := &spooler{
+		srv:      srv,
+		dir:      dir,
+		size:     size,
+		interval: interval,
+		wake:     make(chan struct{}, 1),
+	}
+
+	sp.done = sync.NewCond(&sp.mu)
+
+	entries, err := sp.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	keep := make(map[string]bool)
+	for _, entry := range entries {
+		keep[path.Base(sp.path(entry.Archive))] = true
+		sp.used += entry.Size
+	}
+
+	// remove partially spooled archives and archives migrated just before
+	// a crash
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fi := range files {
+		if !keep[fi.Name()] {
+			if err := os.Remove(path.Join(dir, fi.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(entries) > 0 {
+		log.Printf("spool: %d archives awaiting migration", len(entries))
+	}
+
+	go sp.run()
+
+	sp.notify()
+
+	return sp, nil
+}
+
+// path returns the path of the spooled data of archive.
+func (sp *spooler) path(archive string) string {
+	sum := sha256.Sum256([]byte(archive))
+	return path.Join(sp.dir, hex.EncodeToString(sum[:]))
+}
+
+func (sp *spooler) notify() {
+	select {
+	case sp.wake <- struct{}{}:
+	default:
+	}
+}
+
+type bySpooled []*SpoolEntry
+
+func (s bySpooled) Len() int           { return len(s) }
+func (s bySpooled) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySpooled) Less(i, j int) bool { return s[i].Spooled.Before(s[j].Spooled) }
+
+// entries returns the spooled archives, oldest first.
+func (sp *spooler) entries() ([]*SpoolEntry, error) {
+	var entries []*SpoolEntry
+
+	err := sp.srv.chunkdb.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(spoolBucket)
+		if bkt == nil {
+			return nil
+		}
+
+		return bkt.ForEach(func(k, v []byte) error {
+			entry := new(SpoolEntry)
+			if err := json.Unmarshal(v, entry); err != nil {
+				return err
+			}
+
+			entries = append(entries, entry)
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(bySpooled(entries))
+
+	return entries, nil
+}
+
+// put persists entry.
+func (sp *spooler) put(tx *bolt.Tx, entry *SpoolEntry) error {
+	bkt, err := tx.CreateBucketIfNotExists(spoolBucket)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return bkt.Put([]byte(entry.Archive), buf)
+}
+
+// get returns the persisted entry of archive, if any.
+func (sp *spooler) get(tx *bolt.Tx, archive string) (*SpoolEntry, error) {
+	bkt := tx.Bucket(spoolBucket)
+	if bkt == nil {
+		return nil, nil
+	}
+
+	v := bkt.Get([]byte(archive))
+	if v == nil {
+		return nil, nil
+	}
+
+	entry := new(SpoolEntry)
+	if err := json.Unmarshal(v, entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// run migrates the spooled archives, oldest first, whenever an archive is
+// spooled and every interval to retry failed migrations.
+func (sp *spooler) run() {
+	tick := time.NewTicker(sp.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-sp.wake:
+		case <-tick.C:
+		}
+
+		entries, err := sp.entries()
+		if err != nil {
+			log.Printf("spool: %v", err)
+			continue
+		}
+
+		for _, entry := range entries {
+			if err := sp.migrate(entry); err != nil {
+				log.Printf("spool: failed to migrate %s: %v", entry.Archive, err)
+				sp.fail(entry, err)
+			}
+		}
+	}
+}
+
+// fail records a failed migration attempt.
+func (sp *spooler) fail(entry *SpoolEntry, cause error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	uerr := sp.srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		// the archive may have been deleted meanwhile
+		stored, err := sp.get(tx, entry.Archive)
+		if err != nil || stored == nil {
+			return err
+		}
+
+		stored.Attempts++
+		stored.Error = cause.Error()
+
+		return sp.put(tx, stored)
+	})
+
+	if uerr != nil {
+		log.Printf("spool: %v", uerr)
+	}
+}
+
+// migrate writes the spooled archive to tape through the regular write path
+// and removes it from the spool once durable.
+func (sp *spooler) migrate(entry *SpoolEntry) error {
+	srv := sp.srv
+
+	sp.mu.Lock()
+
+	// deleted or replaced since listed
+	var stored *SpoolEntry
+	err := srv.chunkdb.View(func(tx *bolt.Tx) error {
+		var err error
+		stored, err = sp.get(tx, entry.Archive)
+		return err
+	})
+
+	if err != nil || stored == nil || !stored.Created.Equal(entry.Created) {
+		sp.mu.Unlock()
+		return err
+	}
+
+	sp.migrating = entry.Archive
+	sp.mu.Unlock()
+
+	defer func() {
+		sp.mu.Lock()
+		sp.migrating = ""
+		sp.done.Broadcast()
+		sp.mu.Unlock()
+	}()
+
+	log.Printf("spool: migrating %s", entry.Archive)
+
+	f, err := os.Open(sp.path(entry.Archive))
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	// drop the chunks of an earlier attempt
+	if err := srv.resetChunks(context.Background(), entry.Archive); err != nil {
+		return err
+	}
+
+	// the spool is only cleared once the archive is durable on tape
+	pol := *entry.Policy
+	pol.AcknowledgedWrite = true
+	pol.Spool = false
+
+	libnames, err := srv.copyLibraries(&pol)
+	if err != nil {
+		return err
+	}
+
+	ctx := policy.Wrap(context.Background(), &pol)
+
+	receipt, err := srv.store(ctx, entry.Archive, &pol, libnames, f)
+	if err != nil {
+		return err
+	}
+
+	if receipt.Size != entry.Size {
+		return errors.Errorf("migrated %d bytes, expected %d", receipt.Size, entry.Size)
+	}
+
+	err = srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(entry.Archive))
+		if bkt == nil {
+			return ErrNoSuchArchive
+		}
+
+		ar, err := getArchive(bkt)
+		if err != nil {
+			return err
+		}
+
+		ar.Spooled = false
+		if err := putArchive(bkt, ar); err != nil {
+			return err
+		}
+
+		return tx.Bucket(spoolBucket).Delete([]byte(entry.Archive))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("spool: migrated %s to %v", entry.Archive, receipt.Volumes)
+
+	sp.release(entry.Size)
+
+	return os.Remove(sp.path(entry.Archive))
+}
+
+// open returns the spooled data of ar. It returns false if the archive has
+// been migrated.
+func (sp *spooler) open(ar *Archive) (*os.File, bool, error) {
+	f, err := os.Open(sp.path(ar.Name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	return f, true, nil
+}
+
+// forget removes archive from the spool, waiting for a migration of the
+// archive in progress to finish.
+func (sp *spooler) forget(archive string) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	for sp.migrating == archive {
+		sp.done.Wait()
+	}
+
+	var entry *SpoolEntry
+	err := sp.srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		var err error
+		if entry, err = sp.get(tx, archive); err != nil || entry == nil {
+			return err
+		}
+
+		return tx.Bucket(spoolBucket).Delete([]byte(archive))
+	})
+
+	if err != nil || entry == nil {
+		return err
+	}
+
+	sp.used -= entry.Size
+
+	if err := os.Remove(sp.path(archive)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// reserve accounts n bytes as spooled if they fit in the spool.
+func (sp *spooler) reserve(n int64) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if sp.used+n > sp.size {
+		return errors.Wrapf(ErrSpoolFull, "%d of %d bytes in use", sp.used, sp.size)
+	}
+
+	sp.used += n
+
+	return nil
+}
+
+// release accounts n bytes as no longer spooled.
+func (sp *spooler) release(n int64) {
+	sp.mu.Lock()
+	sp.used -= n
+	sp.mu.Unlock()
+}
+
+// free returns the number of bytes left in the spool.
+func (sp *spooler) free() int64 {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	return sp.size - sp.used
+}
+
+// rename runs fn to move the archive identified by from to the name to in the
+// same transaction as its spool entry, waiting for a migration of the archive
+// in progress to finish.
+func (sp *spooler) rename(from string, to string, fn func(tx *bolt.Tx) error) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	for sp.migrating == from {
+		sp.done.Wait()
+	}
+
+	var moved bool
+	err := sp.srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+
+		entry, err := sp.get(tx, from)
+		if err != nil || entry == nil {
+			return err
+		}
+
+		if err := tx.Bucket(spoolBucket).Delete([]byte(from)); err != nil {
+			return err
+		}
+
+		entry.Archive = to
+		if err := sp.put(tx, entry); err != nil {
+			return err
+		}
+
+		if err := os.Rename(sp.path(from), sp.path(to)); err != nil {
+			return err
+		}
+
+		moved = true
+
+		return nil
+	})
+
+	// the transaction failed to commit after the data was moved
+	if err != nil && moved {
+		if err := os.Rename(sp.path(to), sp.path(from)); err != nil {
+			log.Printf("spool: %v", err)
+		}
+	}
+
+	return err
+}
+
+// storeSpooled reads rd until EOF into the spool and returns once the data is
+// durable on disk. The archive is migrated to tape in the background.
+func (srv *Server) storeSpooled(ctx context.Context, archive string, pol *policy.Policy, rd io.Reader, expect ...Digest) (*Receipt, error) {
+	sp := srv.spool
+
+	// the policy must be usable for the migration
+	if pol.Parallel() {
+		if _, ok := srv.groups[pol.WriteGroup]; !ok {
+			return nil, errors.New("no such write group")
+		}
+	}
+
+	f, err := ioutil.TempFile(sp.dir, ".spooling-")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(f.Name())
+
+	digest := newDigester()
+
+	// read no more than what fits, reserving the space once the size is known
+	free := sp.free()
+
+	n, err := io.Copy(io.MultiWriter(f, digest), io.LimitReader(rd, free+1))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if n > free {
+		f.Close()
+		return nil, errors.Wrapf(ErrSpoolFull, "archive %s does not fit in the spool", archive)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := digest.verify(expect); err != nil {
+		if err := srv.Delete(ctx, archive); err != nil {
+			log.Printf("failed to delete archive %s: %v", archive, err)
+		}
+
+		return nil, err
+	}
+
+	if err := sp.reserve(n); err != nil {
+		return nil, err
+	}
+
+	spooled := false
+	defer func() {
+		if !spooled {
+			sp.release(n)
+		}
+	}()
+
+	if err := os.Rename(f.Name(), sp.path(archive)); err != nil {
+		return nil, err
+	}
+
+	if err := syncDir(sp.dir); err != nil {
+		return nil, err
+	}
+
+	if err := srv.complete(archive, digest, pol, nil); err != nil {
+		return nil, err
+	}
+
+	err = srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(archive))
+		if bkt == nil {
+			return ErrNoSuchArchive
+		}
+
+		ar, err := getArchive(bkt)
+		if err != nil {
+			return err
+		}
+
+		ar.Spooled = true
+		if err := putArchive(bkt, ar); err != nil {
+			return err
+		}
+
+		return sp.put(tx, &SpoolEntry{
+			Archive: archive,
+			Size:    digest.size,
+			Created: ar.Created,
+			Policy:  pol,
+			Spooled: time.Now().UTC(),
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	spooled = true
+
+	log.Printf("spooled archive: %s", archive)
+
+	sp.notify()
+
+	return &Receipt{
+		Archive: archive,
+		Size:    digest.size,
+		Volumes: make([]string, 0),
+		MD5:     hex.EncodeToString(digest.sum(DigestMD5)),
+		SHA256:  hex.EncodeToString(digest.sum(DigestSHA256)),
+		Spooled: true,
+	}, nil
+}
+
+// retrieveSpooled writes the spooled data of ar to w. It returns false if the
+// archive has been migrated meanwhile.
+func (srv *Server) retrieveSpooled(ar *Archive, w io.Writer) (bool, error) {
+	f, ok, err := srv.spool.open(ar)
+	if !ok || err != nil {
+		return ok, err
+	}
+
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+
+	return true, err
+}
+
+// resetChunks removes all chunk records of archive and marks the chunk files
+// dead.
+func (srv *Server) resetChunks(ctx context.Context, archive string) error {
+	var dead []*ChunkInfo
+
+	err := srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(archive))
+		if bkt == nil {
+			return ErrNoSuchArchive
+		}
+
+		var err error
+		if dead, err = dropRange(tx, bkt, 0, int(^uint(0)>>1)); err != nil {
+			return err
+		}
+
+		if parity := bkt.Bucket(parityBucket); parity != nil {
+			stale, err := dropRange(tx, parity, 0, int(^uint(0)>>1))
+			if err != nil {
+				return err
+			}
+
+			dead = append(dead, stale...)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return srv.killChunks(ctx, dead)
+}
+
+// syncDir flushes the directory entries of dir to disk.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return f.Sync()
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/config"
+	"github.com/bh107/tapr/stream/policy"
+)
+
+func TestSpoolRecovery(t *testing.T) {
+	var cfg *config.Config
+	var dir string
+
+	srv, _ := newTestServer(t, func(c *config.Config, d string) {
+		c.Spool = config.SpoolConfig{
+			Dir:      filepath.Join(d, "spool"),
+			Size:     len(custodian) + len(custodian)/2,
+			Interval: "1h",
+		}
+
+		cfg, dir = c, d
+	})
+
+	defer os.RemoveAll(dir)
+
+	pol := policy.NewDefaultPolicy()
+	pol.Spool = true
+
+	// keep the archives in the spool by failing their migration
+	mountpoint, err := srv.drives["write"][0].Mountpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(mountpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	receipt, err := store(t, srv, "first", pol, custodian)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !receipt.Spooled {
+		t.Fatal("expected archive to be spooled")
+	}
+
+	if _, err := store(t, srv, "second", pol, custodian); errors.Cause(err) != ErrSpoolFull {
+		t.Fatalf("expected %v, got %v", ErrSpoolFull, err)
+	}
+
+	if got := retrieve(t, srv, "first"); !bytes.Equal(got, custodian) {
+		t.Fatalf("retrieved %d bytes from the spool, expected %d", len(got), len(custodian))
+	}
+
+	srv.Shutdown()
+
+	if err := os.MkdirAll(mountpoint, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	// the spooled archive is migrated on restart
+	srv, err = New(cfg, false, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer srv.Shutdown()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		ar, err := srv.Stat(context.Background(), "first")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !ar.Spooled {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the spooled archive to be migrated")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := retrieve(t, srv, "first"); !bytes.Equal(got, custodian) {
+		t.Fatalf("retrieved %d bytes from tape, expected %d", len(got), len(custodian))
+	}
+
+	// the space of the migrated archive is available again
+	if err := srv.Delete(context.Background(), "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store(t, srv, "second", pol, custodian); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,524 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/stream"
+	"github.com/bh107/tapr/util"
+)
+
+var ErrNoSuchUpload = errors.New("no such upload")
+
+// MaxParts is the largest part number of a multipart upload.
+const MaxParts = 10000
+
+// partShift places the chunks of each part of a multipart upload in a
+// separate range of chunk ids, such that parts may be written in any order and
+// the chunks of the completed archive are ordered by part.
+const partShift = 32
+
+// partsBucket is the bucket nested in the archive bucket of a multipart
+// upload holding the part records.
+var partsBucket = []byte("parts")
+
+// PartInfo describes an uploaded part of a multipart upload.
+type PartInfo struct {
+	Number int   `json:"number"`
+	Size   int64 `json:"size"`
+
+	// ETag is the hex encoded MD5 digest of the part.
+	ETag   string `json:"etag"`
+	SHA256 string `json:"sha256"`
+
+	Chunks  int       `json:"chunks"`
+	Written time.Time `json:"written"`
+}
+
+// partRange returns the range of chunk ids of part n.
+func partRange(n int) (int, int) {
+	return n << partShift, (n + 1) << partShift
+}
+
+// InitiateUpload starts a multipart upload to archive and returns the id of
+// the upload. The write policy of the context applies to all parts. The
+// archive is not visible until the upload is completed.
+func (srv *Server) InitiateUpload(ctx context.Context, archive string) (string, error) {
+	log.Printf("initiate upload: %s", archive)
+
+	pol := srv.writePolicy(ctx)
+
+	if _, err := srv.copyLibraries(pol); err != nil {
+		return "", err
+	}
+
+	if err := validChunkSize(pol.ChunkSize); err != nil {
+		return "", err
+	}
+
+	if err := stream.ValidChecksum(pol.Checksum); err != nil {
+		return "", err
+	}
+
+	// stripes of different parts would collide
+	if srv.erasure(pol) != nil {
+		return "", errors.Errorf("write group %s is erasure coded and cannot take multipart uploads", pol.WriteGroup)
+	}
+
+	if err := validName(archive); err != nil {
+		return "", err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	// the parts are kept apart from any existing archive until completed
+	name := uploadArchive(archive, id)
+
+	if err := srv.create(name); err != nil {
+		return "", err
+	}
+
+	// all parts are encrypted with the same data key
+	if srv.keyring != nil {
+		_, wk, err := srv.keyring.NewDataKey()
+		if err != nil {
+			return "", err
+		}
+
+		if err := srv.setKey(name, wk); err != nil {
+			return "", err
+		}
+	}
+
+	err = srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(name))
+		if bkt == nil {
+			return ErrNoSuchArchive
+		}
+
+		ar, err := getArchive(bkt)
+		if err != nil {
+			return err
+		}
+
+		ar.Upload = id
+		ar.Policy = pol
+
+		return putArchive(bkt, ar)
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// newID returns a random identifier.
+func newID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// uploadArchive returns the name of the archive holding the parts of the
+// multipart upload identified by id until it is completed as archive.
+func uploadArchive(archive string, id string) string {
+	return ".upload-" + id + "-" + archive
+}
+
+// upload returns the archive holding the parts of the multipart upload to
+// archive identified by id.
+func (srv *Server) upload(archive string, id string) (*Archive, error) {
+	ar, err := srv.stat(uploadArchive(archive, id))
+	if err != nil {
+		if err == ErrNoSuchArchive {
+			return nil, ErrNoSuchUpload
+		}
+
+		return nil, err
+	}
+
+	if ar.Upload == "" || ar.Upload != id {
+		return nil, ErrNoSuchUpload
+	}
+
+	return ar, nil
+}
+
+// StorePart reads rd until EOF and stores the data as part n of the multipart
+// upload identified by id. A part that was uploaded before is replaced. If any
+// expected digests are given and differ from the digests of the data, the part
+// is dropped.
+func (srv *Server) StorePart(ctx context.Context, archive string, id string, n int, rd io.Reader, expect ...Digest) (*PartInfo, error) {
+	log.Printf("store part %d of upload %s: %s", n, id, archive)
+
+	if n < 1 || n > MaxParts {
+		return nil, errors.Errorf("invalid part number %d; must be between 1 and %d", n, MaxParts)
+	}
+
+	ar, err := srv.upload(archive, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	if ar.Key != nil {
+		if srv.keyring == nil {
+			return nil, errors.Errorf("archive %s is encrypted, but no keys are configured", archive)
+		}
+
+		if key, err = srv.keyring.Unwrap(ar.Key); err != nil {
+			return nil, errors.Wrapf(err, "failed to unwrap key of archive %s", archive)
+		}
+	}
+
+	libnames, err := srv.copyLibraries(ar.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := srv.dropPart(ctx, ar.Name, n); err != nil {
+		return nil, err
+	}
+
+	base, _ := partRange(n)
+
+	digest, chunks, err := srv.writeCopies(ctx, ar.Name, ar.Policy, libnames, key, ar.Key, base, rd)
+	if err == nil {
+		err = digest.verify(expect)
+	}
+
+	if err != nil {
+		// the part is retried from the start
+		if err := srv.dropPart(ctx, ar.Name, n); err != nil {
+			log.Printf("failed to drop part %d of %s: %v", n, archive, err)
+		}
+
+		return nil, err
+	}
+
+	part := &PartInfo{
+		Number:  n,
+		Size:    digest.size,
+		ETag:    hex.EncodeToString(digest.sum(DigestMD5)),
+		SHA256:  hex.EncodeToString(digest.sum(DigestSHA256)),
+		Chunks:  chunks,
+		Written: time.Now().UTC(),
+	}
+
+	err = srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(ar.Name))
+		if bkt == nil {
+			return ErrNoSuchUpload
+		}
+
+		parts, err := bkt.CreateBucketIfNotExists(partsBucket)
+		if err != nil {
+			return err
+		}
+
+		buf, err := json.Marshal(part)
+		if err != nil {
+			return err
+		}
+
+		return parts.Put(util.Itob(n), buf)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return part, nil
+}
+
+// ListParts returns the uploaded parts of the multipart upload identified by
+// id ordered by part number.
+func (srv *Server) ListParts(ctx context.Context, archive string, id string) ([]*PartInfo, error) {
+	ar, err := srv.upload(archive, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []*PartInfo
+
+	err = srv.chunkdb.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(ar.Name))
+		if bkt == nil {
+			return ErrNoSuchUpload
+		}
+
+		var err error
+		parts, err = readParts(bkt)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parts, nil
+}
+
+// readParts returns the part records in the archive bucket.
+func readParts(bkt *bolt.Bucket) ([]*PartInfo, error) {
+	parts := make([]*PartInfo, 0)
+
+	if bkt = bkt.Bucket(partsBucket); bkt == nil {
+		return parts, nil
+	}
+
+	err := bkt.ForEach(func(k, v []byte) error {
+		part := new(PartInfo)
+		if err := json.Unmarshal(v, part); err != nil {
+			return err
+		}
+
+		parts = append(parts, part)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parts, nil
+}
+
+// CompleteUpload completes the multipart upload identified by id, making the
+// archive visible in place of any existing archive of the same name. If parts
+// is non-empty, it lists the parts making up the archive in ascending order;
+// other uploaded parts are dropped. The ETag of listed parts, if given, must
+// match the uploaded part. The ETag of the archive is computed from the part
+// ETags as done by S3.
+func (srv *Server) CompleteUpload(ctx context.Context, archive string, id string, parts []*PartInfo) (*Receipt, error) {
+	log.Printf("complete upload %s: %s", id, archive)
+
+	ar, err := srv.upload(archive, id)
+	if err != nil {
+		return nil, err
+	}
+
+	uploaded, err := srv.ListParts(ctx, archive, id)
+	if err != nil {
+		return nil, err
+	}
+
+	byNumber := make(map[int]*PartInfo)
+	for _, part := range uploaded {
+		byNumber[part.Number] = part
+	}
+
+	if len(parts) == 0 {
+		parts = uploaded
+	}
+
+	if len(parts) == 0 {
+		return nil, errors.Errorf("upload %s has no parts", id)
+	}
+
+	keep := make(map[int]bool)
+	for i, part := range parts {
+		if i > 0 && part.Number <= parts[i-1].Number {
+			return nil, errors.Errorf("parts must be listed in ascending order")
+		}
+
+		stored, ok := byNumber[part.Number]
+		if !ok {
+			return nil, errors.Errorf("part %d of upload %s: no such part", part.Number, id)
+		}
+
+		if part.ETag != "" && part.ETag != stored.ETag {
+			return nil, errors.Errorf("part %d of upload %s: etag mismatch", part.Number, id)
+		}
+
+		parts[i] = stored
+		keep[part.Number] = true
+	}
+
+	for _, part := range uploaded {
+		if !keep[part.Number] {
+			if err := srv.dropPart(ctx, ar.Name, part.Number); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var size int64
+	var chunks int
+	sums := md5.New()
+	for _, part := range parts {
+		size += part.Size
+		chunks += part.Chunks
+
+		sum, err := hex.DecodeString(part.ETag)
+		if err != nil {
+			return nil, err
+		}
+
+		sums.Write(sum)
+	}
+
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(sums.Sum(nil)), len(parts))
+
+	err = srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(ar.Name))
+		if bkt == nil {
+			return ErrNoSuchUpload
+		}
+
+		ar, err := getArchive(bkt)
+		if err != nil {
+			return err
+		}
+
+		ar.Upload = ""
+		ar.Size = size
+		ar.ETag = etag
+		ar.Parts = len(parts)
+
+		if err := bkt.DeleteBucket(partsBucket); err != nil {
+			return err
+		}
+
+		return putArchive(bkt, ar)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := srv.rename(ctx, ar.Name, archive); err != nil {
+		return nil, err
+	}
+
+	vols, err := srv.volumes(ctx, archive)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Receipt{
+		Archive: archive,
+		Size:    size,
+		Chunks:  chunks,
+		Volumes: vols,
+		ETag:    etag,
+	}, nil
+}
+
+// AbortUpload aborts the multipart upload identified by id. The chunks of all
+// uploaded parts are marked dead.
+func (srv *Server) AbortUpload(ctx context.Context, archive string, id string) error {
+	log.Printf("abort upload %s: %s", id, archive)
+
+	ar, err := srv.upload(archive, id)
+	if err != nil {
+		return err
+	}
+
+	return srv.Delete(ctx, ar.Name)
+}
+
+// dropPart removes the chunks and record of part n of the multipart upload to
+// archive and marks the chunk files dead.
+func (srv *Server) dropPart(ctx context.Context, archive string, n int) error {
+	first, last := partRange(n)
+
+	var dead []*ChunkInfo
+
+	err := srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(archive))
+		if bkt == nil {
+			return ErrNoSuchUpload
+		}
+
+		var err error
+		if dead, err = dropRange(tx, bkt, first, last); err != nil {
+			return err
+		}
+
+		if parts := bkt.Bucket(partsBucket); parts != nil {
+			return parts.Delete(util.Itob(n))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return srv.killChunks(ctx, dead)
+}
+
+// dropRange removes the records of the chunks in bkt with ids in [first,
+// last) and returns the stored chunks that are now dead.
+func dropRange(tx *bolt.Tx, bkt *bolt.Bucket, first int, last int) ([]*ChunkInfo, error) {
+	var keys [][]byte
+	var cnks []*ChunkInfo
+
+	c := bkt.Cursor()
+	for k, v := c.Seek(util.Itob(first)); k != nil; k, v = c.Next() {
+		// skip nested buckets
+		if v == nil {
+			continue
+		}
+
+		info := new(ChunkInfo)
+		if err := json.Unmarshal(v, info); err != nil {
+			return nil, err
+		}
+
+		if info.ID >= last {
+			break
+		}
+
+		keys = append(keys, k)
+		cnks = append(cnks, info)
+	}
+
+	var dead []*ChunkInfo
+	for i, info := range cnks {
+		if info.ref() {
+			stored, err := unref(tx, info)
+			if err != nil {
+				return nil, err
+			}
+
+			if stored != nil {
+				dead = append(dead, stored)
+			}
+		} else {
+			if err := killChunk(tx, info); err != nil {
+				return nil, err
+			}
+
+			dead = append(dead, info)
+		}
+
+		if err := bkt.Delete(keys[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return dead, nil
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/stream/policy"
+)
+
+// storeParts stores each of parts as the part numbered by its key.
+func storeParts(t *testing.T, srv *Server, archive string, id string, parts map[int]string) {
+	for n, data := range parts {
+		if _, err := srv.StorePart(context.Background(), archive, id, n, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+
+	pol := policy.NewDefaultPolicy()
+	ctx := policy.Wrap(context.Background(), pol)
+
+	if _, err := store(t, srv, "object", pol, custodian); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := srv.InitiateUpload(ctx, "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// parts may come in any order and be uploaded again
+	storeParts(t, srv, "object", id, map[int]string{2: "world", 3: "!"})
+	storeParts(t, srv, "object", id, map[int]string{1: "hello "})
+	storeParts(t, srv, "object", id, map[int]string{1: "hello, "})
+
+	// the existing archive is only replaced once the upload completes
+	if got := retrieve(t, srv, "object"); !bytes.Equal(got, custodian) {
+		t.Fatalf("expected the archive to be kept during the upload, got %q", got)
+	}
+
+	parts, err := srv.ListParts(ctx, "object", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parts) != 3 || parts[0].Number != 1 || parts[0].Size != 7 {
+		t.Fatalf("expected 3 parts with the first replaced, got %+v", parts)
+	}
+
+	receipt, err := srv.CompleteUpload(ctx, "object", id, []*PartInfo{{Number: 1}, {Number: 2, ETag: parts[1].ETag}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if receipt.Size != 12 || !strings.HasSuffix(receipt.ETag, "-2") {
+		t.Fatalf("expected 12 bytes in 2 parts, got %d bytes with etag %s", receipt.Size, receipt.ETag)
+	}
+
+	if got := retrieve(t, srv, "object"); string(got) != "hello, world" {
+		t.Fatalf("expected %q, got %q", "hello, world", got)
+	}
+
+	ar, err := srv.Stat(ctx, "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the chunks of each part are in the range of the part, in order
+	if len(ar.chunks) != 2 {
+		t.Fatalf("expected a chunk per listed part, got %d", len(ar.chunks))
+	}
+
+	for i, info := range ar.chunks {
+		first, last := partRange(i + 1)
+		if info.ID < first || info.ID >= last {
+			t.Fatalf("chunk %d of part %d is outside [%d, %d)", info.ID, i+1, first, last)
+		}
+	}
+
+	if _, err := srv.ListParts(ctx, "object", id); err != ErrNoSuchUpload {
+		t.Fatalf("expected %v once completed, got %v", ErrNoSuchUpload, err)
+	}
+}
+
+func TestMultipartUploadEncrypted(t *testing.T) {
+	srv, cleanup := newTestServer(t, encrypted(t))
+	defer cleanup()
+
+	pol := policy.NewDefaultPolicy()
+	ctx := policy.Wrap(context.Background(), pol)
+
+	if err := srv.Create(ctx, "object"); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := srv.InitiateUpload(ctx, "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storeParts(t, srv, "object", id, map[int]string{1: "hello, ", 2: "world"})
+
+	if _, err := srv.CompleteUpload(ctx, "object", id, []*PartInfo{{Number: 1}, {Number: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := retrieve(t, srv, "object"); string(got) != "hello, world" {
+		t.Fatalf("expected %q, got %q", "hello, world", got)
+	}
+}
+
+func TestAbortUpload(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+
+	pol := policy.NewDefaultPolicy()
+	ctx := policy.Wrap(context.Background(), pol)
+
+	if _, err := store(t, srv, "object", pol, custodian); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := srv.InitiateUpload(ctx, "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storeParts(t, srv, "object", id, map[int]string{1: "lost"})
+
+	if err := srv.AbortUpload(ctx, "object", id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := srv.StorePart(ctx, "object", id, 2, strings.NewReader("late")); err != ErrNoSuchUpload {
+		t.Fatalf("expected %v, got %v", ErrNoSuchUpload, err)
+	}
+
+	if got := retrieve(t, srv, "object"); !bytes.Equal(got, custodian) {
+		t.Fatalf("expected the archive to be kept, got %q", got)
+	}
+
+	archives, err := srv.List(ctx, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(archives) != 1 {
+		t.Fatalf("expected a single archive, got %d", len(archives))
+	}
+}
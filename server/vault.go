@@ -0,0 +1,891 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/changer"
+	"github.com/bh107/tapr/inventory"
+	"github.com/bh107/tapr/util/mtx"
+)
+
+// DefaultExportInterval is the time between attempts to move volumes queued
+// for export to the mail slots.
+const DefaultExportInterval = time.Minute
+
+var (
+	ErrNoSuchLibrary = errors.New("no such library")
+	ErrNotInLibrary  = errors.New("volume is not in the library")
+	ErrVolumeBusy    = errors.New("volume is being written")
+
+	ErrInvalidState   = errors.New("invalid volume state")
+	ErrVolumeNotEmpty = errors.New("volume holds live chunks")
+)
+
+// exportsBucket is the top-level bucket holding the volumes queued for export,
+// keyed by serial.
+var exportsBucket = []byte(".exports")
+
+// ExportState is the state of an export job.
+type ExportState string
+
+const (
+	ExportQueued   ExportState = "queued"
+	ExportExported ExportState = "exported"
+)
+
+// ExportJob moves a volume to a mail slot to be taken offsite. Jobs are queued
+// while the mail slots are full.
+type ExportJob struct {
+	Serial  string      `json:"serial"`
+	Library string      `json:"library"`
+	State   ExportState `json:"state"`
+
+	// Slot is the mail slot the volume was moved to.
+	Slot int `json:"slot,omitempty"`
+
+	// Error is the reason the last attempt to export the volume failed.
+	Error string `json:"error,omitempty"`
+
+	Requested time.Time `json:"requested"`
+}
+
+// Import describes a volume found in a mail slot by an import.
+type Import struct {
+	Serial string `json:"serial"`
+	From   int    `json:"from"`
+
+	// Slot is the storage slot the volume was moved to and Status its
+	// state in the inventory.
+	Slot   int             `json:"slot,omitempty"`
+	Status inventory.State `json:"status,omitempty"`
+
+	// Skipped is the reason the volume was left in the mail slot.
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// library returns the library identified by libname.
+func (srv *Server) library(libname string) (*Library, error) {
+	lib, ok := srv.libraries[libname]
+	if !ok {
+		return nil, errors.Wrap(ErrNoSuchLibrary, libname)
+	}
+
+	return lib, nil
+}
+
+// freeSlots returns the empty storage slots of the library that are not the
+// home of a volume in a drive.
+func (srv *Server) freeSlots(lib *Library, status *mtx.StatusInfo) []int {
+	homes := make(map[int]bool)
+	for _, slot := range status.Drives {
+		if slot.Vol != nil {
+			homes[slot.Vol.Home] = true
+		}
+	}
+
+	for _, drvs := range lib.drives {
+		for _, drv := range drvs {
+			if vol := drv.Volume(); vol != nil {
+				homes[vol.Home] = true
+			}
+		}
+	}
+
+	var free []int
+	for _, slot := range status.Slots {
+		if slot.Type == mtx.StorageSlot && slot.Vol == nil && !homes[slot.Num] {
+			free = append(free, slot.Num)
+		}
+	}
+
+	return free
+}
+
+// departing returns the in-transit volumes of the library still waiting in a
+// mail slot, keyed by slot. Volumes that have been taken out are recorded as
+// offsite.
+func (srv *Server) departing(ctx context.Context, libname string, status *mtx.StatusInfo) (map[int]string, error) {
+	vols, err := srv.inv.Departing(ctx, libname)
+	if err != nil {
+		return nil, err
+	}
+
+	present := make(map[int]string)
+	for _, slot := range status.Slots {
+		if slot.Type == mtx.MailSlot && slot.Vol != nil {
+			present[slot.Num] = slot.Vol.Serial
+		}
+	}
+
+	departing := make(map[int]string)
+	for _, info := range vols {
+		if present[info.Slot] == info.Serial {
+			departing[info.Slot] = info.Serial
+			continue
+		}
+
+		log.Printf("vault: volume %s has been taken out of mail slot %d", info.Serial, info.Slot)
+
+		if err := srv.inv.Departed(ctx, info.Serial); err != nil {
+			return nil, err
+		}
+	}
+
+	return departing, nil
+}
+
+// Import moves the volumes in the mail slots of the library to free storage
+// slots and registers them in the inventory. Unknown volumes are registered as
+// scratch volumes, or as readonly volumes if foreign is set. Volumes exported
+// earlier and not yet taken out are left in place. Recalls waiting for an
+// imported volume are queued.
+func (srv *Server) Import(ctx context.Context, libname string, foreign bool) ([]*Import, error) {
+	lib, err := srv.library(libname)
+	if err != nil {
+		return nil, err
+	}
+
+	imports := make([]*Import, 0)
+
+	err = lib.chgr.Use(func(tx *changer.Tx) error {
+		// the volumes were put in the mail slots by an operator
+		tx.Refresh()
+
+		status, err := tx.Status()
+		if err != nil {
+			return err
+		}
+
+		departing, err := srv.departing(ctx, libname, status)
+		if err != nil {
+			return err
+		}
+
+		free := srv.freeSlots(lib, status)
+
+		for _, slot := range status.Slots {
+			if slot.Type != mtx.MailSlot || slot.Vol == nil {
+				continue
+			}
+
+			imp := &Import{Serial: slot.Vol.Serial, From: slot.Num}
+			imports = append(imports, imp)
+
+			switch {
+			case slot.Vol.Serial == "":
+				imp.Skipped = "volume has no barcode label"
+				continue
+			case departing[slot.Num] == slot.Vol.Serial:
+				imp.Skipped = "volume is exported"
+				continue
+			case len(free) == 0:
+				imp.Skipped = "no free storage slot"
+				continue
+			}
+
+			if err := tx.Transfer(slot.Num, free[0]); err != nil {
+				return errors.Wrapf(err, "failed to import volume %s", imp.Serial)
+			}
+
+			imp.Slot, free = free[0], free[1:]
+
+			imp.Status, err = srv.inv.Import(ctx, imp.Serial, imp.Slot, libname, foreign)
+			if err != nil {
+				return err
+			}
+
+			log.Printf("vault: imported volume %s from mail slot %d to slot %d as %s", imp.Serial, imp.From, imp.Slot, imp.Status)
+		}
+
+		return nil
+	})
+
+	// queued exports may fit in the emptied mail slots
+	srv.export.notify()
+
+	if srv.recall != nil {
+		srv.recall.imported(ctx)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return imports, nil
+}
+
+// Export queues the volumes identified by serials for export from the library
+// and moves as many of them as possible to the mail slots right away. Volumes
+// moved to a mail slot are in transit until taken out of the library. The
+// remaining volumes are moved once mail slots are emptied.
+func (srv *Server) Export(ctx context.Context, libname string, serials []string) ([]*ExportJob, error) {
+	if _, err := srv.library(libname); err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*ExportJob, 0, len(serials))
+
+	for _, serial := range serials {
+		info, err := srv.inv.Info(ctx, serial)
+		if err != nil {
+			return nil, errors.Wrap(err, serial)
+		}
+
+		if info.Library != libname {
+			return nil, errors.Wrap(ErrNotInLibrary, serial)
+		}
+
+		if srv.writing(serial) {
+			return nil, errors.Wrap(ErrVolumeBusy, serial)
+		}
+
+		job := &ExportJob{
+			Serial:    serial,
+			Library:   libname,
+			State:     ExportQueued,
+			Requested: time.Now(),
+		}
+
+		switch {
+		case !info.Status.Onsite():
+			job.State = ExportExported
+			job.Slot = info.Slot
+		case !info.Status.CanTransition(inventory.StateInTransit):
+			return nil, &inventory.TransitionError{Serial: serial, From: info.Status, To: inventory.StateInTransit}
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	// keep the exporter from taking the jobs before they are processed here
+	srv.export.mu.Lock()
+	defer srv.export.mu.Unlock()
+
+	err := srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		for _, job := range jobs {
+			if job.State != ExportQueued {
+				continue
+			}
+
+			queued, err := srv.export.get(tx, job.Serial)
+			if err != nil {
+				return err
+			}
+
+			// keep the place in the queue
+			if queued != nil {
+				job.Requested = queued.Requested
+			}
+
+			if err := srv.export.put(tx, job); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	exported, err := srv.export.processLocked(ctx, libname)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, job := range jobs {
+		if done, ok := exported[job.Serial]; ok {
+			jobs[i] = done
+		}
+	}
+
+	// report the reason a volume is still queued
+	queued, err := srv.Exports(libname)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, job := range jobs {
+		for _, q := range queued {
+			if q.Serial == job.Serial {
+				jobs[i] = q
+			}
+		}
+	}
+
+	return jobs, nil
+}
+
+// Exports returns the volumes of the library queued for export, oldest
+// request first.
+func (srv *Server) Exports(libname string) ([]*ExportJob, error) {
+	if _, err := srv.library(libname); err != nil {
+		return nil, err
+	}
+
+	jobs, err := srv.export.jobs(libname)
+	if err != nil {
+		return nil, err
+	}
+
+	if jobs == nil {
+		jobs = make([]*ExportJob, 0)
+	}
+
+	return jobs, nil
+}
+
+// exporter moves the volumes queued for export to the mail slots.
+type exporter struct {
+	srv      *Server
+	interval time.Duration
+	wake     chan struct{}
+
+	// mu serializes processing of the queue.
+	mu sync.Mutex
+}
+
+// newExporter creates an exporter and starts processing the volumes queued by
+// a previous run.
+func newExporter(srv *Server, interval time.Duration) *exporter {
+	e := &exporter{
+		srv:      srv,
+		interval: interval,
+		wake:     make(chan struct{}, 1),
+	}
+
+	go e.run()
+
+	e.notify()
+
+	return e
+}
+
+func (e *exporter) notify() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run processes the queue of every library whenever notified and at every
+// interval, as mail slots are emptied by operators without notice.
+func (e *exporter) run() {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.wake:
+		case <-ticker.C:
+		}
+
+		for libname := range e.srv.libraries {
+			if _, err := e.process(context.Background(), libname); err != nil {
+				log.Printf("vault: failed to export volumes from library %s: %v", libname, err)
+			}
+		}
+	}
+}
+
+type byRequestedExport []*ExportJob
+
+func (s byRequestedExport) Len() int           { return len(s) }
+func (s byRequestedExport) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byRequestedExport) Less(i, j int) bool { return s[i].Requested.Before(s[j].Requested) }
+
+// jobs returns the queued jobs of the library, oldest first.
+func (e *exporter) jobs(libname string) ([]*ExportJob, error) {
+	var jobs []*ExportJob
+
+	err := e.srv.chunkdb.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(exportsBucket)
+		if bkt == nil {
+			return nil
+		}
+
+		return bkt.ForEach(func(k, v []byte) error {
+			job := new(ExportJob)
+			if err := json.Unmarshal(v, job); err != nil {
+				return err
+			}
+
+			if job.Library == libname {
+				jobs = append(jobs, job)
+			}
+
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byRequestedExport(jobs))
+
+	return jobs, nil
+}
+
+// put persists job.
+func (e *exporter) put(tx *bolt.Tx, job *ExportJob) error {
+	bkt, err := tx.CreateBucketIfNotExists(exportsBucket)
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return bkt.Put([]byte(job.Serial), buf)
+}
+
+// get returns the queued job of the volume identified by serial, if any.
+func (e *exporter) get(tx *bolt.Tx, serial string) (*ExportJob, error) {
+	bkt := tx.Bucket(exportsBucket)
+	if bkt == nil {
+		return nil, nil
+	}
+
+	v := bkt.Get([]byte(serial))
+	if v == nil {
+		return nil, nil
+	}
+
+	job := new(ExportJob)
+	if err := json.Unmarshal(v, job); err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// eject unloads the volume identified by serial if it is in a read drive.
+func (e *exporter) eject(ctx context.Context, serial string) error {
+	if e.srv.writing(serial) {
+		return ErrVolumeBusy
+	}
+
+	for _, drv := range e.srv.drives["read"] {
+		if !drv.holds(serial) {
+			continue
+		}
+
+		// wait for the drive to finish reading
+		if _, err := acquireDrive(ctx, []*Drive{drv}, readPolicy); err != nil {
+			return err
+		}
+
+		err := func() error {
+			defer drv.Release()
+
+			if !drv.holds(serial) {
+				return nil
+			}
+
+			if err := e.srv.unmount(drv); err != nil {
+				return err
+			}
+
+			return e.srv.Unload(drv)
+		}()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// process moves the queued volumes of the library to free mail slots, oldest
+// request first, and returns the jobs of the volumes exported.
+func (e *exporter) process(ctx context.Context, libname string) (map[string]*ExportJob, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.processLocked(ctx, libname)
+}
+
+// processLocked is process with e.mu held.
+func (e *exporter) processLocked(ctx context.Context, libname string) (map[string]*ExportJob, error) {
+	jobs, err := e.jobs(libname)
+	if err != nil || len(jobs) == 0 {
+		return nil, err
+	}
+
+	lib, err := e.srv.library(libname)
+	if err != nil {
+		return nil, err
+	}
+
+	// volumes must be unloaded before taking the changer
+	for _, job := range jobs {
+		job.Error = ""
+		if err := e.eject(ctx, job.Serial); err != nil {
+			job.Error = err.Error()
+		}
+	}
+
+	exported := make(map[string]*ExportJob)
+
+	err = lib.chgr.Use(func(tx *changer.Tx) error {
+		// mail slots are emptied by operators
+		tx.Refresh()
+
+		status, err := tx.Status()
+		if err != nil {
+			return err
+		}
+
+		if _, err := e.srv.departing(ctx, libname, status); err != nil {
+			return err
+		}
+
+		homes := make(map[string]int)
+		var free []int
+		for _, slot := range status.Slots {
+			switch {
+			case slot.Type == mtx.MailSlot && slot.Vol == nil:
+				free = append(free, slot.Num)
+			case slot.Type == mtx.StorageSlot && slot.Vol != nil:
+				homes[slot.Vol.Serial] = slot.Num
+			}
+		}
+
+		for _, job := range jobs {
+			if job.Error != "" {
+				continue
+			}
+
+			home, ok := homes[job.Serial]
+			if !ok {
+				job.Error = "volume is not in a storage slot"
+				continue
+			}
+
+			if len(free) == 0 {
+				job.Error = "mail slots are full"
+				continue
+			}
+
+			if err := tx.Transfer(home, free[0]); err != nil {
+				job.Error = err.Error()
+				continue
+			}
+
+			job.Slot, free = free[0], free[1:]
+			job.State = ExportExported
+
+			if err := e.srv.inv.Export(ctx, job.Serial, job.Slot); err != nil {
+				return err
+			}
+
+			exported[job.Serial] = job
+
+			log.Printf("vault: exported volume %s from slot %d to mail slot %d", job.Serial, home, job.Slot)
+		}
+
+		return nil
+	})
+
+	// persist the outcome even if the changer failed part way
+	uerr := e.srv.chunkdb.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(exportsBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, job := range jobs {
+			if job.State == ExportExported {
+				if err := bkt.Delete([]byte(job.Serial)); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if err := e.put(tx, job); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if uerr != nil {
+		return nil, uerr
+	}
+
+	return exported, nil
+}
+
+// onsite returns true if the volume identified by serial is in its library.
+// States are looked up once and kept in states.
+func (srv *Server) onsite(ctx context.Context, serial string, states map[string]inventory.State) (bool, error) {
+	state, ok := states[serial]
+	if !ok {
+		info, err := srv.inv.Info(ctx, serial)
+		if err != nil {
+			return false, errors.Wrap(err, serial)
+		}
+
+		state = info.Status
+		states[serial] = state
+	}
+
+	return state.Onsite(), nil
+}
+
+// offsite returns the volumes that must be imported before ar can be read,
+// i.e. the volumes holding a chunk of which no copy is onsite.
+func (srv *Server) offsite(ctx context.Context, ar *Archive) ([]string, error) {
+	copies := make(map[int][]string)
+	for _, info := range ar.chunks {
+		if info.Parity || info.Volume == "" {
+			continue
+		}
+
+		copies[info.ID] = append(copies[info.ID], info.Volume)
+	}
+
+	states := make(map[string]inventory.State)
+	need := make(map[string]bool)
+
+	for _, serials := range copies {
+		var found bool
+		for _, serial := range serials {
+			ok, err := srv.onsite(ctx, serial, states)
+			if err != nil {
+				return nil, err
+			}
+
+			if ok {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			for _, serial := range serials {
+				need[serial] = true
+			}
+		}
+	}
+
+	if len(need) == 0 {
+		return nil, nil
+	}
+
+	serials := make([]string, 0, len(need))
+	for serial := range need {
+		serials = append(serials, serial)
+	}
+
+	sort.Strings(serials)
+
+	return serials, nil
+}
+
+// VaultVolume is a full volume considered for rotation to the vault.
+type VaultVolume struct {
+	Serial string `json:"serial"`
+	Slot   int    `json:"slot,omitempty"`
+	Live   int64  `json:"live"`
+	Chunks int    `json:"chunks"`
+
+	// Reason is why the volume should stay in the library.
+	Reason string `json:"reason,omitempty"`
+}
+
+// VaultReport lists the full volumes of a library that should be rotated
+// offsite and those that should stay.
+type VaultReport struct {
+	Library string         `json:"library"`
+	Rotate  []*VaultVolume `json:"rotate"`
+	Keep    []*VaultVolume `json:"keep"`
+}
+
+// VaultReport returns the full volumes of the library that should go offsite.
+// A volume can go if every live data chunk on it has a copy on another volume
+// that stays onsite, such that all archives remain readable without importing
+// a volume from the vault. Volumes without live chunks are left for reclaim.
+func (srv *Server) VaultReport(ctx context.Context, libname string) (*VaultReport, error) {
+	if _, err := srv.library(libname); err != nil {
+		return nil, err
+	}
+
+	vols, err := srv.inv.InState(ctx, libname, inventory.StateFull)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VaultReport{
+		Library: libname,
+		Rotate:  make([]*VaultVolume, 0),
+		Keep:    make([]*VaultVolume, 0),
+	}
+
+	states := make(map[string]inventory.State)
+
+	for _, info := range vols {
+		vol := &VaultVolume{
+			Serial: info.Serial,
+			Slot:   info.Slot,
+			Live:   info.Live,
+			Chunks: info.Chunks,
+		}
+
+		reason, err := srv.rotatable(ctx, info.Serial, states)
+		if err != nil {
+			return nil, err
+		}
+
+		if reason != "" {
+			vol.Reason = reason
+			report.Keep = append(report.Keep, vol)
+			continue
+		}
+
+		// the copies on a volume going offsite cannot cover for the next ones
+		states[info.Serial] = inventory.StateOffsite
+
+		report.Rotate = append(report.Rotate, vol)
+	}
+
+	return report, nil
+}
+
+// rotatable returns the reason the volume identified by serial should stay
+// onsite, or the empty string if it can go.
+func (srv *Server) rotatable(ctx context.Context, serial string, states map[string]inventory.State) (string, error) {
+	live, _, err := srv.liveChunks(serial)
+	if err != nil {
+		return "", err
+	}
+
+	if len(live) == 0 {
+		return "no live chunks", nil
+	}
+
+	archives := make([]string, 0, len(live))
+	for archive := range live {
+		archives = append(archives, archive)
+	}
+
+	sort.Strings(archives)
+
+	for _, archive := range archives {
+		var cnks []*ChunkInfo
+
+		err := srv.chunkdb.View(func(tx *bolt.Tx) error {
+			bkt := tx.Bucket([]byte(archive))
+			if bkt == nil {
+				return nil
+			}
+
+			var err error
+			cnks, err = readChunks(bkt)
+
+			return err
+		})
+
+		if err != nil {
+			return "", err
+		}
+
+		for _, info := range live[archive] {
+			if info.Parity {
+				continue
+			}
+
+			var found bool
+			for _, other := range cnks {
+				if other.ID != info.ID || other.Volume == "" || other.Volume == serial {
+					continue
+				}
+
+				ok, err := srv.onsite(ctx, other.Volume, states)
+				if err != nil {
+					return "", err
+				}
+
+				if ok {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				return fmt.Sprintf("only onsite copy of chunk %d of %s", info.ID, archive), nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// SetVolumeState moves the volume identified by serial to state. Operators
+// may mark volumes full, readonly, damaged or retired, or return empty
+// volumes to scratch; volumes move in and out of the library by Import and
+// Export.
+func (srv *Server) SetVolumeState(ctx context.Context, serial string, state inventory.State) (*inventory.VolumeInfo, error) {
+	switch state {
+	case inventory.StateScratch, inventory.StateFull, inventory.StateReadonly, inventory.StateDamaged, inventory.StateRetired:
+	default:
+		return nil, errors.Wrap(ErrInvalidState, string(state))
+	}
+
+	if srv.writing(serial) {
+		return nil, errors.Wrap(ErrVolumeBusy, serial)
+	}
+
+	info, err := srv.inv.Info(ctx, serial)
+	if err != nil {
+		return nil, errors.Wrap(err, serial)
+	}
+
+	if state == inventory.StateScratch {
+		if info.Chunks > 0 {
+			return nil, errors.Wrap(ErrVolumeNotEmpty, serial)
+		}
+
+		// drop the index of the dead chunks
+		err := srv.chunkdb.Update(func(tx *bolt.Tx) error {
+			vols := tx.Bucket(volumesBucket)
+			if vols == nil || vols.Bucket([]byte(serial)) == nil {
+				return nil
+			}
+
+			return vols.DeleteBucket([]byte(serial))
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := srv.inv.SetState(ctx, serial, state); err != nil {
+		return nil, err
+	}
+
+	log.Printf("vault: volume %s is %s", serial, state)
+
+	return srv.inv.Info(ctx, serial)
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/bh107/tapr/changer"
+	"github.com/bh107/tapr/inventory"
+	"github.com/bh107/tapr/util/mtx/mock"
+)
+
+// The mock library has storage slots 1 to 32 and mail slots 33 to 36. The
+// write drive holds the volume of slot 1 and the last mail slot holds a volume
+// not yet known to the inventory.
+
+// operate runs fn on the mock changer of the library as an operator at the
+// mail slots would.
+func operate(t *testing.T, srv *Server, fn func(chgr *mock.Changer) error) {
+	lib := srv.libraries["primary"]
+
+	err := lib.chgr.Use(func(tx *changer.Tx) error {
+		defer tx.Refresh()
+
+		return fn(lib.chgr.Interface.(*mock.Changer))
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serial returns the serial of the volume in the storage slot num.
+func serial(t *testing.T, srv *Server, num int) string {
+	var serial string
+
+	err := srv.libraries["primary"].chgr.Use(func(tx *changer.Tx) error {
+		status, err := tx.Status()
+		if err != nil {
+			return err
+		}
+
+		for _, slot := range status.Slots {
+			if slot.Num == num && slot.Vol != nil {
+				serial = slot.Vol.Serial
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if serial == "" {
+		t.Fatalf("no volume in slot %d", num)
+	}
+
+	return serial
+}
+
+// state returns the state of the volume identified by serial.
+func state(t *testing.T, srv *Server, serial string) inventory.State {
+	info, err := srv.inv.Info(context.Background(), serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return info.Status
+}
+
+func TestExportFullMailSlots(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	var serials []string
+	for num := 3; num <= 6; num++ {
+		serials = append(serials, serial(t, srv, num))
+	}
+
+	jobs, err := srv.Export(ctx, "primary", serials)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// three mail slots are free
+	for i, job := range jobs[:3] {
+		if job.State != ExportExported || job.Slot != 33+i {
+			t.Fatalf("expected %s in mail slot %d, got %s in %d", job.Serial, 33+i, job.State, job.Slot)
+		}
+
+		if st := state(t, srv, job.Serial); st != inventory.StateInTransit {
+			t.Fatalf("expected %s to be %s, got %s", job.Serial, inventory.StateInTransit, st)
+		}
+	}
+
+	if job := jobs[3]; job.State != ExportQueued || job.Error != "mail slots are full" {
+		t.Fatalf("expected %s to be queued as the mail slots are full, got %s: %q", job.Serial, job.State, job.Error)
+	}
+
+	operate(t, srv, func(chgr *mock.Changer) error {
+		_, err := chgr.Remove(33)
+		return err
+	})
+
+	// the queued volume takes the place of the departed one
+	if _, err := srv.export.process(ctx, "primary"); err != nil {
+		t.Fatal(err)
+	}
+
+	if st := state(t, srv, serials[0]); st != inventory.StateOffsite {
+		t.Fatalf("expected %s to be %s, got %s", serials[0], inventory.StateOffsite, st)
+	}
+
+	if st := state(t, srv, serials[3]); st != inventory.StateInTransit {
+		t.Fatalf("expected %s to be %s, got %s", serials[3], inventory.StateInTransit, st)
+	}
+
+	queued, err := srv.Exports("primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(queued) != 0 {
+		t.Fatalf("expected no queued exports, got %d", len(queued))
+	}
+}
+
+func TestImport(t *testing.T) {
+	srv, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	exported := serial(t, srv, 3)
+
+	if _, err := srv.Export(ctx, "primary", []string{exported}); err != nil {
+		t.Fatal(err)
+	}
+
+	operate(t, srv, func(chgr *mock.Changer) error {
+		if err := chgr.Insert(34, ""); err != nil {
+			return err
+		}
+
+		return chgr.Insert(35, "X00000L6")
+	})
+
+	imports, err := srv.Import(ctx, "primary", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	skipped := map[int]string{
+		33: "volume is exported",
+		34: "volume has no barcode label",
+	}
+
+	if len(imports) != 4 {
+		t.Fatalf("expected 4 volumes in the mail slots, got %d", len(imports))
+	}
+
+	slots := make(map[int]bool)
+	for _, imp := range imports {
+		if reason, ok := skipped[imp.From]; ok {
+			if imp.Skipped != reason || imp.Slot != 0 {
+				t.Fatalf("expected mail slot %d to be skipped as %q, got %+v", imp.From, reason, imp)
+			}
+
+			continue
+		}
+
+		// the home slot of the exported volume is free for the taking
+		if imp.Skipped != "" || imp.Slot == 0 || imp.Slot > 32 || slots[imp.Slot] {
+			t.Fatalf("expected %s to be imported to a free storage slot, got %+v", imp.Serial, imp)
+		}
+
+		slots[imp.Slot] = true
+
+		if imp.Status != inventory.StateScratch || state(t, srv, imp.Serial) != inventory.StateScratch {
+			t.Fatalf("expected %s to be imported as %s, got %s", imp.Serial, inventory.StateScratch, imp.Status)
+		}
+	}
+
+	// the exported volume returns to the state it left in
+	operate(t, srv, func(chgr *mock.Changer) error {
+		_, err := chgr.Remove(33)
+		return err
+	})
+
+	if _, err := srv.Import(ctx, "primary", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if st := state(t, srv, exported); st != inventory.StateOffsite {
+		t.Fatalf("expected %s to be %s, got %s", exported, inventory.StateOffsite, st)
+	}
+
+	operate(t, srv, func(chgr *mock.Changer) error {
+		return chgr.Insert(33, exported)
+	})
+
+	if _, err := srv.Import(ctx, "primary", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if st := state(t, srv, exported); st != inventory.StateScratch {
+		t.Fatalf("expected %s to be %s, got %s", exported, inventory.StateScratch, st)
+	}
+}
@@ -0,0 +1,78 @@
+package stream
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+)
+
+// Supported checksum algorithms.
+const (
+	SHA256 = "sha256"
+	CRC32C = "crc32c"
+)
+
+// DefaultChecksum is the checksum algorithm used if none is configured.
+const DefaultChecksum = SHA256
+
+// ChecksumXattr is the name of the extended attribute holding the checksum of
+// a chunk file.
+const ChecksumXattr = "user.tapr.checksum"
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func newHash(alg string) (hash.Hash, error) {
+	switch alg {
+	case SHA256:
+		return sha256.New(), nil
+	case CRC32C:
+		return crc32.New(castagnoli), nil
+	}
+
+	return nil, fmt.Errorf("unknown checksum algorithm: %s", alg)
+}
+
+// ValidChecksum returns an error if alg is not a supported checksum
+// algorithm.
+func ValidChecksum(alg string) error {
+	_, err := newHash(alg)
+	return err
+}
+
+// Checksum returns the checksum of p computed with alg. The result is
+// prefixed by the name of the algorithm, e.g. "crc32c:1a2b3c4d".
+func Checksum(alg string, p []byte) (string, error) {
+	h, err := newHash(alg)
+	if err != nil {
+		return "", err
+	}
+
+	h.Write(p)
+
+	return alg + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Verify checks p against a checksum previously returned by Checksum.
+func Verify(sum string, p []byte) error {
+	i := strings.IndexByte(sum, ':')
+	if i < 0 {
+		return fmt.Errorf("malformed checksum: %s", sum)
+	}
+
+	actual, err := Checksum(sum[:i], p)
+	if err != nil {
+		return err
+	}
+
+	if actual != sum {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
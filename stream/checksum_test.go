@@ -0,0 +1,33 @@
+package stream
+
+import "testing"
+
+func TestChecksumVerify(t *testing.T) {
+	for _, alg := range []string{SHA256, CRC32C} {
+		sum, err := Checksum(alg, custodian)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := Verify(sum, custodian); err != nil {
+			t.Errorf("%s: %v", alg, err)
+		}
+
+		corrupted := append([]byte(nil), custodian...)
+		corrupted[3] ^= 0x01
+
+		if err := Verify(sum, corrupted); err != ErrChecksumMismatch {
+			t.Errorf("%s: expected checksum mismatch, got %v", alg, err)
+		}
+	}
+}
+
+func TestChecksumUnknown(t *testing.T) {
+	if _, err := Checksum("md4", nil); err == nil {
+		t.Error("expected error for unknown algorithm")
+	}
+
+	if err := Verify("deadbeef", nil); err == nil {
+		t.Error("expected error for malformed checksum")
+	}
+}
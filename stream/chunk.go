@@ -1,23 +1,53 @@
 package stream
 
-import "sync"
+import (
+	"fmt"
+	"sync"
+)
 
-// DefaultChunkSize defines the well.... default chunk size. By default it is
-// 64 megabytes.
+// DefaultChunkSize is the chunk size used if neither the server configuration
+// nor the write policy sets one; 4 megabytes.
 const DefaultChunkSize = 4 * 1 << 20
 
+// MaxChunkSize is the largest chunk size allowed; 1 gigabyte.
+const MaxChunkSize = 1 << 30
+
+// SmallestChunkSize is the smallest chunk size allowed; 4 kilobytes.
+const SmallestChunkSize = 4 << 10
+
+// ValidChunkSize returns an error if chunks cannot be size bytes. Chunk sizes
+// are powers of two between SmallestChunkSize and MaxChunkSize, which bounds
+// the number of chunk pools kept.
+func ValidChunkSize(size int) error {
+	if size < SmallestChunkSize || size > MaxChunkSize || size&(size-1) != 0 {
+		return fmt.Errorf("invalid chunk size %d; must be a power of two between %d and %d bytes", size, SmallestChunkSize, MaxChunkSize)
+	}
+
+	return nil
+}
+
 // ChunkPool abstracts a sync.Pool for Chunks.
 type ChunkPool struct {
 	pool *sync.Pool
+	size int
 }
 
 // NewChunkPool returns a new ChunkPool.
 func NewChunkPool(chunksize int) *ChunkPool {
-	return &ChunkPool{
-		pool: &sync.Pool{
-			New: func() interface{} { return NewChunk(chunksize) },
+	cnkpool := &ChunkPool{
+		size: chunksize,
+	}
+
+	cnkpool.pool = &sync.Pool{
+		New: func() interface{} {
+			cnk := NewChunk(chunksize)
+			cnk.pool = cnkpool
+
+			return cnk
 		},
 	}
+
+	return cnkpool
 }
 
 // Get retrieves a possibly new Chunk from the ChunkPool.
@@ -25,11 +55,62 @@ func (cnkpool *ChunkPool) Get() *Chunk {
 	return cnkpool.pool.Get().(*Chunk)
 }
 
-// Put returns a Chunk to the ChunkPool.
+// Put returns a Chunk to the ChunkPool. Chunks whose buffer has been replaced,
+// e.g. by compression or encryption, are dropped.
 func (cnkpool *ChunkPool) Put(cnk *Chunk) {
+	if cap(cnk.buf) != cnkpool.size {
+		return
+	}
+
 	cnkpool.pool.Put(cnk)
 }
 
+// pools holds the chunk pools shared by all streams, keyed by chunk size.
+var pools = struct {
+	sync.Mutex
+	m map[int]*ChunkPool
+}{
+	m: make(map[int]*ChunkPool),
+}
+
+// poolFor returns the shared ChunkPool of chunks of the given size. Sizes not
+// allowed by ValidChunkSize get a pool of their own that is not kept.
+func poolFor(chunksize int) *ChunkPool {
+	if ValidChunkSize(chunksize) != nil {
+		return NewChunkPool(chunksize)
+	}
+
+	pools.Lock()
+	defer pools.Unlock()
+
+	cnkpool, ok := pools.m[chunksize]
+	if !ok {
+		cnkpool = NewChunkPool(chunksize)
+		pools.m[chunksize] = cnkpool
+	}
+
+	return cnkpool
+}
+
+// Meta describes how the data of a chunk is stored.
+type Meta struct {
+	Shard Shard
+
+	// Key is the id of the data key the chunk is encrypted with. It is empty
+	// if the chunk is not encrypted.
+	Key string
+
+	// Codec is the compression codec applied before encryption and Length
+	// the uncompressed length. Codec is empty if the chunk is not
+	// compressed.
+	Codec  string
+	Length int
+
+	// Fingerprint identifies the data of the chunk in a deduplicating
+	// stream. It is computed before compression and encryption.
+	Fingerprint string
+}
+
 // Chunk represents a block of data to be committed to backend store in one
 // operation.
 type Chunk struct {
@@ -38,6 +119,12 @@ type Chunk struct {
 	last     bool
 	pool     *ChunkPool
 
+	// checksum of buf, computed when the chunk is sealed
+	sum string
+
+	// how the data is stored
+	meta Meta
+
 	buf []byte
 }
 
@@ -52,6 +139,28 @@ func (cnk *Chunk) Upstream() *Stream {
 	return cnk.upstream
 }
 
+// ID returns the sequence number of the chunk within its stream.
+func (cnk *Chunk) ID() int {
+	return cnk.id
+}
+
+// Checksum returns the checksum computed when the chunk was sealed by its
+// stream.
+func (cnk *Chunk) Checksum() string {
+	return cnk.sum
+}
+
+// Meta describes how the data of the chunk is stored.
+func (cnk *Chunk) Meta() Meta {
+	return cnk.meta
+}
+
+// Bytes returns the data held by the chunk. The slice is only valid until the
+// chunk is returned to its pool.
+func (cnk *Chunk) Bytes() []byte {
+	return cnk.buf
+}
+
 func (cnk *Chunk) add(p []byte) (n int) {
 	free := cap(cnk.buf) - len(cnk.buf)
 	if len(p) > free {
@@ -65,6 +174,8 @@ func (cnk *Chunk) add(p []byte) (n int) {
 
 func (cnk *Chunk) done() {
 	cnk.upstream = nil
+	cnk.sum = ""
+	cnk.meta = Meta{}
 	cnk.buf = cnk.buf[:0]
 
 	cnk.pool.Put(cnk)
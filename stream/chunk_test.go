@@ -0,0 +1,68 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/bh107/tapr/stream/policy"
+	"golang.org/x/net/context"
+)
+
+func TestStreamChunkSize(t *testing.T) {
+	ctx := context.Background()
+
+	out := make(chan *Chunk, 4)
+
+	s := newTestStream(out, func(pol *policy.Policy) {
+		pol.ChunkSize = SmallestChunkSize
+	})
+
+	if other := New("other", s.pol); other.chunkpool != s.chunkpool {
+		t.Error("streams with equal chunk sizes do not share a chunk pool")
+	}
+
+	if _, err := s.Write(ctx, make([]byte, 2*SmallestChunkSize+500), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	close(out)
+
+	var sizes []int
+	for cnk := range out {
+		sizes = append(sizes, len(cnk.Bytes()))
+	}
+
+	if len(sizes) != 3 || sizes[0] != SmallestChunkSize || sizes[1] != SmallestChunkSize || sizes[2] != 500 {
+		t.Errorf("expected chunks of %d, %d and 500 bytes, got %v", SmallestChunkSize, SmallestChunkSize, sizes)
+	}
+}
+
+func TestChunkPools(t *testing.T) {
+	for _, size := range []int{0, 1000, SmallestChunkSize / 2, 3 * SmallestChunkSize, 2 * MaxChunkSize} {
+		if ValidChunkSize(size) == nil {
+			t.Errorf("chunk size %d should be invalid", size)
+		}
+	}
+
+	for _, size := range []int{SmallestChunkSize, DefaultChunkSize, MaxChunkSize} {
+		if err := ValidChunkSize(size); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// pools of sizes clients may not ask for are not kept
+	if poolFor(1000) == poolFor(1000) {
+		t.Error("invalid chunk size was given a shared pool")
+	}
+
+	pools.Lock()
+	_, ok := pools.m[1000]
+	pools.Unlock()
+
+	if ok {
+		t.Error("pool of invalid chunk size was kept")
+	}
+}
@@ -0,0 +1,133 @@
+package stream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported compression codecs.
+const (
+	CompressionNone = "none"
+	Gzip            = "gzip"
+	Zstd            = "zstd"
+)
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+	zstdErr  error
+)
+
+// initZstd sets up the zstd encoder and decoder shared by all streams.
+func initZstd() error {
+	zstdOnce.Do(func() {
+		if zstdEnc, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+
+		zstdDec, zstdErr = zstd.NewReader(nil)
+	})
+
+	return zstdErr
+}
+
+// ValidCompression returns an error if codec is not a supported compression
+// codec.
+func ValidCompression(codec string) error {
+	switch codec {
+	case CompressionNone, Gzip, Zstd:
+		return nil
+	}
+
+	return fmt.Errorf("unknown compression codec: %s", codec)
+}
+
+// compress returns p compressed with codec.
+func compress(codec string, p []byte) ([]byte, error) {
+	switch codec {
+	case Gzip:
+		var buf bytes.Buffer
+
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(p); err != nil {
+			return nil, err
+		}
+
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+
+	case Zstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+
+		return zstdEnc.EncodeAll(p, make([]byte, 0, len(p))), nil
+	}
+
+	return nil, fmt.Errorf("unknown compression codec: %s", codec)
+}
+
+// Decompress returns p decompressed with codec. The result must be length
+// bytes long.
+func Decompress(codec string, p []byte, length int) ([]byte, error) {
+	var buf []byte
+	var err error
+
+	switch codec {
+	case Gzip:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(p)); err != nil {
+			return nil, err
+		}
+
+		buf, err = ioutil.ReadAll(zr)
+
+	case Zstd:
+		if err = initZstd(); err != nil {
+			return nil, err
+		}
+
+		buf, err = zstdDec.DecodeAll(p, make([]byte, 0, length))
+
+	default:
+		return nil, fmt.Errorf("unknown compression codec: %s", codec)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) != length {
+		return nil, fmt.Errorf("decompressed %d bytes, expected %d", len(buf), length)
+	}
+
+	return buf, nil
+}
+
+// compressChunk compresses the data of cnk with the codec of the stream
+// policy. The chunk is left alone if compression does not make it smaller.
+func (s *Stream) compressChunk(cnk *Chunk) error {
+	buf, err := compress(s.pol.Compression, cnk.buf)
+	if err != nil {
+		return err
+	}
+
+	if len(buf) >= len(cnk.buf) {
+		return nil
+	}
+
+	cnk.meta.Codec = s.pol.Compression
+	cnk.meta.Length = len(cnk.buf)
+	cnk.buf = buf
+
+	return nil
+}
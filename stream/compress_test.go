@@ -0,0 +1,38 @@
+package stream
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressRoundtrip(t *testing.T) {
+	data := bytes.Repeat([]byte("2016/05/01 12:00:00 volume mounted at /tmp/ltfs\n"), 1000)
+
+	for _, codec := range []string{Gzip, Zstd} {
+		buf, err := compress(codec, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(buf) >= len(data) {
+			t.Errorf("%s: compressed %d bytes to %d", codec, len(data), len(buf))
+		}
+
+		p, err := Decompress(codec, buf, len(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(p, data) {
+			t.Errorf("%s: decompressed data differs", codec)
+		}
+
+		if _, err := Decompress(codec, buf, len(data)+1); err == nil {
+			t.Errorf("%s: expected length mismatch", codec)
+		}
+	}
+
+	if err := ValidCompression("lz4"); err == nil {
+		t.Error("expected error for unknown codec")
+	}
+}
@@ -0,0 +1,217 @@
+package stream
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// KeySize is the size of master and data keys (AES-256).
+const KeySize = 32
+
+var ErrNoSuchKey = errors.New("no such key")
+
+// KeyID returns the id of key, a prefix of its SHA-256 digest.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// WrappedKey is a data key encrypted with a master key.
+type WrappedKey struct {
+	// ID is the id of the data key.
+	ID string `json:"id"`
+
+	// Master is the id of the master key wrapping the data key.
+	Master string `json:"master"`
+
+	// Key is the encrypted data key.
+	Key []byte `json:"key"`
+}
+
+// Keyring holds the master keys used to wrap data keys.
+type Keyring struct {
+	keys    map[string][]byte
+	current string
+}
+
+// LoadKeyring reads master keys from the file at path. The file holds one
+// hex encoded key per line; blank lines and lines starting with '#' are
+// ignored. New data keys are wrapped with the first key, the others are only
+// used to unwrap existing data keys.
+func LoadKeyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	kr := &Keyring{
+		keys: make(map[string][]byte),
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("%s: invalid key; expected %d hex encoded bytes", path, KeySize)
+		}
+
+		id := KeyID(key)
+		if kr.current == "" {
+			kr.current = id
+		}
+
+		kr.keys[id] = key
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if kr.current == "" {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+
+	return kr, nil
+}
+
+// NewDataKey generates a new random data key and returns it along with its
+// wrapped form.
+func (kr *Keyring) NewDataKey() ([]byte, *WrappedKey, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, nil, err
+	}
+
+	id := KeyID(key)
+
+	wrapped, err := seal(kr.keys[kr.current], key, []byte(id))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, &WrappedKey{
+		ID:     id,
+		Master: kr.current,
+		Key:    wrapped,
+	}, nil
+}
+
+// Unwrap decrypts the data key.
+func (kr *Keyring) Unwrap(wk *WrappedKey) ([]byte, error) {
+	master, ok := kr.keys[wk.Master]
+	if !ok {
+		return nil, fmt.Errorf("master key %s: %v", wk.Master, ErrNoSuchKey)
+	}
+
+	return open(master, wk.Key, []byte(wk.ID))
+}
+
+// SetKey enables encryption of the chunks written to the stream with the data
+// key identified by id.
+func (s *Stream) SetKey(id string, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	s.key = id
+	s.aead = aead
+
+	return nil
+}
+
+// encrypt encrypts the data of cnk. Chunks are bound to their data key rather
+// than the archive name, which changes when an archive is renamed. Each
+// archive has its own data key. Deduplicated chunks may be shared between
+// archives and are bound to their fingerprint instead.
+func (s *Stream) encrypt(cnk *Chunk) error {
+	ad := additionalData(s.key, cnk.id)
+	if cnk.meta.Fingerprint != "" {
+		ad = additionalData(cnk.meta.Fingerprint, 0)
+	}
+
+	buf, err := sealAEAD(s.aead, cnk.buf, ad)
+	if err != nil {
+		return err
+	}
+
+	cnk.buf = buf
+	cnk.meta.Key = s.key
+
+	return nil
+}
+
+// Decrypt decrypts the data of the chunk identified by id, as encrypted by a
+// stream with the data key identified by keyID. Deduplicated chunks are
+// identified by their fingerprint and id 0.
+func Decrypt(key []byte, keyID string, id int, p []byte) ([]byte, error) {
+	return open(key, p, additionalData(keyID, id))
+}
+
+// additionalData binds an encrypted chunk to its id under name.
+func additionalData(name string, id int) []byte {
+	ad := make([]byte, 8, 8+len(name))
+	binary.BigEndian.PutUint64(ad, uint64(id))
+
+	return append(ad, name...)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts p with key.
+func seal(key []byte, p []byte, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return sealAEAD(aead, p, ad)
+}
+
+// open decrypts p as encrypted by seal.
+func open(key []byte, p []byte, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	return aead.Open(nil, p[:aead.NonceSize()], p[aead.NonceSize():], ad)
+}
+
+// sealAEAD encrypts p with a random nonce, which is prepended to the result.
+func sealAEAD(aead cipher.AEAD, p []byte, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(p)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, p, ad), nil
+}
@@ -0,0 +1,91 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestStreamEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tapr")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	master := bytes.Repeat([]byte{0x42}, KeySize)
+	keyfile := path.Join(dir, "master.keys")
+
+	if err := ioutil.WriteFile(keyfile, []byte("# master key\n"+hex.EncodeToString(master)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	kr, err := LoadKeyring(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, wk, err := kr.NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wk.Master != KeyID(master) {
+		t.Errorf("data key wrapped with %s, expected %s", wk.Master, KeyID(master))
+	}
+
+	unwrapped, err := kr.Unwrap(wk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(unwrapped, key) {
+		t.Fatal("unwrapped key differs")
+	}
+
+	out := make(chan *Chunk, 1)
+
+	s := newTestStream(out)
+
+	if err := s.SetKey(wk.ID, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Write(context.Background(), custodian, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	cnk := <-out
+
+	if cnk.Meta().Key != wk.ID {
+		t.Errorf("chunk encrypted with %q, expected %q", cnk.Meta().Key, wk.ID)
+	}
+
+	if bytes.Contains(cnk.Bytes(), custodian) {
+		t.Error("chunk holds plaintext")
+	}
+
+	p, err := Decrypt(key, wk.ID, cnk.ID(), cnk.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(p, custodian) {
+		t.Error("decrypted chunk differs")
+	}
+
+	// chunks are bound to their id under the data key
+	if _, err := Decrypt(key, wk.ID, cnk.ID()+1, cnk.Bytes()); err == nil {
+		t.Error("expected error decrypting chunk under another id")
+	}
+}
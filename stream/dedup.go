@@ -0,0 +1,104 @@
+package stream
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+
+	"golang.org/x/net/context"
+)
+
+// Content-defined chunking parameters. Chunk boundaries are placed where the
+// rolling hash of the last 64 bytes has the low bits in ChunkMask cleared, but
+// never before MinChunkSize bytes, giving chunks of about 1 MiB on average.
+// Chunks are cut at the chunk size of the stream regardless of content.
+const (
+	MinChunkSize = 256 * 1 << 10
+	ChunkMask    = 1<<20 - 1
+)
+
+// gear maps bytes to the random values mixed into the rolling hash. The table
+// must never change; doing so would move all chunk boundaries and defeat
+// deduplication of data already stored.
+var gear = func() (tbl [256]uint64) {
+	rnd := rand.New(rand.NewSource(0x7461707200000001))
+	for i := range tbl {
+		tbl[i] = uint64(rnd.Int63())<<1 ^ uint64(rnd.Int63())
+	}
+
+	return tbl
+}()
+
+// DedupFunc is called with every chunk of a deduplicating stream before it is
+// written. The fingerprint of the chunk is available from its Meta. If the
+// function returns true, an identical chunk is already stored and cnk is not
+// written.
+type DedupFunc func(cnk *Chunk) (bool, error)
+
+// chunker finds content-defined chunk boundaries.
+type chunker struct {
+	hash uint64
+}
+
+// split adds bytes from p to cnk up to the next chunk boundary. It returns the
+// number of bytes added and whether a boundary was found.
+func (c *chunker) split(cnk *Chunk, p []byte) (int, bool) {
+	max := cap(cnk.buf) - len(cnk.buf)
+
+	for i, b := range p {
+		c.hash = c.hash<<1 + gear[b]
+
+		size := len(cnk.buf) + i + 1
+		if i+1 == max || size >= MinChunkSize && c.hash&ChunkMask == 0 {
+			cnk.buf = append(cnk.buf, p[:i+1]...)
+			c.hash = 0
+
+			return i + 1, true
+		}
+	}
+
+	cnk.buf = append(cnk.buf, p...)
+
+	return len(p), false
+}
+
+// Fingerprint returns the fingerprint identifying chunks holding p.
+func Fingerprint(p []byte) string {
+	sum := sha256.Sum256(p)
+	return hex.EncodeToString(sum[:])
+}
+
+// SetDedup enables content-defined chunking of the stream and deduplication
+// of chunks through fn.
+func (s *Stream) SetDedup(fn DedupFunc) {
+	s.chunker = new(chunker)
+	s.dedup = fn
+}
+
+// writeContent writes p to the stream, cutting chunks at content-defined
+// boundaries.
+func (s *Stream) writeContent(ctx context.Context, p []byte, ack bool) error {
+	for len(p) > 0 {
+		n, cut := s.chunker.split(s.tmp, p)
+		p = p[n:]
+
+		if cut {
+			if err := s.writeChunk(ctx, s.tmp, ack); err != nil {
+				return err
+			}
+
+			s.tmp = s.chunkpool.Get()
+		}
+	}
+
+	return nil
+}
+
+// deduplicate fingerprints cnk and returns true if it need not be written.
+func (s *Stream) deduplicate(cnk *Chunk) (bool, error) {
+	cnk.meta.Fingerprint = Fingerprint(cnk.buf)
+
+	cnk.upstream = s
+
+	return s.dedup(cnk)
+}
@@ -0,0 +1,73 @@
+package stream
+
+import (
+	"math/rand"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// fingerprints writes p to a deduplicating stream and returns the fingerprints
+// of its chunks.
+func fingerprints(t *testing.T, p []byte) []string {
+	ctx := context.Background()
+
+	out := make(chan *Chunk, 64)
+
+	s := newTestStream(out)
+
+	var fps []string
+	s.SetDedup(func(cnk *Chunk) (bool, error) {
+		fps = append(fps, cnk.Meta().Fingerprint)
+		return false, nil
+	})
+
+	// write in odd sized pieces to cross chunk boundaries
+	for len(p) > 0 {
+		n := 100003
+		if n > len(p) {
+			n = len(p)
+		}
+
+		if _, err := s.Write(ctx, p[:n], false); err != nil {
+			t.Fatal(err)
+		}
+
+		p = p[n:]
+	}
+
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return fps
+}
+
+func TestContentDefinedChunking(t *testing.T) {
+	data := make([]byte, 8<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	fps := fingerprints(t, data)
+	if len(fps) < 3 {
+		t.Fatalf("expected content-defined chunks, got %d chunks", len(fps))
+	}
+
+	// inserting data at the front only changes the first chunk
+	shifted := fingerprints(t, append([]byte("inserted"), data...))
+
+	seen := make(map[string]bool)
+	for _, fp := range fps {
+		seen[fp] = true
+	}
+
+	var shared int
+	for _, fp := range shifted {
+		if seen[fp] {
+			shared++
+		}
+	}
+
+	if shared != len(fps)-1 {
+		t.Errorf("%d of %d chunks shared after insertion, expected %d", shared, len(fps), len(fps)-1)
+	}
+}
@@ -0,0 +1,157 @@
+package stream
+
+import (
+	"errors"
+
+	"github.com/klauspost/reedsolomon"
+	"golang.org/x/net/context"
+)
+
+// Erasure describes a Reed-Solomon code protecting stripes of Data chunks with
+// Parity parity chunks.
+type Erasure struct {
+	Data   int `json:"data"`
+	Parity int `json:"parity"`
+}
+
+// Shards returns the number of chunks in a full stripe.
+func (ec *Erasure) Shards() int {
+	return ec.Data + ec.Parity
+}
+
+// Encoder returns a Reed-Solomon encoder for the code.
+func (ec *Erasure) Encoder() (reedsolomon.Encoder, error) {
+	return reedsolomon.New(ec.Data, ec.Parity)
+}
+
+// Shard identifies the position of a chunk in an erasure coded stripe.
+type Shard struct {
+	// Stripe is the sequence number of the stripe within the stream, counting
+	// from 1. It is zero for chunks that are not erasure coded.
+	Stripe int
+
+	// Index is the position of the chunk in the stripe. Data chunks come
+	// first, followed by the parity chunks.
+	Index int
+
+	Parity bool
+}
+
+// striper collects the chunks of a stream into stripes and adds parity chunks
+// to each stripe. Each chunk of a stripe is sent on a separate channel.
+type striper struct {
+	ec  *Erasure
+	enc reedsolomon.Encoder
+
+	outs []chan *Chunk
+
+	stripe  int
+	pending []*Chunk
+}
+
+// SetErasure enables erasure coding of the stream. Chunks are distributed over
+// outs, which must hold at least ec.Shards() channels, such that no two chunks
+// of a stripe are sent on the same channel.
+func (s *Stream) SetErasure(ec *Erasure, outs []chan *Chunk) error {
+	if ec.Data < 1 || ec.Parity < 1 {
+		return errors.New("invalid erasure code")
+	}
+
+	if len(outs) < ec.Shards() {
+		return errors.New("too few channels for erasure code")
+	}
+
+	enc, err := ec.Encoder()
+	if err != nil {
+		return err
+	}
+
+	s.striper = &striper{
+		ec:   ec,
+		enc:  enc,
+		outs: outs,
+	}
+
+	return nil
+}
+
+// stripe adds cnk to the current stripe and writes the stripe when it is full.
+func (s *Stream) stripe(ctx context.Context, cnk *Chunk, ack bool) error {
+	st := s.striper
+
+	st.pending = append(st.pending, cnk)
+
+	if len(st.pending) < st.ec.Data {
+		return nil
+	}
+
+	return s.flushStripe(ctx, ack)
+}
+
+// flushStripe computes the parity chunks of the current, possibly partial,
+// stripe and sends all chunks of the stripe. A partial stripe is encoded as if
+// the missing data chunks were all zeros.
+func (s *Stream) flushStripe(ctx context.Context, ack bool) error {
+	st := s.striper
+
+	if len(st.pending) == 0 {
+		return nil
+	}
+
+	st.stripe++
+
+	// all shards must have the size of the largest chunk
+	var size int
+	for _, cnk := range st.pending {
+		if len(cnk.buf) > size {
+			size = len(cnk.buf)
+		}
+	}
+
+	shards := make([][]byte, st.ec.Shards())
+	for i := range shards[:st.ec.Data] {
+		shards[i] = make([]byte, size)
+		if i < len(st.pending) {
+			copy(shards[i], st.pending[i].buf)
+		}
+	}
+
+	data := st.pending
+	st.pending = nil
+
+	parity := make([]*Chunk, st.ec.Parity)
+	for i := range parity {
+		parity[i] = s.chunkpool.Get()
+		parity[i].id = 0
+		parity[i].buf = append(parity[i].buf[:0], make([]byte, size)...)
+		parity[i].meta.Shard.Parity = true
+
+		shards[st.ec.Data+i] = parity[i].buf
+	}
+
+	if err := st.enc.Encode(shards); err != nil {
+		return err
+	}
+
+	// the zero chunks completing a partial stripe are not written
+	for i, cnk := range append(data, parity...) {
+		cnk.meta.Shard.Stripe = st.stripe
+		cnk.meta.Shard.Index = i
+		if cnk.meta.Shard.Parity {
+			cnk.meta.Shard.Index = st.ec.Data + i - len(data)
+		}
+
+		// rotate the channels, such that parity is spread over all drives
+		out := st.outs[(st.stripe+cnk.meta.Shard.Index)%len(st.outs)]
+
+		if err := s.send(ctx, cnk, out, false); err != nil {
+			return err
+		}
+	}
+
+	if ack {
+		return s.Wait(ctx)
+	}
+
+	return nil
+}
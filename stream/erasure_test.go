@@ -0,0 +1,86 @@
+package stream
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestStreamErasure(t *testing.T) {
+	ctx := context.Background()
+
+	ec := &Erasure{Data: 2, Parity: 1}
+
+	outs := make([]chan *Chunk, 3)
+	for i := range outs {
+		outs[i] = make(chan *Chunk, 4)
+	}
+
+	s := newTestStream(nil)
+
+	if err := s.SetErasure(ec, outs); err != nil {
+		t.Fatal(err)
+	}
+
+	// two and a half chunks; a full stripe and a partial one
+	data := make([]byte, DefaultChunkSize*5/2)
+	rand.Read(data)
+
+	if _, err := s.Write(ctx, data, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	stripes := make(map[int][][]byte)
+	for i, out := range outs {
+		close(out)
+
+		seen := make(map[int]bool)
+		for cnk := range out {
+			shard := cnk.Meta().Shard
+			if seen[shard.Stripe] {
+				t.Errorf("channel %d received two chunks of stripe %d", i, shard.Stripe)
+			}
+
+			seen[shard.Stripe] = true
+
+			if stripes[shard.Stripe] == nil {
+				stripes[shard.Stripe] = make([][]byte, ec.Shards())
+			}
+
+			stripes[shard.Stripe][shard.Index] = append([]byte(nil), cnk.Bytes()...)
+		}
+	}
+
+	if len(stripes) != 2 {
+		t.Fatalf("expected 2 stripes, got %d", len(stripes))
+	}
+
+	enc, err := ec.Encoder()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lose the first data chunk of the full stripe
+	shards := stripes[1]
+	lost := shards[0]
+	shards[0] = nil
+
+	if err := enc.ReconstructData(shards); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(shards[0], lost) {
+		t.Error("reconstructed chunk differs")
+	}
+
+	// the partial stripe has no second data chunk
+	if stripes[2][1] != nil {
+		t.Error("zero chunk of partial stripe was written")
+	}
+}
@@ -1,7 +1,9 @@
 package policy
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"golang.org/x/net/context"
@@ -14,6 +16,30 @@ type Policy struct {
 	WriteGroup        string
 	Exclusive         bool
 	ExclusiveTimeout  time.Duration
+
+	// Checksum is the algorithm used for computing chunk checksums. Empty
+	// means the server default.
+	Checksum string
+
+	// Copies is the number of copies of each chunk, each stored in a
+	// separate library. Zero means the server default.
+	Copies int
+
+	// Compression is the codec used for compressing chunks; "zstd", "gzip"
+	// or "none".
+	Compression string
+
+	// ChunkSize is the size of the chunks in bytes, a power of two. Zero
+	// means the server default.
+	ChunkSize int
+
+	// Dedup enables content-defined chunking and deduplication of chunks
+	// against all chunks already stored.
+	Dedup bool
+
+	// Spool lands the archive in the disk spool, from which it is migrated
+	// to tape later. Writes are acknowledged once durable on disk.
+	Spool bool
 }
 
 func NewDefaultPolicy() *Policy {
@@ -22,6 +48,7 @@ func NewDefaultPolicy() *Policy {
 		WriteGroup:        "none",
 		Exclusive:         false,
 		ExclusiveTimeout:  0,
+		Compression:       "none",
 	}
 }
 
@@ -55,9 +82,105 @@ func Construct(req *http.Request) (*Policy, error) {
 		pol.ExclusiveTimeout = timeout
 	}
 
+	if v = req.Header.Get("Checksum"); v != "" {
+		pol.Checksum = v
+	}
+
+	if v = req.Header.Get("Copies"); v != "" {
+		copies, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if copies < 1 {
+			return nil, fmt.Errorf("invalid number of copies: %d", copies)
+		}
+
+		pol.Copies = copies
+	}
+
+	if v = req.Header.Get("Chunk-Size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if size < 1 {
+			return nil, fmt.Errorf("invalid chunk size: %d", size)
+		}
+
+		pol.ChunkSize = size
+	}
+
+	if v = req.Header.Get("Dedup"); v == "yes" {
+		pol.Dedup = true
+	}
+
+	if v = req.Header.Get("Spool"); v == "yes" {
+		pol.Spool = true
+	}
+
+	if v = req.Header.Get("Compression"); v != "" {
+		switch v {
+		case "zstd", "gzip", "none":
+			pol.Compression = v
+		default:
+			return nil, fmt.Errorf("unknown compression codec: %s", v)
+		}
+	}
+
 	return pol, nil
 }
 
+// Header describes pol in h using the same headers as parsed by Construct.
+func (pol *Policy) Header(h http.Header) {
+	if pol.AcknowledgedWrite {
+		h.Set("Acknowledged-Write", "yes")
+	} else {
+		h.Set("Acknowledged-Write", "no")
+	}
+
+	h.Set("Write-Group", pol.WriteGroup)
+
+	if pol.Exclusive {
+		h.Set("Exclusive", "yes")
+	} else {
+		h.Set("Exclusive", "no")
+	}
+
+	if pol.ExclusiveTimeout != 0 {
+		h.Set("Exclusive-Timeout", pol.ExclusiveTimeout.String())
+	}
+
+	if pol.Checksum != "" {
+		h.Set("Checksum", pol.Checksum)
+	}
+
+	if pol.Copies != 0 {
+		h.Set("Copies", strconv.Itoa(pol.Copies))
+	}
+
+	if pol.Compression != "" {
+		h.Set("Compression", pol.Compression)
+	}
+
+	if pol.ChunkSize != 0 {
+		h.Set("Chunk-Size", strconv.Itoa(pol.ChunkSize))
+	}
+
+	if pol.Dedup {
+		h.Set("Dedup", "yes")
+	} else {
+		h.Set("Dedup", "no")
+	}
+
+	if pol.Spool {
+		h.Set("Spool", "yes")
+	} else {
+		h.Set("Spool", "no")
+	}
+}
+
 type contextKey struct {
 	name string
 }
@@ -0,0 +1,38 @@
+package policy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	pol := &Policy{
+		AcknowledgedWrite: false,
+		WriteGroup:        "parallel-write",
+		Exclusive:         true,
+		ExclusiveTimeout:  time.Minute,
+		Checksum:          "crc32c",
+		Copies:            2,
+		Compression:       "zstd",
+		ChunkSize:         1 << 20,
+		Dedup:             true,
+		Spool:             true,
+	}
+
+	req, err := http.NewRequest("PUT", "/obj/test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pol.Header(req.Header)
+
+	got, err := Construct(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *got != *pol {
+		t.Errorf("expected %+v, got %+v", pol, got)
+	}
+}
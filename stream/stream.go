@@ -1,12 +1,18 @@
 package stream
 
 import (
+	"crypto/cipher"
+	"errors"
 	"log"
+	"sync"
 
 	"github.com/bh107/tapr/stream/policy"
 	"golang.org/x/net/context"
 )
 
+// ErrAborted is reported for chunks sent to an aborted stream.
+var ErrAborted = errors.New("stream aborted")
+
 // Stream represents a byte stream going to backend storage.
 type Stream struct {
 	archive    string
@@ -14,23 +20,52 @@ type Stream struct {
 	cnkCounter int
 	pol        *policy.Policy
 
+	// base is added to the sequence number of chunks to form their id.
+	base int
+
+	// copy is the copy number of the chunks written to the stream.
+	copy int
+
+	// striper is non-nil if the stream is erasure coded.
+	striper *striper
+
+	// key and aead are set if chunks are encrypted.
+	key  string
+	aead cipher.AEAD
+
+	// chunker and dedup are set if the stream is deduplicated.
+	chunker *chunker
+	dedup   DedupFunc
+
 	onclose func()
+	closed  sync.Once
 
-	errc chan error
+	// outstanding chunk acknowledgements
+	mu       sync.Mutex
+	sent     int
+	inflight int
+	err      error
+	acked    chan struct{}
 
 	out chan *Chunk
 
 	chunkpool *ChunkPool
 }
 
-// New creates a new byte stream.
+// New creates a new byte stream. Chunks are pol.ChunkSize bytes, or
+// DefaultChunkSize if the policy does not set a size.
 func New(name string, pol *policy.Policy) *Stream {
+	chunksize := pol.ChunkSize
+	if chunksize == 0 {
+		chunksize = DefaultChunkSize
+	}
+
 	s := &Stream{
 		archive: name,
-		errc:    make(chan error),
+		acked:   make(chan struct{}, 1),
 		pol:     pol,
 
-		chunkpool: NewChunkPool(DefaultChunkSize),
+		chunkpool: poolFor(chunksize),
 	}
 
 	s.tmp = s.chunkpool.Get()
@@ -43,15 +78,74 @@ func (s *Stream) String() string {
 }
 
 func (s *Stream) Parallel() bool {
-	return s.pol.WriteGroup != ""
+	return s.pol.Parallel()
+}
+
+// Chunks returns the number of chunks written to the stream.
+func (s *Stream) Chunks() int {
+	return s.cnkCounter
+}
+
+// SetBase makes the ids of the chunks written to the stream start after base
+// instead of zero. It allows multiple streams to write disjoint ranges of
+// chunks of the same archive.
+func (s *Stream) SetBase(base int) {
+	s.base = base
 }
 
 func (s *Stream) Policy() *policy.Policy {
 	return s.pol
 }
 
-func (s *Stream) Errc() chan<- error {
-	return s.errc
+// Copy returns the copy number of the stream. Each copy of an archive is
+// written through a separate stream.
+func (s *Stream) Copy() int {
+	return s.copy
+}
+
+func (s *Stream) SetCopy(n int) {
+	s.copy = n
+}
+
+// Report is used by writers to acknowledge a chunk of the stream. A nil error
+// means that the chunk is durable on the backend storage. Report never blocks.
+func (s *Stream) Report(err error) {
+	s.mu.Lock()
+	s.inflight--
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+
+	// wake up the stream if it is waiting
+	select {
+	case s.acked <- struct{}{}:
+	default:
+	}
+}
+
+// Wait blocks until all chunks written to the stream have been acknowledged.
+// It returns the first error reported for any chunk.
+func (s *Stream) Wait(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		inflight, err := s.inflight, s.err
+		s.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		if inflight == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.acked:
+		}
+	}
 }
 
 func (s *Stream) SetOut(out chan *Chunk) {
@@ -63,8 +157,17 @@ func (s *Stream) OnClose(fn func()) {
 }
 
 // Write writes bytes to the stream. Chunks are only flushed to backend storage
-// when they reach DefaultChunkSize.
+// when they reach the chunk size of the stream, or at content-defined
+// boundaries if the stream is deduplicated.
 func (s *Stream) Write(ctx context.Context, p []byte, ack bool) (n int, err error) {
+	if s.chunker != nil {
+		if err := s.writeContent(ctx, p, ack); err != nil {
+			return 0, err
+		}
+
+		return len(p), nil
+	}
+
 	// try to assemble a chunk
 	for {
 		if len(p) == 0 {
@@ -92,41 +195,147 @@ func (s *Stream) Write(ctx context.Context, p []byte, ack bool) (n int, err erro
 	return len(p), nil
 }
 
+// Rewrite writes p as the chunk identified by id, replacing any existing chunk
+// with that id in the backing store. It is used to move chunks between
+// volumes; p is written as is and meta must describe how it was stored.
+func (s *Stream) Rewrite(ctx context.Context, id int, meta Meta, p []byte) error {
+	cnk := s.chunkpool.Get()
+	cnk.buf = append(cnk.buf[:0], p...)
+	cnk.id = id
+	cnk.meta = meta
+
+	if id > s.cnkCounter {
+		s.cnkCounter = id
+	}
+
+	return s.send(ctx, cnk, s.out, false)
+}
+
 // Close closes the current stream and flushed the partial chunk to backend
-// storage.
+// storage. If the stream policy requires acknowledged writes, Close waits for
+// all outstanding chunks to become durable.
 func (s *Stream) Close(ctx context.Context) error {
 	s.tmp.last = true
 
-	// write the partial chunk, if any
-	if err := s.writeChunk(ctx, s.tmp, true); err != nil {
-		return err
+	// write the partial chunk, unless it is empty and not the only chunk
+	var err error
+	if len(s.tmp.buf) > 0 || s.cnkCounter == 0 && s.sent == 0 {
+		err = s.writeChunk(ctx, s.tmp, false)
+	}
+
+	// write the partial stripe, if any
+	if err == nil && s.striper != nil {
+		err = s.flushStripe(ctx, false)
+	}
+
+	if err == nil && s.pol.AcknowledgedWrite {
+		err = s.Wait(ctx)
 	}
 
 	log.Print("closing stream")
 
-	go s.onclose()
+	s.release()
 
-	return nil
+	return err
+}
+
+// Abort releases the backend of a stream that will not be completed, without
+// flushing the partial chunk. Chunks already sent are not waited for, and
+// further writes fail with ErrAborted. Abort does nothing if the stream has
+// been closed.
+func (s *Stream) Abort() {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = ErrAborted
+	}
+	s.mu.Unlock()
+
+	s.release()
+}
+
+// release runs the close callback of the stream once.
+func (s *Stream) release() {
+	s.closed.Do(func() {
+		go s.onclose()
+	})
 }
 
 func (s *Stream) writeChunk(ctx context.Context, cnk *Chunk, ack bool) error {
 	s.cnkCounter++
-	s.tmp.id = s.cnkCounter
+	cnk.id = s.base + s.cnkCounter
+
+	if s.dedup != nil {
+		skip, err := s.deduplicate(cnk)
+		if err != nil {
+			return err
+		}
+
+		if skip {
+			cnk.done()
+			return nil
+		}
+	}
+
+	if s.pol.Compression != "" && s.pol.Compression != CompressionNone {
+		if err := s.compressChunk(cnk); err != nil {
+			return err
+		}
+	}
+
+	if s.aead != nil {
+		if err := s.encrypt(cnk); err != nil {
+			return err
+		}
+	}
+
+	if s.striper != nil {
+		return s.stripe(ctx, cnk, ack)
+	}
+
+	return s.send(ctx, cnk, s.out, ack)
+}
+
+// send seals the chunk and sends it to the backend on out.
+func (s *Stream) send(ctx context.Context, cnk *Chunk, out chan *Chunk, ack bool) error {
+	// fail early if a previous chunk could not be written
+	s.mu.Lock()
+	err := s.err
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
 
 	cnk.upstream = s
 
+	// seal the chunk
+	alg := s.pol.Checksum
+	if alg == "" {
+		alg = DefaultChecksum
+	}
+
+	sum, err := Checksum(alg, cnk.buf)
+	if err != nil {
+		return err
+	}
+
+	cnk.sum = sum
+
+	s.mu.Lock()
+	s.sent++
+	s.inflight++
+	s.mu.Unlock()
+
 	// send chunk
-	s.out <- cnk
+	select {
+	case <-ctx.Done():
+		s.Report(ctx.Err())
+		return ctx.Err()
+	case out <- cnk:
+	}
 
 	if ack {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case err := <-s.errc:
-			if err != nil {
-				return err
-			}
-		}
+		return s.Wait(ctx)
 	}
 
 	return nil
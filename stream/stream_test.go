@@ -0,0 +1,27 @@
+package stream
+
+import "github.com/bh107/tapr/stream/policy"
+
+// custodian is the content written by the tests.
+var custodian = []byte("the tape custodian")
+
+// newTestStream returns a stream that does not wait for its chunks to be
+// acknowledged. Sealed chunks are sent to out, if given. The write policy may
+// be adjusted by configure before the stream is created.
+func newTestStream(out chan *Chunk, configure ...func(pol *policy.Policy)) *Stream {
+	pol := policy.NewDefaultPolicy()
+	pol.AcknowledgedWrite = false
+
+	for _, fn := range configure {
+		fn(pol)
+	}
+
+	s := New("test", pol)
+	if out != nil {
+		s.SetOut(out)
+	}
+
+	s.OnClose(func() {})
+
+	return s
+}
@@ -2,10 +2,13 @@ package stream
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"strings"
 	"syscall"
+	"unicode/utf8"
 )
 
 type ErrIO struct {
@@ -17,13 +20,22 @@ func (e ErrIO) Error() string {
 	return fmt.Sprintf("i/o error: %s", e.Err)
 }
 
+// CommitFunc is called by a Writer when a chunk has been written to the file
+// fname relative to the root of the media. A non-nil error fails the chunk.
+type CommitFunc func(cnk *Chunk, fname string) error
+
+// VolumeSize is the capacity of a volume; a Writer reports the volume full once
+// this many bytes are written to it.
+const VolumeSize = 1024 * 64 * 16
+
 // Writer represents a writable media.
 type Writer struct {
 	root      string
 	globalSeq int
 	total     int
 
-	errc chan error
+	errc   chan error
+	commit CommitFunc
 
 	device string
 
@@ -31,10 +43,12 @@ type Writer struct {
 	agg chan *Chunk
 }
 
-// NewWriter returns a new Writer and starts the communicating process.
-func NewWriter(root string, in chan *Chunk, agg chan *Chunk, device string) *Writer {
+// NewWriter returns a new Writer and starts the communicating process. If
+// commit is non-nil, it is called for every chunk written.
+func NewWriter(root string, in chan *Chunk, agg chan *Chunk, device string, commit CommitFunc) *Writer {
 	wr := &Writer{
-		root: root,
+		root:   root,
+		commit: commit,
 
 		// in channel for direct/exclusive access
 		in:  in,
@@ -55,7 +69,6 @@ func (wr *Writer) Errc() <-chan error {
 }
 
 func (wr *Writer) run() {
-	var err error
 	var cnk *Chunk
 
 	// Grab chunks from all streams
@@ -68,43 +81,116 @@ func (wr *Writer) run() {
 		case cnk = <-wr.agg:
 		}
 
-		wr.globalSeq++
+		if err := wr.write(cnk); err != nil {
+			wr.errc <- ErrIO{err, cnk}
 
-		// generate filename
-		fname := fmt.Sprintf("%07d-%s.cnk%07d",
-			wr.globalSeq, string(cnk.upstream.archive),
-			cnk.id,
-		)
+			if err == syscall.ENOSPC {
+				// the drive starts a new writer when a new volume is mounted
+				return
+			}
 
-		wr.total += len(cnk.buf)
-		if wr.total > (1024 * 64 * 16) {
-			wr.errc <- ErrIO{syscall.ENOSPC, cnk}
-			break
+			continue
 		}
 
-		var f *os.File
-		f, err = os.Create(path.Join(wr.root, fname))
-		if err != nil {
-			wr.errc <- ErrIO{err, cnk}
-			break
+		// report success, bypassing drive
+		upstream := cnk.upstream
+
+		// reset and return chunk to chunk pool
+		cnk.done()
+
+		upstream.Report(nil)
+	}
+}
+
+// maxNameLen is the longest archive name used in chunk file names.
+const maxNameLen = 200
+
+// fileName returns the archive name as used in chunk file names. Slashes are
+// escaped and long names truncated; the sequence number prefix keeps file
+// names unique.
+func fileName(archive string) string {
+	name := strings.Replace(archive, "/", "%2F", -1)
+	if len(name) > maxNameLen {
+		n := maxNameLen
+		for n > 0 && !utf8.RuneStart(name[n]) {
+			n--
 		}
 
-		if _, err = f.Write(cnk.buf); err != nil {
-			wr.errc <- ErrIO{err, cnk}
-			break
+		name = name[:n]
+	}
+
+	return name
+}
+
+// write writes cnk to a new file on the media, verifies it and commits it.
+func (wr *Writer) write(cnk *Chunk) error {
+	wr.globalSeq++
+
+	// generate filename
+	fname := fmt.Sprintf("%07d-%s.cnk%07d",
+		wr.globalSeq, fileName(cnk.upstream.archive),
+		cnk.id,
+	)
+
+	if cnk.meta.Shard.Parity {
+		fname = fmt.Sprintf("%07d-%s.par%07d-%d",
+			wr.globalSeq, fileName(cnk.upstream.archive),
+			cnk.meta.Shard.Stripe, cnk.meta.Shard.Index,
+		)
+	}
+
+	wr.total += len(cnk.buf)
+	if wr.total > VolumeSize {
+		return syscall.ENOSPC
+	}
+
+	fpath := path.Join(wr.root, fname)
+
+	f, err := os.Create(fpath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(cnk.buf); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// store the checksum with the file as well, such that the volume is
+	// self-describing.
+	if err := syscall.Setxattr(fpath, ChecksumXattr, []byte(cnk.sum), 0); err != nil {
+		if err != syscall.ENOTSUP {
+			return err
 		}
 
-		if err = f.Close(); err != nil {
-			wr.errc <- ErrIO{err, cnk}
-			break
+		log.Printf("writer[%v]: %s: xattrs not supported", wr.device, fname)
+	}
+
+	// read back and verify
+	if err := verifyFile(fpath, cnk.sum); err != nil {
+		return err
+	}
+
+	if wr.commit != nil {
+		if err := wr.commit(cnk, fname); err != nil {
+			return err
 		}
+	}
 
-		log.Printf("writer[%v]: succesfully wrote %s", wr.device, fname)
+	log.Printf("writer[%v]: succesfully wrote %s", wr.device, fname)
 
-		// report success (no error), bypassing drive
-		//cnk.upstream.errc <- nil
+	return nil
+}
 
-		// reset and return chunk to chunk pool
-		cnk.done()
+func verifyFile(fpath string, sum string) error {
+	buf, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return err
 	}
+
+	return Verify(sum, buf)
 }
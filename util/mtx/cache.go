@@ -0,0 +1,59 @@
+package mtx
+
+import "sync"
+
+// Cache wraps a changer and caches its status. The cached status is dropped
+// when volumes are moved or the changer takes inventory, such that the next
+// call to Status queries the changer. Callers receive a copy of the cached
+// status they may modify.
+type Cache struct {
+	Interface
+
+	mu     sync.Mutex
+	status *StatusInfo
+}
+
+// NewCache returns a caching changer wrapping chgr.
+func NewCache(chgr Interface) *Cache {
+	return &Cache{Interface: chgr}
+}
+
+// Status returns the cached status, querying the changer if there is none.
+func (c *Cache) Status() (*StatusInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.status == nil {
+		status, err := c.Interface.Status()
+		if err != nil {
+			return nil, err
+		}
+
+		c.status = status
+	}
+
+	return c.status.Copy(), nil
+}
+
+// Invalidate drops the cached status, e.g. if volumes may have been moved by
+// an operator.
+func (c *Cache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.status = nil
+}
+
+// Move moves the volume in src to dst and drops the cached status.
+func (c *Cache) Move(src, dst Element) error {
+	defer c.Invalidate()
+
+	return c.Interface.Move(src, dst)
+}
+
+// Inventory makes the changer take inventory and drops the cached status.
+func (c *Cache) Inventory() error {
+	defer c.Invalidate()
+
+	return c.Interface.Inventory()
+}
@@ -0,0 +1,74 @@
+package mtx_test
+
+import (
+	"testing"
+
+	"github.com/bh107/tapr/util/mtx"
+	"github.com/bh107/tapr/util/mtx/mock"
+)
+
+// counter counts the status queries of a changer.
+type counter struct {
+	mtx.Interface
+	n int
+}
+
+func (c *counter) Status() (*mtx.StatusInfo, error) {
+	c.n++
+	return c.Interface.Status()
+}
+
+func TestCache(t *testing.T) {
+	chgr := &counter{Interface: mock.NewWithSpec("/dev/mock", 'T', mock.DefaultSpec)}
+	cache := mtx.NewCache(chgr)
+
+	if _, err := mtx.MaxDrives(cache); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mtx.StorageSlots(cache); err != nil {
+		t.Fatal(err)
+	}
+
+	drives, err := mtx.Drives(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if chgr.n != 1 {
+		t.Fatalf("expected 1 status query, got %d", chgr.n)
+	}
+
+	// modifying the returned status must not affect the cache
+	drives[0].Vol = &mtx.Volume{Serial: "BOGUS"}
+
+	if err := mtx.Load(cache, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	drives, err = mtx.Drives(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if chgr.n != 2 {
+		t.Fatalf("expected the move to invalidate the cache, got %d status queries", chgr.n)
+	}
+
+	if drives[0].Vol == nil || drives[0].Vol.Serial != "T00000L6" || drives[0].Vol.Home != 1 {
+		t.Fatalf("expected T00000L6 from slot 1 in drive 0, got %v", drives[0].Vol)
+	}
+
+	if err := mtx.Unload(cache, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	slots, err := mtx.Slots(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slots[0].Vol == nil || slots[0].Vol.Serial != "T00000L6" {
+		t.Fatalf("expected T00000L6 back in slot 1, got %v", slots[0].Vol)
+	}
+}
@@ -1,4 +1,5 @@
-// Package mock implements a mocked library auto changer that simulates 'mtx'.
+// Package mock implements a mocked library auto changer. It also simulates the
+// commands of 'mtx'.
 package mock
 
 import (
@@ -34,11 +35,11 @@ type Spec struct {
 var serialCounter int
 var serialPrefixes = []rune{'A', 'B', 'C', 'D'}
 
+// New returns a mock library auto changer with the default spec. The serials
+// of the volumes of the first four changers have distinct prefixes; later
+// changers reuse them.
 func New(name string) *Changer {
-	if serialCounter > len(serialPrefixes)-1 {
-		panic("cannot allocate serial prefix")
-	}
-	serialPrefix := serialPrefixes[serialCounter]
+	serialPrefix := serialPrefixes[serialCounter%len(serialPrefixes)]
 	serialCounter++
 
 	return NewWithSpec(name, serialPrefix, DefaultSpec)
@@ -91,7 +92,7 @@ func NewWithSpec(name string, serialPrefix rune, spec *Spec) *Changer {
 		if i == spec.NumStorageSlots+spec.NumMailSlots-1 {
 			chgr.slots[i].Vol = &mtx.Volume{
 				Serial: fmt.Sprintf("%c%05dL6", serialPrefix, spec.NumVolumes),
-				Home:   i,
+				Home:   i + 1,
 			}
 		}
 	}
@@ -113,43 +114,147 @@ func mtxSlotString(slot *mtx.Slot) string {
 	return fmt.Sprintf("Full :VolumeTag=%s", slot.Vol.Serial)
 }
 
-func (chgr *Changer) load(slotnum int, drivenum int) error {
-	slot := chgr.slots[slotnum-1]
-	chgr.drives[drivenum].Vol = slot.Vol
-	slot.Vol = nil
+// slot returns the slot of element e.
+func (chgr *Changer) slot(e mtx.Element) (*mtx.Slot, error) {
+	if e.IsDrive() {
+		if e.Num < 0 || e.Num >= len(chgr.drives) {
+			return nil, fmt.Errorf("mtx/mock: no such drive: %d", e.Num)
+		}
+
+		return chgr.drives[e.Num], nil
+	}
+
+	if e.Num < 1 || e.Num > len(chgr.slots) {
+		return nil, fmt.Errorf("mtx/mock: no such slot: %d", e.Num)
+	}
+
+	return chgr.slots[e.Num-1], nil
+}
+
+// Move simulates moving the volume in src to dst.
+func (chgr *Changer) Move(src, dst mtx.Element) error {
+	from, err := chgr.slot(src)
+	if err != nil {
+		return err
+	}
+
+	to, err := chgr.slot(dst)
+	if err != nil {
+		return err
+	}
+
+	if from.Vol == nil {
+		return fmt.Errorf("unable to move volume: no volume in %v", src)
+	}
+
+	if to.Vol != nil {
+		return fmt.Errorf("unable to move volume: %v already occupied", dst)
+	}
+
+	to.Vol = from.Vol
+	from.Vol = nil
+
+	if !dst.IsDrive() {
+		to.Vol.Home = to.Num
+	}
 
 	return nil
 }
 
-func (chgr *Changer) unload(slotnum int, drivenum int) error {
-	drv := chgr.drives[drivenum]
-	if slotnum == 0 {
-		slotnum = drv.Vol.Home
+// mailSlot returns mail slot number num.
+func (chgr *Changer) mailSlot(num int) (*mtx.Slot, error) {
+	slot, err := chgr.slot(mtx.SlotElement(num))
+	if err != nil {
+		return nil, err
 	}
 
-	chgr.slots[slotnum-1].Vol = drv.Vol
-	drv.Vol = nil
+	if slot.Type != mtx.MailSlot {
+		return nil, fmt.Errorf("mtx/mock: slot %d is not a mail slot", num)
+	}
+
+	return slot, nil
+}
+
+// Insert simulates an operator putting the volume identified by serial in mail
+// slot num. A volume without a barcode label has an empty serial.
+func (chgr *Changer) Insert(num int, serial string) error {
+	slot, err := chgr.mailSlot(num)
+	if err != nil {
+		return err
+	}
+
+	if slot.Vol != nil {
+		return fmt.Errorf("mtx/mock: mail slot %d already occupied", num)
+	}
+
+	slot.Vol = &mtx.Volume{Serial: serial, Home: num}
 
 	return nil
 }
 
-func (chgr *Changer) transfer(from, to int) error {
-	from -= 1
-	to -= 1
-	if chgr.slots[from].Vol == nil {
-		return errors.New("unable to transfer volume: no volume in slot")
+// Remove simulates an operator taking the volume out of mail slot num.
+func (chgr *Changer) Remove(num int) (*mtx.Volume, error) {
+	slot, err := chgr.mailSlot(num)
+	if err != nil {
+		return nil, err
 	}
 
-	if chgr.slots[to].Vol != nil {
-		return errors.New("unable to transfer volume: slot already occupied")
+	if slot.Vol == nil {
+		return nil, fmt.Errorf("mtx/mock: mail slot %d is empty", num)
+	}
+
+	vol := slot.Vol
+	slot.Vol = nil
+
+	return vol, nil
+}
+
+// Status returns the simulated status.
+func (chgr *Changer) Status() (*mtx.StatusInfo, error) {
+	status := &mtx.StatusInfo{
+		MaxDrives:       chgr.numDrives,
+		NumSlots:        chgr.numStorageSlots + chgr.numMailSlots,
+		NumStorageSlots: chgr.numStorageSlots,
+		NumMailSlots:    chgr.numMailSlots,
+
+		Drives: chgr.drives,
+		Slots:  chgr.slots,
 	}
 
-	chgr.slots[to].Vol = chgr.slots[from].Vol
-	chgr.slots[from].Vol = nil
+	return status.Copy(), nil
+}
 
+// Inventory is a no-op; the mock changer always knows its volumes.
+func (chgr *Changer) Inventory() error {
 	return nil
 }
 
+// Inquiry returns the identification of the mock changer.
+func (chgr *Changer) Inquiry() (*mtx.InquiryInfo, error) {
+	return &mtx.InquiryInfo{
+		Vendor:   "TAPR",
+		Product:  "MOCK CHANGER",
+		Revision: "0001",
+	}, nil
+}
+
+func (chgr *Changer) unload(slotnum int, drivenum int) error {
+	if slotnum == 0 {
+		drv, err := chgr.slot(mtx.DriveElement(drivenum))
+		if err != nil {
+			return err
+		}
+
+		if drv.Vol == nil {
+			return errors.New("unable to unload volume: drive is empty")
+		}
+
+		slotnum = drv.Vol.Home
+	}
+
+	return chgr.Move(mtx.DriveElement(drivenum), mtx.SlotElement(slotnum))
+}
+
 // Do simulates performaing the given mtx command.
 func (chgr *Changer) Do(args ...string) ([]byte, error) {
 	if len(args) < 1 {
@@ -178,11 +283,11 @@ func (chgr *Changer) Do(args ...string) ([]byte, error) {
 
 	switch cmd {
 	case "load":
-		return nil, chgr.load(a, b)
+		return nil, chgr.Move(mtx.SlotElement(a), mtx.DriveElement(b))
 	case "unload":
 		return nil, chgr.unload(a, b)
 	case "transfer":
-		return nil, chgr.transfer(a, b)
+		return nil, chgr.Move(mtx.SlotElement(a), mtx.SlotElement(b))
 	}
 
 	return nil, errors.New("mtx/mock: unknown or unsupported mtx command")
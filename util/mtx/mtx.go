@@ -1,9 +1,12 @@
 // Package mtx provides functions for working with an automated library
 // changer.
 //
-// It includes two subpackages, scsi and mock. scsi calls the 'mtx' program and
-// mock simulates the use of 'mtx' if no library changer is available doing
-// testing/development.
+// It includes three subpackages, scsi, sgio and mock. scsi calls the 'mtx'
+// program, sgio issues the SCSI media changer commands directly and mock
+// simulates a library changer if none is available doing testing/development.
+//
+// Querying the changer involves the robot and may be slow. Cache wraps a
+// changer and reuses its status until volumes are moved.
 package mtx
 
 import (
@@ -11,8 +14,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"regexp"
-	"strconv"
+	"strings"
 )
 
 // SlotType defines the type of slot.
@@ -25,20 +27,21 @@ const (
 	MailSlot
 )
 
-var (
-	hdrRegexp          = regexp.MustCompile(`\s*Storage Changer\s*(.*):(\d*) Drives, (\d*) Slots \((\d*) Import/Export \)`)
-	driveRegexp        = regexp.MustCompile(`Data Transfer Element (\d*):(.*)`)
-	driveElementRegexp = regexp.MustCompile(`Full \(Storage Element (\d*) Loaded\):VolumeTag = (.*)`)
-	slotRegexp         = regexp.MustCompile(`\s*Storage Element (\d*):(.*)`)
-	mailSlotRegexp     = regexp.MustCompile(`\s*Storage Element (\d*) IMPORT/EXPORT:(.*)`)
-	slotElementRegexp  = regexp.MustCompile(`Full :VolumeTag=(.*)`)
-)
-
 // The Interface interface describes operations supported by a library auto
 // changer.
 type Interface interface {
-	// Do performs the raw operation identified by cmd.
-	Do(args ...string) ([]byte, error)
+	// Status returns the status of all drives and slots in the library.
+	Status() (*StatusInfo, error)
+
+	// Move moves the volume in the src element to the empty dst element.
+	Move(src, dst Element) error
+
+	// Inventory makes the changer rescan its elements, e.g. by reading the
+	// barcodes of all volumes.
+	Inventory() error
+
+	// Inquiry identifies the changer.
+	Inquiry() (*InquiryInfo, error)
 }
 
 type StatusInfo struct {
@@ -49,14 +52,48 @@ type StatusInfo struct {
 
 	Drives []*Slot
 	Slots  []*Slot
+
+	// Warnings holds lines of the status that were not understood.
+	Warnings []string
+}
+
+// Copy returns a deep copy of the status.
+func (status *StatusInfo) Copy() *StatusInfo {
+	cp := *status
+
+	cp.Drives = copySlots(status.Drives)
+	cp.Slots = copySlots(status.Slots)
+	cp.Warnings = append([]string(nil), status.Warnings...)
+
+	return &cp
+}
+
+func copySlots(slots []*Slot) []*Slot {
+	cp := make([]*Slot, len(slots))
+	for i, slot := range slots {
+		tmp := *slot
+		if slot.Vol != nil {
+			vol := *slot.Vol
+			tmp.Vol = &vol
+		}
+
+		cp[i] = &tmp
+	}
+
+	return cp
 }
 
 // Volume represents a tape.
 type Volume struct {
-	// The VOLSER of the tape.
+	// The VOLSER of the tape. It is empty if the volume has no barcode label
+	// or the changer did not report it.
 	Serial string
 
-	// The home slot of this volume.
+	// AltSerial is the alternate volume tag, if reported.
+	AltSerial string
+
+	// The home slot of this volume, or 0 if the changer does not know where
+	// a volume in a drive was loaded from.
 	Home int
 }
 
@@ -75,6 +112,9 @@ type Slot struct {
 
 	// If a volume is in the slot, Vol will be non-nil.
 	Vol *Volume
+
+	// Addr is the SCSI element address of the slot, if known.
+	Addr int
 }
 
 // String returns a textual representation of the slot.
@@ -82,319 +122,261 @@ func (slot *Slot) String() string {
 	return fmt.Sprintf("%s[%d]: %s", slot.Type, slot.Num, slot.Vol)
 }
 
+// Element returns the element identifying the slot.
+func (slot *Slot) Element() Element {
+	return Element{Type: slot.Type, Num: slot.Num}
+}
+
+// Element identifies a drive or slot in the library. Drives are numbered from
+// 0 and storage slots from 1 with the mail slots following the storage slots,
+// as done by 'mtx'.
+type Element struct {
+	Type SlotType
+	Num  int
+}
+
+// DriveElement returns the element of drive number num.
+func DriveElement(num int) Element {
+	return Element{Type: DataTransferSlot, Num: num}
+}
+
+// SlotElement returns the element of storage or mail slot number num.
+func SlotElement(num int) Element {
+	return Element{Type: StorageSlot, Num: num}
+}
+
+// IsDrive returns true if the element is a data transfer element.
+func (e Element) IsDrive() bool {
+	return e.Type == DataTransferSlot
+}
+
+// String returns a textual representation of the element.
+func (e Element) String() string {
+	return fmt.Sprintf("%s[%d]", e.Type, e.Num)
+}
+
+// InquiryInfo identifies a library changer.
+type InquiryInfo struct {
+	Vendor   string
+	Product  string
+	Revision string
+}
+
 // Load drive with the volume from slot.
 func Load(chgr Interface, slotnum, drivenum int) error {
-	_, err := chgr.Do(
-		"load", strconv.Itoa(slotnum), strconv.Itoa(drivenum),
-	)
-
-	return err
+	return chgr.Move(SlotElement(slotnum), DriveElement(drivenum))
 }
 
-// Unload a volume from a drive and return it to a slot.
+// Unload a volume from a drive and return it to a slot. If slotnum is 0, the
+// volume is returned to its home slot.
 func Unload(chgr Interface, slotnum, drivenum int) error {
-	_, err := chgr.Do(
-		"unload", strconv.Itoa(slotnum), strconv.Itoa(drivenum),
-	)
+	if slotnum == 0 {
+		status, err := chgr.Status()
+		if err != nil {
+			return err
+		}
 
-	return err
+		for _, slot := range status.Drives {
+			if slot.Num == drivenum && slot.Vol != nil {
+				slotnum = slot.Vol.Home
+			}
+		}
+
+		if slotnum == 0 {
+			return fmt.Errorf("unknown home slot of volume in drive %d", drivenum)
+		}
+	}
+
+	return chgr.Move(DriveElement(drivenum), SlotElement(slotnum))
 }
 
 // Transfer moves a volume from one slot to another.
-func Transfer(chgr Interface, slotnum, drivenum int) error {
-	_, err := chgr.Do(
-		"transfer", strconv.Itoa(slotnum), strconv.Itoa(drivenum),
-	)
-
-	return err
+func Transfer(chgr Interface, from, to int) error {
+	return chgr.Move(SlotElement(from), SlotElement(to))
 }
 
 // MaxDrives returns the number of data transfer elements. Note that this
 // does not necessary correspond to the number of actual drives present in
 // the system.
 func MaxDrives(chgr Interface) (int, error) {
-	status, err := chgr.Do("status")
-	if err != nil {
-		return -1, err
-	}
-
-	params, err := params(status)
+	status, err := chgr.Status()
 	if err != nil {
 		return -1, err
 	}
 
-	return params["maxDrives"], nil
+	return status.MaxDrives, nil
 }
 
 // NumSlots returns the number of storage and mail slots.
 func NumSlots(chgr Interface) (int, error) {
-	status, err := chgr.Do("status")
-	if err != nil {
-		return -1, err
-	}
-
-	params, err := params(status)
+	status, err := chgr.Status()
 	if err != nil {
 		return -1, err
 	}
 
-	return params["numSlots"], nil
+	return status.NumSlots, nil
 }
 
 // NumStorageSlots returns the number of storage slots.
 func NumStorageSlots(chgr Interface) (int, error) {
-	status, err := chgr.Do("status")
+	status, err := chgr.Status()
 	if err != nil {
 		return -1, err
 	}
 
-	params, err := params(status)
-	if err != nil {
-		return -1, err
-	}
-
-	return params["numSlots"] - params["numMailSlots"], nil
+	return status.NumStorageSlots, nil
 }
 
 // NumMailSlots returns the number of mail slots.
 func NumMailSlots(chgr Interface) (int, error) {
-	status, err := chgr.Do("status")
+	status, err := chgr.Status()
 	if err != nil {
 		return -1, err
 	}
 
-	params, err := params(status)
-	if err != nil {
-		return -1, err
-	}
-
-	return params["numMailSlots"], nil
+	return status.NumMailSlots, nil
 }
 
 // Drives returns a slice of data transfer elements. Note that data transfer
 // slots typically start with slot id 0.
 func Drives(chgr Interface) ([]*Slot, error) {
-	status, err := chgr.Do("status")
-	if err != nil {
-		return nil, err
-	}
-
-	elements, err := elements(status)
+	status, err := chgr.Status()
 	if err != nil {
 		return nil, err
 	}
 
-	return elements["transfer"], nil
+	return status.Drives, nil
 }
 
 // Slots returns a slice of storage and mail elements. Note that storage
 // slots typically start with slot id 1 and not 0.
 func Slots(chgr Interface) ([]*Slot, error) {
-	status, err := chgr.Do("status")
-	if err != nil {
-		return nil, err
-	}
-
-	elems, err := elements(status)
+	status, err := chgr.Status()
 	if err != nil {
 		return nil, err
 	}
 
-	return append(elems["storage"], elems["mail"]...), nil
+	return status.Slots, nil
 }
 
 // StorageSlots returns a slice of storage elements. Note that storage
 // slots typically start with slot id 1 and not 0.
 func StorageSlots(chgr Interface) ([]*Slot, error) {
-	status, err := chgr.Do("status")
-	if err != nil {
-		return nil, err
-	}
-
-	elems, err := elements(status)
-	if err != nil {
-		return nil, err
-	}
-
-	return elems["storage"], nil
+	return slotsOfType(chgr, StorageSlot)
 }
 
 // MailSlots returns a slice of storage elements. Note that mail slots
 // typically start with slot ids counting from the id of the last storage
 // slot.
 func MailSlots(chgr Interface) ([]*Slot, error) {
-	status, err := chgr.Do("status")
+	return slotsOfType(chgr, MailSlot)
+}
+
+func slotsOfType(chgr Interface, typ SlotType) ([]*Slot, error) {
+	status, err := chgr.Status()
 	if err != nil {
 		return nil, err
 	}
 
-	elems, err := elements(status)
-	if err != nil {
-		return nil, err
+	slots := make([]*Slot, 0)
+	for _, slot := range status.Slots {
+		if slot.Type == typ {
+			slots = append(slots, slot)
+		}
 	}
 
-	return elems["mail"], nil
+	return slots, nil
 }
 
 // Status returns a Status structure with combined information about the status
 // of the library.
 func Status(chgr Interface) (*StatusInfo, error) {
-	status, err := chgr.Do("status")
-	if err != nil {
-		return nil, err
-	}
-
-	params, err := params(status)
-	elems, err := elements(status)
-
-	return &StatusInfo{
-		MaxDrives:       params["maxDrives"],
-		NumSlots:        params["numSlots"],
-		NumStorageSlots: params["numSlots"] - params["numMailSlots"],
-		NumMailSlots:    params["numMailSlots"],
-
-		Drives: elems["transfer"],
-		Slots:  append(elems["storage"], elems["mail"]...),
-	}, nil
+	return chgr.Status()
 }
 
-func elements(status []byte) (map[string][]*Slot, error) {
-	elements := map[string][]*Slot{
-		"transfer": make([]*Slot, 0),
-		"storage":  make([]*Slot, 0),
-		"mail":     make([]*Slot, 0),
-	}
-
-	scanner := bufio.NewScanner(bytes.NewReader(status))
+// ParseInquiry parses the output of 'mtx inquiry'.
+func ParseInquiry(out []byte) (*InquiryInfo, error) {
+	info := &InquiryInfo{}
 
-	// skip header
-	scanner.Scan()
+	fields := map[string]*string{
+		"Vendor ID":  &info.Vendor,
+		"Product ID": &info.Product,
+		"Revision":   &info.Revision,
+	}
 
-	// scan elements
-	var matches []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
 	for scanner.Scan() {
-		line := scanner.Text()
-
-		// match data transfer elements
-		matches = driveRegexp.FindStringSubmatch(line)
-		if matches != nil {
-			elemnum, err := strconv.Atoi(matches[1])
-			if err != nil {
-				return nil, err
-			}
-
-			slot := &Slot{Num: elemnum, Type: DataTransferSlot}
-
-			if matches[2] != "Empty" {
-				matches = driveElementRegexp.FindStringSubmatch(matches[2])
-				if matches == nil {
-					return nil, errors.New("failed to parse transfer element")
-				}
-
-				home, err := strconv.Atoi(matches[1])
-				if err != nil {
-					return nil, err
-				}
-
-				slot.Vol = &Volume{Serial: matches[2], Home: home}
-			}
-
-			elements["transfer"] = append(elements["transfer"], slot)
-
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
 			continue
 		}
 
-		// match storage elements
-		matches = slotRegexp.FindStringSubmatch(line)
-		if matches != nil {
-			elemnum, err := strconv.Atoi(matches[1])
-			if err != nil {
-				return nil, err
-			}
-
-			slot := &Slot{Num: elemnum, Type: StorageSlot}
-
-			if matches[2] != "Empty" {
-				match := slotElementRegexp.FindStringSubmatch(matches[2])
-				if match == nil {
-					return nil, errors.New("failed to parse slot element: " + matches[2])
-				}
-
-				slot.Vol = &Volume{Serial: match[1], Home: elemnum}
-			}
-
-			elements["storage"] = append(elements["storage"], slot)
-
-			continue
+		if field, ok := fields[strings.TrimSpace(parts[0])]; ok {
+			*field = strings.TrimSpace(strings.Trim(strings.TrimSpace(parts[1]), "'"))
 		}
-
-		// match mailslot elements
-		matches = mailSlotRegexp.FindStringSubmatch(line)
-		if matches != nil {
-			elemnum, err := strconv.Atoi(matches[1])
-			if err != nil {
-				return nil, err
-			}
-
-			slot := &Slot{Num: elemnum, Type: MailSlot}
-
-			if matches[2] != "Empty" {
-				matches = slotElementRegexp.FindStringSubmatch(matches[2])
-				if matches == nil {
-					return nil, errors.New("failed to parse slot element")
-				}
-
-				slot.Vol = &Volume{Serial: matches[1], Home: elemnum}
-			}
-
-			elements["mail"] = append(elements["mail"], slot)
-
-			continue
-		}
-
-		return nil, errors.New("failed to parse slot")
 	}
 
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
 
-	return elements, nil
-}
+	if info.Vendor == "" && info.Product == "" {
+		return nil, errors.New("failed to parse inquiry data")
+	}
 
-func params(status []byte) (map[string]int, error) {
-	params := make(map[string]int)
+	return info, nil
+}
 
-	scanner := bufio.NewScanner(bytes.NewReader(status))
+// Format returns status as formatted by 'mtx status'.
+func Format(name string, status *StatusInfo) []byte {
+	var buf bytes.Buffer
 
-	var err error
-	if scanner.Scan() {
-		line := scanner.Text()
+	fmt.Fprintf(&buf, "  Storage Changer %s:%d Drives, %d Slots ( %d Import/Export )\n",
+		name, status.MaxDrives, status.NumSlots, status.NumMailSlots,
+	)
 
-		matches := hdrRegexp.FindStringSubmatch(line)
-		if matches == nil {
-			return nil, errors.New("failed to match mtx status header")
+	for _, slot := range status.Drives {
+		if slot.Vol == nil {
+			fmt.Fprintf(&buf, "Data Transfer Element %d:Empty\n", slot.Num)
+			continue
 		}
 
-		params["maxDrives"], err = strconv.Atoi(matches[2])
-		if err != nil {
-			return nil, err
+		if slot.Vol.Home == 0 {
+			fmt.Fprintf(&buf, "Data Transfer Element %d:Full (Unknown Storage Element Loaded)", slot.Num)
+		} else {
+			fmt.Fprintf(&buf, "Data Transfer Element %d:Full (Storage Element %d Loaded)", slot.Num, slot.Vol.Home)
 		}
 
-		params["numSlots"], err = strconv.Atoi(matches[3])
-		if err != nil {
-			return nil, err
+		formatTags(&buf, slot.Vol, " = ")
+	}
+
+	for _, slot := range status.Slots {
+		extra := ""
+		if slot.Type == MailSlot {
+			extra = " IMPORT/EXPORT"
 		}
 
-		params["numMailSlots"], err = strconv.Atoi(matches[4])
-		if err != nil {
-			return nil, err
+		if slot.Vol == nil {
+			fmt.Fprintf(&buf, "      Storage Element %d%s:Empty\n", slot.Num, extra)
+			continue
 		}
+
+		fmt.Fprintf(&buf, "      Storage Element %d%s:Full ", slot.Num, extra)
+		formatTags(&buf, slot.Vol, "=")
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	return buf.Bytes()
+}
+
+// formatTags writes the volume tags of vol and ends the line.
+func formatTags(buf *bytes.Buffer, vol *Volume, sep string) {
+	if vol.Serial != "" {
+		fmt.Fprintf(buf, ":VolumeTag%s%s", sep, vol.Serial)
+	}
+
+	if vol.AltSerial != "" {
+		fmt.Fprintf(buf, ":AlternateVolumeTag%s%s", sep, vol.AltSerial)
 	}
 
-	return params, nil
+	buf.WriteByte('\n')
 }
@@ -0,0 +1,219 @@
+package mtx
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	hdrRegexp    = regexp.MustCompile(`^\s*Storage Changer\s*(.*?)\s*:\s*(\d+)\s+Drives?\s*,\s*(\d+)\s+Slots?\s*\(\s*(\d+)\s+Import/Export\s*\)`)
+	driveRegexp  = regexp.MustCompile(`^\s*Data Transfer Element\s+(\d+)\s*:\s*(.*?)\s*$`)
+	slotRegexp   = regexp.MustCompile(`^\s*Storage Element\s+(\d+)(\s+IMPORT/EXPORT)?\s*:\s*(.*?)\s*$`)
+	loadedRegexp = regexp.MustCompile(`^Full\s*\(\s*(?:Storage Element\s+(\d+)|Unknown Storage Element)\s+Loaded\s*\)(.*)$`)
+	tagRegexp    = regexp.MustCompile(`^:\s*(VolumeTag|AlternateVolumeTag)\s*=\s*([^:]*)`)
+)
+
+// ParseStatus parses the output of 'mtx status'. Lines that are not
+// understood, e.g. vendor specific messages or elements in an unknown state,
+// are skipped and recorded in the Warnings of the status. An error is only
+// returned if the output does not describe a library at all.
+func ParseStatus(out []byte) (*StatusInfo, error) {
+	status := &StatusInfo{
+		Drives: make([]*Slot, 0),
+		Slots:  make([]*Slot, 0),
+	}
+
+	warn := func(format string, args ...interface{}) {
+		status.Warnings = append(status.Warnings, fmt.Sprintf(format, args...))
+	}
+
+	var header bool
+	var numMail int
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if matches := hdrRegexp.FindStringSubmatch(line); matches != nil {
+			if header {
+				warn("duplicate header: %q", line)
+				continue
+			}
+
+			header = true
+
+			var err error
+			if status.MaxDrives, err = strconv.Atoi(matches[2]); err != nil {
+				return nil, err
+			}
+
+			if status.NumSlots, err = strconv.Atoi(matches[3]); err != nil {
+				return nil, err
+			}
+
+			if status.NumMailSlots, err = strconv.Atoi(matches[4]); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if matches := driveRegexp.FindStringSubmatch(line); matches != nil {
+			slot, err := parseDrive(matches[1], matches[2])
+			if err != nil {
+				warn("%v: %q", err, line)
+				continue
+			}
+
+			status.Drives = append(status.Drives, slot)
+
+			continue
+		}
+
+		if matches := slotRegexp.FindStringSubmatch(line); matches != nil {
+			slot, err := parseSlot(matches[1], matches[3])
+			if err != nil {
+				warn("%v: %q", err, line)
+				continue
+			}
+
+			if matches[2] != "" {
+				slot.Type = MailSlot
+				numMail++
+			}
+
+			status.Slots = append(status.Slots, slot)
+
+			continue
+		}
+
+		warn("unknown line: %q", line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !header {
+		if len(status.Drives) == 0 && len(status.Slots) == 0 {
+			return nil, errors.New("failed to parse mtx status: no header or elements")
+		}
+
+		warn("missing header, counting elements")
+
+		status.MaxDrives = len(status.Drives)
+		status.NumSlots = len(status.Slots)
+		status.NumMailSlots = numMail
+	}
+
+	status.NumStorageSlots = status.NumSlots - status.NumMailSlots
+
+	if len(status.Drives) != status.MaxDrives {
+		warn("header reports %d drives, found %d", status.MaxDrives, len(status.Drives))
+	}
+
+	if len(status.Slots) != status.NumSlots {
+		warn("header reports %d slots, found %d", status.NumSlots, len(status.Slots))
+	}
+
+	return status, nil
+}
+
+// parseDrive parses the state of a data transfer element, e.g.
+//
+//	Empty
+//	Full (Storage Element 5 Loaded):VolumeTag = S00004L6
+//	Full (Unknown Storage Element Loaded):VolumeTag = S00004L6
+func parseDrive(num string, state string) (*Slot, error) {
+	n, err := strconv.Atoi(num)
+	if err != nil {
+		return nil, err
+	}
+
+	slot := &Slot{Num: n, Type: DataTransferSlot}
+
+	if strings.HasPrefix(state, "Empty") {
+		return slot, nil
+	}
+
+	matches := loadedRegexp.FindStringSubmatch(state)
+	if matches == nil {
+		return nil, errors.New("failed to parse transfer element")
+	}
+
+	slot.Vol = &Volume{}
+
+	// the home slot is unknown if the changer lost track of it
+	if matches[1] != "" {
+		if slot.Vol.Home, err = strconv.Atoi(matches[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := parseTags(slot.Vol, matches[2]); err != nil {
+		return nil, err
+	}
+
+	return slot, nil
+}
+
+// parseSlot parses the state of a storage or import/export element, e.g.
+//
+//	Empty
+//	Full :VolumeTag=S00004L6
+//	Full :VolumeTag=S00004L6:AlternateVolumeTag=A00004
+func parseSlot(num string, state string) (*Slot, error) {
+	n, err := strconv.Atoi(num)
+	if err != nil {
+		return nil, err
+	}
+
+	slot := &Slot{Num: n, Type: StorageSlot}
+
+	if strings.HasPrefix(state, "Empty") {
+		return slot, nil
+	}
+
+	if !strings.HasPrefix(state, "Full") {
+		return nil, errors.New("failed to parse slot element")
+	}
+
+	slot.Vol = &Volume{Home: n}
+
+	if err := parseTags(slot.Vol, strings.TrimPrefix(state, "Full")); err != nil {
+		return nil, err
+	}
+
+	return slot, nil
+}
+
+// parseTags sets the volume tags of vol from a sequence of ':VolumeTag=...'
+// and ':AlternateVolumeTag=...' fields. Both may be missing if the volume has
+// no barcode label.
+func parseTags(vol *Volume, tags string) error {
+	for tags = strings.TrimSpace(tags); tags != ""; tags = strings.TrimSpace(tags) {
+		matches := tagRegexp.FindStringSubmatch(tags)
+		if matches == nil {
+			return errors.New("failed to parse volume tag")
+		}
+
+		tag := strings.TrimSpace(matches[2])
+		if matches[1] == "VolumeTag" {
+			vol.Serial = tag
+		} else {
+			vol.AltSerial = tag
+		}
+
+		tags = tags[len(matches[0]):]
+	}
+
+	return nil
+}
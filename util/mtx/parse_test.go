@@ -0,0 +1,239 @@
+package mtx
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// vol describes an expected volume; an empty serial means an empty element.
+type vol struct {
+	serial string
+	alt    string
+	home   int
+}
+
+func TestParseStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		input   string
+		err     bool
+
+		maxDrives, numSlots, numMailSlots int
+		numWarnings                       int
+
+		drives map[int]vol
+		slots  map[int]vol
+		mail   []int
+	}{
+		{
+			name:      "mtx",
+			fixture:   "mtx.out",
+			maxDrives: 20, numSlots: 304, numMailSlots: 4,
+			drives: map[int]vol{
+				0: {serial: "S00004L6", home: 5},
+				1: {},
+			},
+			slots: map[int]vol{
+				1:   {serial: "S00000L6", home: 1},
+				5:   {},
+				300: {serial: "CLN000L1", home: 300},
+				304: {serial: "S00003L6", home: 304},
+			},
+			mail: []int{301, 302, 303, 304},
+		},
+		{
+			name:      "ibm",
+			fixture:   "mtx-ibm.out",
+			maxDrives: 2, numSlots: 12, numMailSlots: 2,
+			drives: map[int]vol{
+				0: {serial: "A00004L5", home: 4},
+				1: {},
+			},
+			slots: map[int]vol{
+				1:  {serial: "A00001L5", home: 1},
+				4:  {},
+				10: {serial: "CLNU01L1", home: 10},
+				11: {},
+				12: {serial: "A00099L5", home: 12},
+			},
+			mail: []int{11, 12},
+		},
+		{
+			name:      "quantum",
+			fixture:   "mtx-quantum.out",
+			maxDrives: 2, numSlots: 8, numMailSlots: 1,
+			drives: map[int]vol{
+				// unknown home slot and missing volume tag
+				0: {serial: "000105L6", home: 0},
+				1: {serial: "", home: 2},
+			},
+			slots: map[int]vol{
+				1: {serial: "000101L6", alt: "Q101", home: 1},
+				3: {serial: "", home: 3},
+				4: {serial: "000104L6", home: 4},
+			},
+			mail: []int{8},
+		},
+		{
+			name:      "hp",
+			fixture:   "mtx-hp.out",
+			maxDrives: 1, numSlots: 6, numMailSlots: 1,
+
+			// request sense message, exception element and the resulting
+			// slot count mismatch
+			numWarnings: 3,
+
+			drives: map[int]vol{
+				0: {serial: "HPA003L4", alt: "HP-0003", home: 3},
+			},
+			slots: map[int]vol{
+				1: {serial: "HPA001L4", home: 1},
+				3: {},
+			},
+			mail: []int{6},
+		},
+		{
+			name: "no header",
+			input: "Data Transfer Element 0:Empty\n" +
+				"      Storage Element 1:Full :VolumeTag=S00000L6\n" +
+				"      Storage Element 2 IMPORT/EXPORT:Empty\n",
+			maxDrives: 1, numSlots: 2, numMailSlots: 1,
+			numWarnings: 1,
+			drives:      map[int]vol{0: {}},
+			slots:       map[int]vol{1: {serial: "S00000L6", home: 1}},
+			mail:        []int{2},
+		},
+		{
+			name:  "garbage",
+			input: "mtx: cannot open SCSI device '/dev/sg9'\n",
+			err:   true,
+		},
+		{
+			name: "empty",
+			err:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		input := []byte(tt.input)
+		if tt.fixture != "" {
+			var err error
+			input, err = ioutil.ReadFile(filepath.Join("..", "..", "fixtures", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		status, err := ParseStatus(input)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tt.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if status.MaxDrives != tt.maxDrives || status.NumSlots != tt.numSlots || status.NumMailSlots != tt.numMailSlots {
+			t.Errorf("%s: expected %d drives, %d slots and %d mail slots, got %d, %d and %d", tt.name,
+				tt.maxDrives, tt.numSlots, tt.numMailSlots,
+				status.MaxDrives, status.NumSlots, status.NumMailSlots,
+			)
+		}
+
+		if status.NumStorageSlots != tt.numSlots-tt.numMailSlots {
+			t.Errorf("%s: expected %d storage slots, got %d", tt.name, tt.numSlots-tt.numMailSlots, status.NumStorageSlots)
+		}
+
+		if len(status.Warnings) != tt.numWarnings {
+			t.Errorf("%s: expected %d warnings, got %q", tt.name, tt.numWarnings, status.Warnings)
+		}
+
+		check := func(slots []*Slot, num int, want vol) {
+			for _, slot := range slots {
+				if slot.Num != num {
+					continue
+				}
+
+				if slot.Vol == nil {
+					if want != (vol{}) {
+						t.Errorf("%s: expected %+v in element %d, got empty", tt.name, want, num)
+					}
+
+					return
+				}
+
+				got := vol{serial: slot.Vol.Serial, alt: slot.Vol.AltSerial, home: slot.Vol.Home}
+				if got != want {
+					t.Errorf("%s: expected %+v in element %d, got %+v", tt.name, want, num, got)
+				}
+
+				return
+			}
+
+			t.Errorf("%s: missing element %d", tt.name, num)
+		}
+
+		for num, want := range tt.drives {
+			check(status.Drives, num, want)
+		}
+
+		for num, want := range tt.slots {
+			check(status.Slots, num, want)
+		}
+
+		var mail []int
+		for _, slot := range status.Slots {
+			if slot.Type == MailSlot {
+				mail = append(mail, slot.Num)
+			}
+		}
+
+		if len(mail) != len(tt.mail) {
+			t.Errorf("%s: expected mail slots %v, got %v", tt.name, tt.mail, mail)
+			continue
+		}
+
+		for i := range mail {
+			if mail[i] != tt.mail[i] {
+				t.Errorf("%s: expected mail slots %v, got %v", tt.name, tt.mail, mail)
+				break
+			}
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	input, err := ioutil.ReadFile(filepath.Join("..", "..", "fixtures", "mtx-quantum.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := ParseStatus(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// formatting and parsing again must preserve the status
+	again, err := ParseStatus(Format("/dev/sg5", status))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(again.Warnings) > 0 {
+		t.Fatalf("unexpected warnings: %q", again.Warnings)
+	}
+
+	for i, slot := range append(status.Drives, status.Slots...) {
+		other := append(again.Drives, again.Slots...)[i]
+		if slot.String() != other.String() || (slot.Vol != nil && *slot.Vol != *other.Vol) {
+			t.Errorf("expected %v, got %v", slot, other)
+		}
+	}
+}
@@ -4,8 +4,12 @@ package scsi
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os/exec"
+	"strconv"
+
+	"github.com/bh107/tapr/util/mtx"
 )
 
 // Changer represents a library changer managed by the 'mtx' program.
@@ -30,6 +34,54 @@ func (chgr *Changer) Do(args ...string) ([]byte, error) {
 	return run(exec.Command(chgr.prog, params...))
 }
 
+// Status runs 'mtx status' and parses the output.
+func (chgr *Changer) Status() (*mtx.StatusInfo, error) {
+	out, err := chgr.Do("status")
+	if err != nil {
+		return nil, err
+	}
+
+	return mtx.ParseStatus(out)
+}
+
+// Move moves a volume using the 'load', 'unload' or 'transfer' commands
+// depending on the type of the elements.
+func (chgr *Changer) Move(src, dst mtx.Element) error {
+	var args []string
+
+	switch {
+	case !src.IsDrive() && dst.IsDrive():
+		args = []string{"load", strconv.Itoa(src.Num), strconv.Itoa(dst.Num)}
+	case src.IsDrive() && !dst.IsDrive():
+		args = []string{"unload", strconv.Itoa(dst.Num), strconv.Itoa(src.Num)}
+	case !src.IsDrive() && !dst.IsDrive():
+		args = []string{"transfer", strconv.Itoa(src.Num), strconv.Itoa(dst.Num)}
+	default:
+		return errors.New("mtx/scsi: cannot move volumes between drives")
+	}
+
+	_, err := chgr.Do(args...)
+
+	return err
+}
+
+// Inventory runs 'mtx inventory'.
+func (chgr *Changer) Inventory() error {
+	_, err := chgr.Do("inventory")
+
+	return err
+}
+
+// Inquiry runs 'mtx inquiry' and parses the output.
+func (chgr *Changer) Inquiry() (*mtx.InquiryInfo, error) {
+	out, err := chgr.Do("inquiry")
+	if err != nil {
+		return nil, err
+	}
+
+	return mtx.ParseInquiry(out)
+}
+
 func run(cmd *exec.Cmd) ([]byte, error) {
 	var stderr bytes.Buffer
 
@@ -0,0 +1,169 @@
+package sgio
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+	"unsafe"
+)
+
+// sgIO is the SG_IO ioctl request number.
+const sgIO = 0x2285
+
+// Data transfer directions of SG_IO requests.
+const (
+	dxferNone    = -1
+	dxferToDev   = -2
+	dxferFromDev = -3
+)
+
+const (
+	// statusCheckCondition is the SCSI status of a failed command; the
+	// sense data describes the failure.
+	statusCheckCondition = 0x02
+
+	// infoOKMask masks the bit of the info field that is set if the
+	// command did not complete successfully.
+	infoOKMask = 0x1
+
+	senseLen = 32
+)
+
+// sgIOHdr is struct sg_io_hdr from <scsi/sg.h>.
+type sgIOHdr struct {
+	interfaceID    int32
+	dxferDirection int32
+	cmdLen         uint8
+	mxSbLen        uint8
+	iovecCount     uint16
+	dxferLen       uint32
+	dxferp         *byte
+	cmdp           *byte
+	sbp            *byte
+	timeout        uint32
+	flags          uint32
+	packID         int32
+	usrPtr         uintptr
+	status         uint8
+	maskedStatus   uint8
+	msgStatus      uint8
+	sbLenWr        uint8
+	hostStatus     uint16
+	driverStatus   uint16
+	resid          int32
+	duration       uint32
+	info           uint32
+}
+
+// view returns the n bytes pointed to by p.
+func view(p *byte, n int) []byte {
+	if p == nil || n == 0 {
+		return nil
+	}
+
+	return (*[1 << 30]byte)(unsafe.Pointer(p))[:n:n]
+}
+
+// cdb returns the command descriptor block of the request.
+func (hdr *sgIOHdr) cdb() []byte {
+	return view(hdr.cmdp, int(hdr.cmdLen))
+}
+
+// data returns the data transfer buffer of the request.
+func (hdr *sgIOHdr) data() []byte {
+	return view(hdr.dxferp, int(hdr.dxferLen))
+}
+
+// sense returns the sense buffer of the request.
+func (hdr *sgIOHdr) sense() []byte {
+	return view(hdr.sbp, int(hdr.mxSbLen))
+}
+
+// ioctlFunc issues the SG_IO request described by hdr on the file descriptor
+// fd.
+type ioctlFunc func(fd uintptr, hdr *sgIOHdr) error
+
+// SenseError is returned when the changer fails a command with CHECK
+// CONDITION.
+type SenseError struct {
+	Key  byte
+	ASC  byte
+	ASCQ byte
+}
+
+var senseKeys = []string{
+	"NO SENSE", "RECOVERED ERROR", "NOT READY", "MEDIUM ERROR",
+	"HARDWARE ERROR", "ILLEGAL REQUEST", "UNIT ATTENTION", "DATA PROTECT",
+	"BLANK CHECK", "VENDOR SPECIFIC", "COPY ABORTED", "ABORTED COMMAND",
+	"RESERVED", "VOLUME OVERFLOW", "MISCOMPARE", "RESERVED",
+}
+
+func (e SenseError) Error() string {
+	return fmt.Sprintf("sense key %s, asc/ascq 0x%02x/0x%02x", senseKeys[e.Key&0x0f], e.ASC, e.ASCQ)
+}
+
+// parseSense decodes fixed and descriptor format sense data.
+func parseSense(sense []byte) error {
+	if len(sense) < 4 {
+		return errors.New("check condition without sense data")
+	}
+
+	switch sense[0] & 0x7f {
+	case 0x70, 0x71:
+		if len(sense) < 14 {
+			return SenseError{Key: sense[2] & 0x0f}
+		}
+
+		return SenseError{Key: sense[2] & 0x0f, ASC: sense[12], ASCQ: sense[13]}
+
+	case 0x72, 0x73:
+		return SenseError{Key: sense[1] & 0x0f, ASC: sense[2], ASCQ: sense[3]}
+	}
+
+	return fmt.Errorf("unknown sense data format 0x%02x", sense[0])
+}
+
+// exec sends cdb to the device at path. Data is read into buf or written from
+// it depending on dir. It returns the number of bytes transferred.
+func exec(ioctl ioctlFunc, path string, cdb []byte, dir int32, buf []byte, timeout time.Duration) (int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
+
+	sense := make([]byte, senseLen)
+
+	hdr := &sgIOHdr{
+		interfaceID:    'S',
+		dxferDirection: dir,
+		cmdLen:         uint8(len(cdb)),
+		mxSbLen:        uint8(len(sense)),
+		cmdp:           &cdb[0],
+		sbp:            &sense[0],
+		timeout:        uint32(timeout / time.Millisecond),
+	}
+
+	if len(buf) > 0 {
+		hdr.dxferLen = uint32(len(buf))
+		hdr.dxferp = &buf[0]
+	}
+
+	if err := ioctl(f.Fd(), hdr); err != nil {
+		return 0, fmt.Errorf("SG_IO: %v", err)
+	}
+
+	if hdr.status == statusCheckCondition {
+		return 0, parseSense(sense[:hdr.sbLenWr])
+	}
+
+	if hdr.info&infoOKMask != 0 {
+		return 0, fmt.Errorf("command 0x%02x failed: status 0x%02x, host status 0x%x, driver status 0x%x",
+			cdb[0], hdr.status, hdr.hostStatus, hdr.driverStatus,
+		)
+	}
+
+	return len(buf) - int(hdr.resid), nil
+}
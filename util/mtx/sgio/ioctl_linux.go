@@ -0,0 +1,16 @@
+package sgio
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// sysIoctl issues the SG_IO request using the ioctl system call.
+func sysIoctl(fd uintptr, hdr *sgIOHdr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, sgIO, uintptr(unsafe.Pointer(hdr)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
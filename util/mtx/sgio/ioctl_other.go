@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package sgio
+
+import "errors"
+
+// sysIoctl fails; SG_IO is specific to Linux.
+func sysIoctl(fd uintptr, hdr *sgIOHdr) error {
+	return errors.New("SG_IO is only supported on Linux")
+}
@@ -0,0 +1,478 @@
+// Package sgio implements the mtx.Interface for a scsi library auto changer by
+// issuing SCSI media changer commands directly through the SG_IO ioctl of the
+// generic scsi device (/dev/sgN).
+//
+// Slots and drives are numbered as done by 'mtx'; drives from 0, storage slots
+// from 1 and import/export slots following the storage slots.
+package sgio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bh107/tapr/util/mtx"
+)
+
+// SCSI operation codes.
+const (
+	opInquiry                 = 0x12
+	opModeSense6              = 0x1a
+	opInitializeElementStatus = 0x07
+	opMoveMedium              = 0xa5
+	opReadElementStatus       = 0xb8
+)
+
+// Element type codes.
+const (
+	elemTransport    = 0x01
+	elemStorage      = 0x02
+	elemImportExport = 0x03
+	elemDataTransfer = 0x04
+)
+
+// elementAddressPage is the mode page assigning element addresses.
+const elementAddressPage = 0x1d
+
+// Command timeouts. Moving and inventorying media involves the robot.
+const (
+	defaultTimeout    = time.Minute
+	moveTimeout       = 15 * time.Minute
+	initializeTimeout = time.Hour
+)
+
+// volTagLen is the length of a volume tag field in an element descriptor.
+const volTagLen = 36
+
+// Changer represents a library changer driven through SG_IO.
+type Changer struct {
+	path  string
+	ioctl ioctlFunc
+
+	// addrs is read from the changer on first use.
+	addrs *addresses
+}
+
+// New returns a new changer implementation issuing commands to the generic
+// scsi device at path.
+func New(path string) *Changer {
+	return &Changer{
+		path:  path,
+		ioctl: sysIoctl,
+	}
+}
+
+// addresses is the element address assignment of the changer.
+type addresses struct {
+	transport, numTransport int
+	storage, numStorage     int
+	mail, numMail           int
+	drive, numDrives        int
+}
+
+func (chgr *Changer) exec(cdb []byte, dir int32, buf []byte, timeout time.Duration) (int, error) {
+	return exec(chgr.ioctl, chgr.path, cdb, dir, buf, timeout)
+}
+
+// Inquiry identifies the changer.
+func (chgr *Changer) Inquiry() (*mtx.InquiryInfo, error) {
+	buf := make([]byte, 96)
+	cdb := []byte{opInquiry, 0, 0, 0, byte(len(buf)), 0}
+
+	n, err := chgr.exec(cdb, dxferFromDev, buf, defaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if n < 36 {
+		return nil, fmt.Errorf("short inquiry data: %d bytes", n)
+	}
+
+	return &mtx.InquiryInfo{
+		Vendor:   strings.TrimSpace(string(buf[8:16])),
+		Product:  strings.TrimSpace(string(buf[16:32])),
+		Revision: strings.TrimSpace(string(buf[32:36])),
+	}, nil
+}
+
+// addresses returns the element address assignment of the changer.
+func (chgr *Changer) addresses() (*addresses, error) {
+	if chgr.addrs != nil {
+		return chgr.addrs, nil
+	}
+
+	buf := make([]byte, 255)
+
+	// disable block descriptors
+	cdb := []byte{opModeSense6, 0x08, elementAddressPage, 0, byte(len(buf)), 0}
+
+	n, err := chgr.exec(cdb, dxferFromDev, buf, defaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if n < 4 {
+		return nil, fmt.Errorf("short mode sense data: %d bytes", n)
+	}
+
+	// skip the mode parameter header and any block descriptors; some
+	// changers return block descriptors even though they were disabled
+	off := 4 + int(buf[3])
+	if off > n {
+		return nil, fmt.Errorf("block descriptor length %d exceeds mode sense data of %d bytes", buf[3], n)
+	}
+
+	page := buf[off:n]
+	if len(page) < 18 || page[0]&0x3f != elementAddressPage {
+		return nil, errors.New("invalid element address assignment page")
+	}
+
+	u16 := func(off int) int {
+		return int(binary.BigEndian.Uint16(page[off:]))
+	}
+
+	chgr.addrs = &addresses{
+		transport: u16(2), numTransport: u16(4),
+		storage: u16(6), numStorage: u16(8),
+		mail: u16(10), numMail: u16(12),
+		drive: u16(14), numDrives: u16(16),
+	}
+
+	return chgr.addrs, nil
+}
+
+// element is an element descriptor read by READ ELEMENT STATUS.
+type element struct {
+	typ    byte
+	addr   int
+	full   bool
+	except bool
+	asc    byte
+	ascq   byte
+
+	// source is the address of the element the medium was last moved from
+	// if valid is set.
+	source int
+	valid  bool
+
+	// tag and alt are the primary and alternate volume tags.
+	tag string
+	alt string
+}
+
+// readElementStatus reads the status of n elements of type typ starting at
+// address start.
+func (chgr *Changer) readElementStatus(typ byte, start int, n int) ([]*element, error) {
+	if n == 0 {
+		return nil, nil
+	}
+
+	// room for the headers and descriptors with both volume tags and a
+	// device identifier
+	size := 8 + 8 + n*(12+2*volTagLen+36)
+	if size > 0xffffff {
+		size = 0xffffff
+	}
+
+	buf := make([]byte, size)
+
+	cdb := make([]byte, 12)
+	cdb[0] = opReadElementStatus
+	cdb[1] = 0x10 | typ // report volume tags
+	binary.BigEndian.PutUint16(cdb[2:], uint16(start))
+	binary.BigEndian.PutUint16(cdb[4:], uint16(n))
+	cdb[7] = byte(size >> 16)
+	cdb[8] = byte(size >> 8)
+	cdb[9] = byte(size)
+
+	m, err := chgr.exec(cdb, dxferFromDev, buf, defaultTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseElementStatus(buf[:m])
+}
+
+func u24(p []byte) int {
+	return int(p[0])<<16 | int(p[1])<<8 | int(p[2])
+}
+
+// parseElementStatus decodes READ ELEMENT STATUS data.
+func parseElementStatus(buf []byte) ([]*element, error) {
+	if len(buf) < 8 {
+		return nil, fmt.Errorf("short element status data: %d bytes", len(buf))
+	}
+
+	// the report may have been truncated to the allocation length
+	end := 8 + u24(buf[5:])
+	if end > len(buf) {
+		end = len(buf)
+	}
+
+	var elems []*element
+
+	for off := 8; off+8 <= end; {
+		typ := buf[off] & 0x0f
+		pvoltag := buf[off+1]&0x80 != 0
+		avoltag := buf[off+1]&0x40 != 0
+		descLen := int(binary.BigEndian.Uint16(buf[off+2:]))
+		pageEnd := off + 8 + u24(buf[off+5:])
+		if pageEnd > end {
+			pageEnd = end
+		}
+
+		if descLen < 12 {
+			return nil, fmt.Errorf("invalid element descriptor length %d", descLen)
+		}
+
+		for desc := off + 8; desc+descLen <= pageEnd; desc += descLen {
+			d := buf[desc : desc+descLen]
+
+			elem := &element{
+				typ:    typ,
+				addr:   int(binary.BigEndian.Uint16(d)),
+				full:   d[2]&0x01 != 0,
+				except: d[2]&0x04 != 0,
+				asc:    d[4],
+				ascq:   d[5],
+				valid:  d[9]&0x80 != 0,
+				source: int(binary.BigEndian.Uint16(d[10:])),
+			}
+
+			tags := d[12:]
+			if pvoltag && len(tags) >= volTagLen {
+				elem.tag = volTag(tags[:volTagLen])
+				tags = tags[volTagLen:]
+			}
+
+			if avoltag && len(tags) >= volTagLen {
+				elem.alt = volTag(tags[:volTagLen])
+			}
+
+			elems = append(elems, elem)
+		}
+
+		off = pageEnd
+	}
+
+	return elems, nil
+}
+
+// volTag returns the volume identifier of a volume tag field.
+func volTag(p []byte) string {
+	return strings.TrimRight(string(p[:32]), " \x00")
+}
+
+// Status reads the status of all drives, storage slots and import/export
+// slots.
+func (chgr *Changer) Status() (*mtx.StatusInfo, error) {
+	addrs, err := chgr.addresses()
+	if err != nil {
+		return nil, err
+	}
+
+	drives, err := chgr.readElementStatus(elemDataTransfer, addrs.drive, addrs.numDrives)
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := chgr.readElementStatus(elemStorage, addrs.storage, addrs.numStorage)
+	if err != nil {
+		return nil, err
+	}
+
+	mail, err := chgr.readElementStatus(elemImportExport, addrs.mail, addrs.numMail)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &mtx.StatusInfo{
+		MaxDrives:       addrs.numDrives,
+		NumSlots:        addrs.numStorage + addrs.numMail,
+		NumStorageSlots: addrs.numStorage,
+		NumMailSlots:    addrs.numMail,
+
+		Drives: make([]*mtx.Slot, 0, len(drives)),
+		Slots:  make([]*mtx.Slot, 0, len(storage)+len(mail)),
+	}
+
+	for _, elem := range drives {
+		slot := &mtx.Slot{
+			Num:  elem.addr - addrs.drive,
+			Type: mtx.DataTransferSlot,
+			Addr: elem.addr,
+		}
+
+		if elem.full {
+			slot.Vol = &mtx.Volume{Serial: elem.tag, AltSerial: elem.alt}
+			if elem.valid {
+				slot.Vol.Home = addrs.slot(elem.source)
+			}
+		}
+
+		status.Drives = append(status.Drives, slot)
+	}
+
+	for _, elem := range append(storage, mail...) {
+		slot := &mtx.Slot{
+			Num:  addrs.slot(elem.addr),
+			Type: mtx.StorageSlot,
+			Addr: elem.addr,
+		}
+
+		if elem.typ == elemImportExport {
+			slot.Type = mtx.MailSlot
+		}
+
+		if elem.full {
+			slot.Vol = &mtx.Volume{Serial: elem.tag, AltSerial: elem.alt, Home: slot.Num}
+		}
+
+		status.Slots = append(status.Slots, slot)
+	}
+
+	return status, nil
+}
+
+// slot returns the slot number of the storage or import/export element at
+// addr, or 0 if there is none.
+func (addrs *addresses) slot(addr int) int {
+	if addr >= addrs.storage && addr < addrs.storage+addrs.numStorage {
+		return addr - addrs.storage + 1
+	}
+
+	if addr >= addrs.mail && addr < addrs.mail+addrs.numMail {
+		return addrs.numStorage + addr - addrs.mail + 1
+	}
+
+	return 0
+}
+
+// slotAddr returns the element address of slot number n.
+func (addrs *addresses) slotAddr(n int) (int, error) {
+	if n >= 1 && n <= addrs.numStorage {
+		return addrs.storage + n - 1, nil
+	}
+
+	if n > addrs.numStorage && n <= addrs.numStorage+addrs.numMail {
+		return addrs.mail + n - addrs.numStorage - 1, nil
+	}
+
+	return 0, fmt.Errorf("no such slot: %d", n)
+}
+
+// driveAddr returns the element address of drive number n.
+func (addrs *addresses) driveAddr(n int) (int, error) {
+	if n < 0 || n >= addrs.numDrives {
+		return 0, fmt.Errorf("no such drive: %d", n)
+	}
+
+	return addrs.drive + n, nil
+}
+
+// addr returns the element address of e.
+func (addrs *addresses) addr(e mtx.Element) (int, error) {
+	if e.IsDrive() {
+		return addrs.driveAddr(e.Num)
+	}
+
+	return addrs.slotAddr(e.Num)
+}
+
+// Move moves the volume in src to dst using the first medium transport
+// element.
+func (chgr *Changer) Move(src, dst mtx.Element) error {
+	addrs, err := chgr.addresses()
+	if err != nil {
+		return err
+	}
+
+	from, err := addrs.addr(src)
+	if err != nil {
+		return err
+	}
+
+	to, err := addrs.addr(dst)
+	if err != nil {
+		return err
+	}
+
+	cdb := make([]byte, 12)
+	cdb[0] = opMoveMedium
+	binary.BigEndian.PutUint16(cdb[2:], uint16(addrs.transport))
+	binary.BigEndian.PutUint16(cdb[4:], uint16(from))
+	binary.BigEndian.PutUint16(cdb[6:], uint16(to))
+
+	_, err = chgr.exec(cdb, dxferNone, nil, moveTimeout)
+
+	return err
+}
+
+// Inventory makes the changer take inventory of all elements, e.g. by
+// scanning the barcodes of all volumes.
+func (chgr *Changer) Inventory() error {
+	cdb := []byte{opInitializeElementStatus, 0, 0, 0, 0, 0}
+
+	_, err := chgr.exec(cdb, dxferNone, nil, initializeTimeout)
+
+	return err
+}
+
+// Do performs the given operation using the arguments of the 'mtx' program.
+// The status is formatted as done by 'mtx'.
+func (chgr *Changer) Do(args ...string) ([]byte, error) {
+	if len(args) < 1 {
+		return nil, errors.New("no command given")
+	}
+
+	switch args[0] {
+	case "status":
+		status, err := chgr.Status()
+		if err != nil {
+			return nil, err
+		}
+
+		return mtx.Format(chgr.path, status), nil
+
+	case "inquiry":
+		info, err := chgr.Inquiry()
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte(fmt.Sprintf("Product Type: Medium Changer\nVendor ID: '%s'\nProduct ID: '%s'\nRevision: '%s'\n",
+			info.Vendor, info.Product, info.Revision,
+		)), nil
+
+	case "inventory":
+		return nil, chgr.Inventory()
+	}
+
+	if len(args) != 3 {
+		return nil, errors.New("wrong number of arguments")
+	}
+
+	a, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := strconv.Atoi(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	switch args[0] {
+	case "load":
+		return nil, mtx.Load(chgr, a, b)
+	case "unload":
+		return nil, mtx.Unload(chgr, a, b)
+	case "transfer":
+		return nil, mtx.Transfer(chgr, a, b)
+	}
+
+	return nil, errors.New("mtx/sgio: unknown or unsupported mtx command")
+}
@@ -0,0 +1,352 @@
+package sgio
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bh107/tapr/util/mtx"
+)
+
+// library simulates a media changer at the level of the SG_IO ioctl.
+type library struct {
+	transport int
+	drives    []int
+	storage   []int
+	mail      []int
+
+	// tags holds the volume tag of each full element and source the
+	// element it was moved from.
+	tags   map[int]string
+	source map[int]int
+
+	// cmds records the operation codes issued.
+	cmds []byte
+
+	// descLen, if set, is the block descriptor length reported by MODE
+	// SENSE, which ignores DBD on some changers.
+	descLen byte
+}
+
+func newLibrary() *library {
+	lib := &library{
+		transport: 1,
+		drives:    []int{256, 257},
+		storage:   []int{4096, 4097, 4098, 4099},
+		mail:      []int{16},
+		tags:      make(map[int]string),
+		source:    make(map[int]int),
+	}
+
+	lib.tags[4096] = "S00001L6"
+	lib.tags[4098] = "S00003L6"
+	lib.tags[16] = "S00009L6"
+
+	return lib
+}
+
+func (lib *library) check(hdr *sgIOHdr, key, asc, ascq byte) error {
+	sense := hdr.sense()
+	for i := range sense {
+		sense[i] = 0
+	}
+
+	sense[0] = 0x70
+	sense[2] = key
+	sense[7] = 10
+	sense[12] = asc
+	sense[13] = ascq
+
+	hdr.status = statusCheckCondition
+	hdr.sbLenWr = 18
+	hdr.info |= infoOKMask
+
+	return nil
+}
+
+func (lib *library) ioctl(fd uintptr, hdr *sgIOHdr) error {
+	cdb := hdr.cdb()
+	lib.cmds = append(lib.cmds, cdb[0])
+
+	var resp []byte
+
+	switch cdb[0] {
+	case opInquiry:
+		resp = make([]byte, 36)
+		resp[0] = 0x08 // medium changer
+		copy(resp[8:], "ACME    ")
+		copy(resp[16:], "TapeMaster 3000 ")
+		copy(resp[32:], "0042")
+
+	case opModeSense6:
+		if cdb[2]&0x3f != elementAddressPage {
+			return lib.check(hdr, 0x05, 0x24, 0x00)
+		}
+
+		page := make([]byte, 20)
+		page[0] = elementAddressPage
+		page[1] = 18
+		put := func(off, first, n int) {
+			binary.BigEndian.PutUint16(page[off:], uint16(first))
+			binary.BigEndian.PutUint16(page[off+2:], uint16(n))
+		}
+
+		put(2, lib.transport, 1)
+		put(6, lib.storage[0], len(lib.storage))
+		put(10, lib.mail[0], len(lib.mail))
+		put(14, lib.drives[0], len(lib.drives))
+
+		resp = append([]byte{byte(3 + len(page)), 0, 0, lib.descLen}, page...)
+
+	case opReadElementStatus:
+		resp = lib.readElementStatus(cdb)
+
+	case opMoveMedium:
+		src := int(binary.BigEndian.Uint16(cdb[4:]))
+		dst := int(binary.BigEndian.Uint16(cdb[6:]))
+
+		tag, ok := lib.tags[src]
+		if !ok {
+			// medium source element empty
+			return lib.check(hdr, 0x05, 0x3b, 0x0e)
+		}
+
+		if _, ok := lib.tags[dst]; ok {
+			// medium destination element full
+			return lib.check(hdr, 0x05, 0x3b, 0x0d)
+		}
+
+		delete(lib.tags, src)
+		delete(lib.source, src)
+		lib.tags[dst] = tag
+		lib.source[dst] = src
+
+	case opInitializeElementStatus:
+
+	default:
+		// invalid command operation code
+		return lib.check(hdr, 0x05, 0x20, 0x00)
+	}
+
+	buf := hdr.data()
+	n := copy(buf, resp)
+	hdr.resid = int32(len(buf) - n)
+
+	return nil
+}
+
+func (lib *library) readElementStatus(cdb []byte) []byte {
+	var addrs []int
+	switch cdb[1] & 0x0f {
+	case elemStorage:
+		addrs = lib.storage
+	case elemImportExport:
+		addrs = lib.mail
+	case elemDataTransfer:
+		addrs = lib.drives
+	}
+
+	start := int(binary.BigEndian.Uint16(cdb[2:]))
+	n := int(binary.BigEndian.Uint16(cdb[4:]))
+
+	const descLen = 12 + volTagLen
+
+	var descs []byte
+	var first, count int
+	for _, addr := range addrs {
+		if addr < start || count == n {
+			continue
+		}
+
+		if count == 0 {
+			first = addr
+		}
+
+		count++
+
+		d := make([]byte, descLen)
+		binary.BigEndian.PutUint16(d, uint16(addr))
+
+		if tag, ok := lib.tags[addr]; ok {
+			d[2] = 0x01
+			copy(d[12:], tag+strings.Repeat(" ", volTagLen-len(tag)))
+
+			if src, ok := lib.source[addr]; ok {
+				d[9] = 0x80
+				binary.BigEndian.PutUint16(d[10:], uint16(src))
+			}
+		}
+
+		descs = append(descs, d...)
+	}
+
+	page := make([]byte, 8)
+	page[0] = cdb[1] & 0x0f
+	page[1] = 0x80 // primary volume tags
+	binary.BigEndian.PutUint16(page[2:], descLen)
+	page[5] = byte(len(descs) >> 16)
+	page[6] = byte(len(descs) >> 8)
+	page[7] = byte(len(descs))
+
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint16(hdr, uint16(first))
+	binary.BigEndian.PutUint16(hdr[2:], uint16(count))
+	size := len(page) + len(descs)
+	hdr[5] = byte(size >> 16)
+	hdr[6] = byte(size >> 8)
+	hdr[7] = byte(size)
+
+	return append(append(hdr, page...), descs...)
+}
+
+func setup(t *testing.T) (*Changer, *library) {
+	f, err := ioutil.TempFile("", "sgio")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	lib := newLibrary()
+
+	return &Changer{path: f.Name(), ioctl: lib.ioctl}, lib
+}
+
+func teardown(chgr *Changer) {
+	os.Remove(chgr.path)
+}
+
+func TestStatus(t *testing.T) {
+	chgr, _ := setup(t)
+	defer teardown(chgr)
+
+	if err := mtx.Load(chgr, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := chgr.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.MaxDrives != 2 || status.NumSlots != 5 || status.NumStorageSlots != 4 || status.NumMailSlots != 1 {
+		t.Fatalf("unexpected parameters: %+v", status)
+	}
+
+	if len(status.Drives) != 2 || len(status.Slots) != 5 {
+		t.Fatalf("unexpected number of elements: %d drives, %d slots", len(status.Drives), len(status.Slots))
+	}
+
+	if status.Drives[0].Vol != nil {
+		t.Errorf("drive 0 should be empty, holds %v", status.Drives[0].Vol)
+	}
+
+	if vol := status.Drives[1].Vol; vol == nil || vol.Serial != "S00003L6" || vol.Home != 3 {
+		t.Errorf("drive 1 should hold S00003L6 from slot 3, holds %+v", vol)
+	}
+
+	if status.Drives[1].Addr != 257 {
+		t.Errorf("drive 1 should have address 257, has %d", status.Drives[1].Addr)
+	}
+
+	if slot := status.Slots[0]; slot.Num != 1 || slot.Vol == nil || slot.Vol.Serial != "S00001L6" {
+		t.Errorf("slot 1 should hold S00001L6: %v", slot)
+	}
+
+	if slot := status.Slots[2]; slot.Vol != nil {
+		t.Errorf("slot 3 should be empty: %v", slot)
+	}
+
+	if slot := status.Slots[4]; slot.Num != 5 || slot.Type != mtx.MailSlot || slot.Vol == nil || slot.Vol.Serial != "S00009L6" {
+		t.Errorf("slot 5 should be a mail slot holding S00009L6: %v", slot)
+	}
+
+	// the formatted status must be understood by the text parser
+	parsed, err := mtx.ParseStatus(mtx.Format(chgr.path, status))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.NumSlots != 5 || len(parsed.Slots) != 5 || len(parsed.Warnings) > 0 || parsed.Drives[1].Vol.Serial != "S00003L6" {
+		t.Errorf("unexpected status parsed from formatted status: %+v", parsed)
+	}
+}
+
+func TestMove(t *testing.T) {
+	chgr, lib := setup(t)
+	defer teardown(chgr)
+
+	if err := mtx.Load(chgr, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if lib.tags[256] != "S00001L6" {
+		t.Fatalf("drive 0 should hold S00001L6")
+	}
+
+	// unload to home slot
+	if err := mtx.Unload(chgr, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if lib.tags[4096] != "S00001L6" {
+		t.Fatalf("slot 1 should hold S00001L6")
+	}
+
+	// import from the mail slot
+	if _, err := chgr.Do("transfer", "5", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if lib.tags[4097] != "S00009L6" {
+		t.Fatalf("slot 2 should hold S00009L6")
+	}
+
+	err := mtx.Load(chgr, 4, 0)
+	if e, ok := err.(SenseError); !ok || e.Key != 0x05 || e.ASC != 0x3b || e.ASCQ != 0x0e {
+		t.Fatalf("loading from an empty slot should fail with an illegal request, got %v", err)
+	}
+
+	if err := mtx.Transfer(chgr, 1, 2); err == nil {
+		t.Fatal("transfer to a full slot should fail")
+	}
+
+	if err := mtx.Load(chgr, 9, 0); err == nil {
+		t.Fatal("load from a non-existing slot should fail")
+	}
+}
+
+func TestInquiry(t *testing.T) {
+	chgr, lib := setup(t)
+	defer teardown(chgr)
+
+	info, err := chgr.Inquiry()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Vendor != "ACME" || info.Product != "TapeMaster 3000" || info.Revision != "0042" {
+		t.Errorf("unexpected inquiry data: %+v", info)
+	}
+
+	if err := chgr.Inventory(); err != nil {
+		t.Fatal(err)
+	}
+
+	if lib.cmds[len(lib.cmds)-1] != opInitializeElementStatus {
+		t.Errorf("expected INITIALIZE ELEMENT STATUS, got 0x%02x", lib.cmds[len(lib.cmds)-1])
+	}
+}
+
+func TestBlockDescriptorLength(t *testing.T) {
+	chgr, lib := setup(t)
+	defer teardown(chgr)
+
+	lib.descLen = 200
+
+	if _, err := chgr.Status(); err == nil {
+		t.Fatal("expected error for a block descriptor length beyond the mode sense data")
+	}
+}